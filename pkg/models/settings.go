@@ -3,15 +3,141 @@ package models
 import (
 	"encoding/json"
 	"fmt"
+	"regexp"
 
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 )
 
 type PluginSettings struct {
 	StepFunctionArn string `json:"stepFunctionArn"`
 	S3Bucket        string `json:"s3Bucket"`
+
+	// AuditS3Prefix enables writing audit events as JSON lines to objects
+	// below this prefix in the S3 bucket
+	AuditS3Prefix string `json:"auditS3Prefix"`
+
+	// Grafana roles allowed to check the status of jobs, to request new
+	// extractions and to download the unanonymized captures, by default the
+	// roles allowed to request them
+	StatusRoles   []string `json:"statusRoles"`
+	RequestRoles  []string `json:"requestRoles"`
+	DownloadRoles []string `json:"downloadRoles"`
+
+	// ShareJobsWithinOrg makes jobs visible to every user of the organization
+	// they were requested in instead of only to the requesting user
+	ShareJobsWithinOrg bool `json:"shareJobsWithinOrg"`
+
+	// Limits on extraction requests, zero disables a limit
+	MaxRunningJobsPerUser int `json:"maxRunningJobsPerUser"`
+	MaxRunningJobsPerOrg  int `json:"maxRunningJobsPerOrg"`
+	MaxPacketsPerRequest  int `json:"maxPacketsPerRequest"`
+	MaxFilesPerRequest    int `json:"maxFilesPerRequest"`
+	DailyPacketBudget     int `json:"dailyPacketBudget"` // per user
+	MaxRequestsPerMinute  int `json:"maxRequestsPerMinute"`
+
+	// Limits on the extract of a request, zero disables a limit
+	MaxPacketNumber     int `json:"maxPacketNumber"`
+	MaxRangesPerRequest int `json:"maxRangesPerRequest"`
+	MaxFileNameLength   int `json:"maxFileNameLength"`
+
+	// SourcePrefixes restricts the source files of an extract to keys below
+	// one of these prefixes, CheckSourceFiles verifies that they exist in the
+	// SourceBucket (the S3Bucket if empty) before a job is started
+	SourcePrefixes   []string `json:"sourcePrefixes"`
+	CheckSourceFiles bool     `json:"checkSourceFiles"`
+	SourceBucket     string   `json:"sourceBucket"`
+
+	// S3AssumeRoleArn is the role assumed to access the buckets, e.g. in
+	// another account, instead of the role of the data source. Captures are
+	// presigned with it, while executions keep the role of the data source.
+	S3AssumeRoleArn string `json:"s3AssumeRoleArn"`
+	S3ExternalId    string `json:"s3ExternalId"`
+
+	// Targets are further state machines with their buckets, e.g. in other
+	// regions. Source files are routed to the first target with a matching
+	// prefix, all others to the state machine and buckets above.
+	Targets []Target `json:"targets"`
+
+	// UpstreamDatasources are the UIDs of the data sources whose queries
+	// requests may build their extract from
+	UpstreamDatasources []string `json:"upstreamDatasources"`
+
+	// Columns of query results naming the source file and the number of a
+	// packet, and optionally its capture time to order the files of an extract
+	SourceFileColumn   string `json:"sourceFileColumn"`
+	PacketNumberColumn string `json:"packetNumberColumn"`
+	TimestampColumn    string `json:"timestampColumn"`
+
+	// ExtractEncoding is how the packets of an extract are passed to the
+	// state machine, plain lists or ranges
+	ExtractEncoding string `json:"extractEncoding"`
+
+	// MaxConcurrentQueries bounds how many queries of a request run in parallel
+	MaxConcurrentQueries int `json:"maxConcurrentQueries"`
+
+	// MaxRetryAttempts bounds the attempts of a throttled or failed AWS call
+	MaxRetryAttempts int `json:"maxRetryAttempts"`
+
+	// LogLevel is the least severe level logged for this data source, one of
+	// debug, info, warn and error
+	LogLevel string `json:"logLevel"`
 }
 
+// Target is a state machine extracting the packets of the source files below
+// its prefixes, with the bucket it writes captures to and the bucket holding
+// the source files (the S3Bucket if empty). The region defaults to the one of
+// the state machine. Executions are started with AssumeRoleArn and the buckets
+// accessed with S3AssumeRoleArn, which default to the roles of the data source.
+type Target struct {
+	Name            string   `json:"name"`
+	Region          string   `json:"region"`
+	StepFunctionArn string   `json:"stepFunctionArn"`
+	S3Bucket        string   `json:"s3Bucket"`
+	SourceBucket    string   `json:"sourceBucket"`
+	SourcePrefixes  []string `json:"sourcePrefixes"`
+
+	AssumeRoleArn   string `json:"assumeRoleArn"`
+	ExternalId      string `json:"externalId"`
+	S3AssumeRoleArn string `json:"s3AssumeRoleArn"`
+	S3ExternalId    string `json:"s3ExternalId"`
+}
+
+// DefaultTargetName is the name of the target made of the top level
+// settings, it is reserved.
+const DefaultTargetName = "default"
+
+// targetNamePattern matches names that are valid in execution names.
+var targetNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+var (
+	DefaultStatusRoles  = []string{"Viewer", "Editor", "Admin"}
+	DefaultRequestRoles = []string{"Editor", "Admin"}
+)
+
+const (
+	DefaultMaxConcurrentQueries = 4
+	DefaultMaxRetryAttempts     = 5
+
+	// DefaultMaxFileNameLength is the maximum length of S3 object keys
+	DefaultMaxFileNameLength = 1024
+
+	DefaultSourceFileColumn   = "source_file"
+	DefaultPacketNumberColumn = "source_packet_number"
+)
+
+const (
+	ExtractEncodingList   = "list"
+	ExtractEncodingRanges = "ranges"
+)
+
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+)
+
 func LoadPluginSettings(source backend.DataSourceInstanceSettings) (*PluginSettings, error) {
 	settings := PluginSettings{}
 	err := json.Unmarshal(source.JSONData, &settings)
@@ -19,5 +145,114 @@ func LoadPluginSettings(source backend.DataSourceInstanceSettings) (*PluginSetti
 		return nil, fmt.Errorf("could not unmarshal PluginSettings json: %w", err)
 	}
 
+	if len(settings.StatusRoles) == 0 {
+		settings.StatusRoles = DefaultStatusRoles
+	}
+	if len(settings.RequestRoles) == 0 {
+		settings.RequestRoles = DefaultRequestRoles
+	}
+	if len(settings.DownloadRoles) == 0 {
+		settings.DownloadRoles = settings.RequestRoles
+	}
+	if settings.MaxConcurrentQueries <= 0 {
+		settings.MaxConcurrentQueries = DefaultMaxConcurrentQueries
+	}
+	if settings.MaxRetryAttempts <= 0 {
+		settings.MaxRetryAttempts = DefaultMaxRetryAttempts
+	}
+	if settings.MaxFileNameLength <= 0 {
+		settings.MaxFileNameLength = DefaultMaxFileNameLength
+	}
+	if settings.SourceBucket == "" {
+		settings.SourceBucket = settings.S3Bucket
+	}
+	if settings.SourceFileColumn == "" {
+		settings.SourceFileColumn = DefaultSourceFileColumn
+	}
+	if settings.PacketNumberColumn == "" {
+		settings.PacketNumberColumn = DefaultPacketNumberColumn
+	}
+	if settings.SourceFileColumn == settings.PacketNumberColumn {
+		return nil, fmt.Errorf("the source file and packet number columns must differ, both are %q", settings.SourceFileColumn)
+	}
+	if err := checkRole("the buckets", settings.S3AssumeRoleArn, settings.S3ExternalId); err != nil {
+		return nil, err
+	}
+	if err := loadTargets(&settings); err != nil {
+		return nil, err
+	}
+	switch settings.ExtractEncoding {
+	case "":
+		settings.ExtractEncoding = ExtractEncodingList
+	case ExtractEncodingList, ExtractEncodingRanges:
+	default:
+		return nil, fmt.Errorf("invalid extract encoding %q, expected list or ranges", settings.ExtractEncoding)
+	}
+	switch settings.LogLevel {
+	case "":
+		settings.LogLevel = LogLevelInfo
+	case LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError:
+	default:
+		return nil, fmt.Errorf("invalid log level %q, expected debug, info, warn or error", settings.LogLevel)
+	}
+
 	return &settings, nil
 }
+
+// checkRole validates an assume role ARN and the external ID that comes with it.
+func checkRole(of, roleArn, externalId string) error {
+	if roleArn == "" {
+		if externalId != "" {
+			return fmt.Errorf("the external ID of %s requires an assume role ARN", of)
+		}
+		return nil
+	}
+	if _, err := arn.Parse(roleArn); err != nil {
+		return fmt.Errorf("invalid assume role ARN of %s: %w", of, err)
+	}
+	return nil
+}
+
+// loadTargets validates targets and fills in their defaults.
+func loadTargets(settings *PluginSettings) error {
+	names := map[string]bool{}
+	for i := range settings.Targets {
+		target := &settings.Targets[i]
+		if !targetNamePattern.MatchString(target.Name) || target.Name == DefaultTargetName {
+			return fmt.Errorf("invalid target name %q, expected up to 32 letters, digits, '-' or '_' other than %q", target.Name, DefaultTargetName)
+		}
+		if names[target.Name] {
+			return fmt.Errorf("duplicate target %q", target.Name)
+		}
+		names[target.Name] = true
+
+		stateMachine, err := arn.Parse(target.StepFunctionArn)
+		if err != nil {
+			return fmt.Errorf("invalid Step Function ARN of target %q: %w", target.Name, err)
+		}
+		if target.S3Bucket == "" {
+			return fmt.Errorf("target %q has no S3 bucket", target.Name)
+		}
+		if len(target.SourcePrefixes) == 0 {
+			return fmt.Errorf("target %q has no source prefixes", target.Name)
+		}
+		if target.Region == "" {
+			target.Region = stateMachine.Region
+		}
+		if target.SourceBucket == "" {
+			target.SourceBucket = target.S3Bucket
+		}
+
+		of := fmt.Sprintf("target %q", target.Name)
+		if err := checkRole(of, target.AssumeRoleArn, target.ExternalId); err != nil {
+			return err
+		}
+		if err := checkRole("the buckets of "+of, target.S3AssumeRoleArn, target.S3ExternalId); err != nil {
+			return err
+		}
+		if target.S3AssumeRoleArn == "" {
+			target.S3AssumeRoleArn, target.S3ExternalId = settings.S3AssumeRoleArn, settings.S3ExternalId
+		}
+	}
+	return nil
+}
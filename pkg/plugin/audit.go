@@ -0,0 +1,286 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// auditLogger receives every audit event, independent of the S3 audit trail.
+var auditLogger = backend.Logger.With("logger", "pcap-extractor.audit")
+
+const (
+	auditActionRequest   = "request"
+	auditActionURLIssued = "url_issued"
+	auditActionDownload  = "download"
+	auditActionRetry     = "retry"
+	auditActionStop      = "stop"
+
+	auditOutcomeSuccess = "success"
+	auditOutcomeFailure = "failure"
+	auditOutcomeDenied  = "denied"
+
+	// auditQueueSize is the number of audit events waiting to be written to
+	// S3 in the background.
+	auditQueueSize = 1000
+
+	// auditWriteTimeout bounds writing an audit event to S3 in the
+	// background, auditFlushTimeout writing the queued events on dispose.
+	auditWriteTimeout = 30 * time.Second
+	auditFlushTimeout = 10 * time.Second
+)
+
+// AuditEvent records who extracted or downloaded which capture.
+type AuditEvent struct {
+	Time          time.Time `json:"time"`
+	Action        string    `json:"action"`
+	Outcome       string    `json:"outcome"`
+	Error         string    `json:"error,omitempty"`
+	JobId         string    `json:"jobId,omitempty"`
+	UserLogin     string    `json:"userLogin,omitempty"`
+	UserEmail     string    `json:"userEmail,omitempty"`
+	UserRole      string    `json:"userRole,omitempty"`
+	OrgId         int64     `json:"orgId,omitempty"`
+	DatasourceUID string    `json:"datasourceUID,omitempty"`
+	ClientIP      string    `json:"clientIP,omitempty"`
+	Files         int       `json:"files,omitempty"`
+	Packets       int       `json:"packets,omitempty"`
+}
+
+type clientIPKey struct{}
+
+func withClientIP(ctx context.Context, ip string) context.Context {
+	if ip == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+func clientIPFromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey{}).(string)
+	return ip
+}
+
+// clientIP returns the address of the client that sent the request to
+// Grafana, as far as the forwarded headers tell.
+func clientIP(headers http.Header, remoteAddr string) string {
+	if forwarded := headers.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	if realIP := headers.Get("X-Real-Ip"); realIP != "" {
+		return realIP
+	}
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+func newAuditEvent(ctx context.Context, action, jobId string) *AuditEvent {
+	pCtx := backend.PluginConfigFromContext(ctx)
+
+	event := &AuditEvent{
+		Time:     time.Now().UTC(),
+		Action:   action,
+		Outcome:  auditOutcomeSuccess,
+		JobId:    jobId,
+		OrgId:    pCtx.OrgID,
+		ClientIP: clientIPFromContext(ctx),
+	}
+	if pCtx.DataSourceInstanceSettings != nil {
+		event.DatasourceUID = pCtx.DataSourceInstanceSettings.UID
+	}
+	if user := backend.UserFromContext(ctx); user != nil {
+		event.UserLogin = user.Login
+		event.UserEmail = user.Email
+		event.UserRole = user.Role
+	}
+	return event
+}
+
+func (e *AuditEvent) countExtract(extract map[string][]int) {
+	e.Files = len(extract)
+	e.Packets = 0
+	for _, packets := range extract {
+		e.Packets += len(packets)
+	}
+}
+
+func (e *AuditEvent) fail(message string) {
+	e.Outcome = auditOutcomeFailure
+	e.Error = message
+}
+
+func (e *AuditEvent) deny(message string) {
+	e.Outcome = auditOutcomeDenied
+	e.Error = message
+}
+
+// failOnError marks the event as failed or denied if the data response
+// carries an error.
+func (e *AuditEvent) failOnError(response backend.DataResponse) {
+	switch {
+	case response.Error == nil:
+	case response.Status == backend.StatusForbidden:
+		e.deny(response.Error.Error())
+	default:
+		e.fail(response.Error.Error())
+	}
+}
+
+// emitAudit logs the event to the audit logger and, if configured, writes it
+// to the audit prefix in S3 in the background. Audit events are never dropped
+// silently, a failure to store one is logged as an error.
+func (d *Datasource) emitAudit(ctx context.Context, event *AuditEvent) {
+	auditLogger.Info("Audit event",
+		"action", event.Action,
+		"outcome", event.Outcome,
+		"error", event.Error,
+		"jobId", event.JobId,
+		"userLogin", event.UserLogin,
+		"userEmail", event.UserEmail,
+		"userRole", event.UserRole,
+		"orgId", event.OrgId,
+		"datasourceUID", event.DatasourceUID,
+		"clientIP", event.ClientIP,
+		"files", event.Files,
+		"packets", event.Packets)
+
+	if d.settings.AuditS3Prefix == "" || d.s3Client == nil {
+		return
+	}
+	if d.audit.enqueue(event) {
+		return
+	}
+	storeAuditEvent(ctx, d.writeAuditEvent, event)
+}
+
+// storeAuditEvent writes an audit event, a failure is logged as an error.
+func storeAuditEvent(ctx context.Context, write func(context.Context, *AuditEvent) error, event *AuditEvent) {
+	if err := write(ctx, event); err != nil {
+		auditLogger.Error("Failed to write audit event to S3", "error", err, "action", event.Action, "jobId", event.JobId)
+	}
+}
+
+// auditWriter writes audit events to S3 in the background, so that queries
+// do not wait for S3. Events that do not fit into its queue are written
+// right away by the caller instead of being dropped.
+type auditWriter struct {
+	write  func(context.Context, *AuditEvent) error
+	events chan *AuditEvent
+	done   chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newAuditWriter(write func(context.Context, *AuditEvent) error) *auditWriter {
+	w := &auditWriter{
+		write:  write,
+		events: make(chan *AuditEvent, auditQueueSize),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *auditWriter) run() {
+	defer close(w.done)
+	for event := range w.events {
+		ctx, cancel := context.WithTimeout(context.Background(), auditWriteTimeout)
+		storeAuditEvent(ctx, w.write, event)
+		cancel()
+	}
+}
+
+// enqueue queues an event to be written in the background and reports
+// whether it was queued. A nil or closed writer and a full queue queue
+// nothing.
+func (w *auditWriter) enqueue(event *AuditEvent) bool {
+	if w == nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return false
+	}
+	select {
+	case w.events <- event:
+		return true
+	default:
+		auditLogger.Warn("Audit queue is full, writing audit event right away", "action", event.Action, "jobId", event.JobId)
+		return false
+	}
+}
+
+// close writes the queued events, waiting at most auditFlushTimeout, once
+// the datasource instance is disposed. A nil writer does nothing.
+func (w *auditWriter) close() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.events)
+	}
+	w.mu.Unlock()
+
+	select {
+	case <-w.done:
+	case <-time.After(auditFlushTimeout):
+		auditLogger.Error("Timed out writing queued audit events to S3", "events", len(w.events))
+	}
+}
+
+func (d *Datasource) writeAuditEvent(ctx context.Context, event *AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit event: %w", err)
+	}
+	line = append(line, '\n')
+
+	// Objects in S3 cannot be appended to, so each event is its own JSONL
+	// object and the prefix as a whole forms the audit log.
+	_, err = d.s3Client.PutObject(context.WithoutCancel(ctx), &s3.PutObjectInput{
+		Bucket:      aws.String(d.settings.S3Bucket),
+		Key:         aws.String(auditKey(d.settings.AuditS3Prefix, event)),
+		Body:        bytes.NewReader(line),
+		ContentType: aws.String("application/x-ndjson"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write audit event: %w", err)
+	}
+	return nil
+}
+
+// auditKey returns the key of the S3 object of an audit event. Events are
+// also recorded for requests with invalid job IDs, which are kept in the
+// event but replaced in the key so they cannot change the layout of the
+// audit prefix.
+func auditKey(prefix string, event *AuditEvent) string {
+	jobId := event.JobId
+	switch {
+	case jobId == "":
+		jobId = "none"
+	case !jobIdPattern.MatchString(jobId):
+		jobId = "invalid"
+	}
+	return fmt.Sprintf("%s/%s/%s-%s-%s.jsonl",
+		strings.TrimRight(prefix, "/"),
+		event.Time.Format("2006/01/02"),
+		event.Time.Format("20060102T150405.000000000Z"),
+		event.Action,
+		jobId)
+}
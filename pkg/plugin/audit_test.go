@@ -0,0 +1,185 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	"github.com/emnify/pcap-extractor/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestActionEmitsAuditEventOnFailure(t *testing.T) {
+	mockSFNClient := &MockSFNClient{}
+	mockSFNClient.On("StartExecution", mock.Anything, mock.Anything).Return(nil, errors.New("execution failed"))
+
+	mockS3Client := &MockS3Client{}
+	mockS3Client.On("PutObject", mock.Anything, matchKey("test-job-123.meta.json")).Return(&s3.PutObjectOutput{}, nil)
+	mockS3Client.On("DeleteObject", mock.Anything, mock.Anything).Return(&s3.DeleteObjectOutput{}, nil)
+
+	var event AuditEvent
+	var key string
+	mockS3Client.On("PutObject", mock.Anything, mock.MatchedBy(func(input *s3.PutObjectInput) bool {
+		return strings.HasPrefix(*input.Key, "audit/")
+	})).Run(func(args mock.Arguments) {
+		input := args.Get(1).(*s3.PutObjectInput)
+		key = *input.Key
+		body, err := io.ReadAll(input.Body)
+		require.NoError(t, err)
+		assert.True(t, strings.HasSuffix(string(body), "\n"))
+		require.NoError(t, json.Unmarshal(body, &event))
+	}).Return(&s3.PutObjectOutput{}, nil)
+
+	ds := &Datasource{
+		settings: &models.PluginSettings{
+			StepFunctionArn: "arn:aws:states:us-east-1:123456789012:stateMachine:test-state-machine",
+			S3Bucket:        "test-bucket",
+			AuditS3Prefix:   "audit/",
+		},
+		sfnClient: mockSFNClient,
+		s3Client:  mockS3Client,
+	}
+
+	ctx := backend.WithPluginContext(context.Background(), backend.PluginContext{OrgID: 2})
+	ctx = backend.WithUser(ctx, &backend.User{Login: "jdoe", Email: "jdoe@example.com", Role: "Editor"})
+	ctx = withClientIP(ctx, "10.0.0.1")
+
+	response := ds.handleRequestAction(ctx, queryModel{
+		Action:  "request",
+		JobId:   "test-job-123",
+		Extract: map[string][]int{"file1.pcap": {1, 2, 3}},
+	})
+
+	require.Error(t, response.Error)
+	assert.True(t, strings.HasSuffix(key, "-request-test-job-123.jsonl"), key)
+	assert.Equal(t, auditActionRequest, event.Action)
+	assert.Equal(t, auditOutcomeFailure, event.Outcome)
+	assert.Contains(t, event.Error, "execution failed")
+	assert.Equal(t, "jdoe", event.UserLogin)
+	assert.Equal(t, "jdoe@example.com", event.UserEmail)
+	assert.Equal(t, "Editor", event.UserRole)
+	assert.Equal(t, int64(2), event.OrgId)
+	assert.Equal(t, "10.0.0.1", event.ClientIP)
+	assert.Equal(t, 1, event.Files)
+	assert.Equal(t, 3, event.Packets)
+	mockS3Client.AssertExpectations(t)
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		headers    http.Header
+		remoteAddr string
+		expected   string
+	}{
+		{
+			name:     "forwarded for",
+			headers:  http.Header{"X-Forwarded-For": {"10.0.0.1, 10.0.0.2"}},
+			expected: "10.0.0.1",
+		},
+		{
+			name:     "real IP",
+			headers:  http.Header{"X-Real-Ip": {"10.0.0.3"}},
+			expected: "10.0.0.3",
+		},
+		{
+			name:       "remote address",
+			headers:    http.Header{},
+			remoteAddr: "10.0.0.4:51234",
+			expected:   "10.0.0.4",
+		},
+		{
+			name:     "unknown",
+			headers:  http.Header{},
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, clientIP(tt.headers, tt.remoteAddr))
+		})
+	}
+}
+
+func TestAuditKey(t *testing.T) {
+	event := &AuditEvent{
+		Time:   time.Date(2025, 10, 1, 12, 30, 0, 0, time.UTC),
+		Action: auditActionDownload,
+		JobId:  "test-job-123",
+	}
+	assert.Equal(t, "audit/2025/10/01/20251001T123000.000000000Z-download-test-job-123.jsonl", auditKey("audit/", event))
+
+	// Job IDs that could leave the day of the event are not used in the key
+	for _, jobId := range []string{"../../../other", "a/b", strings.Repeat("x", 81)} {
+		event.JobId = jobId
+		assert.Equal(t, "audit/2025/10/01/20251001T123000.000000000Z-download-invalid.jsonl", auditKey("audit/", event))
+	}
+}
+
+func TestAuditWriterWritesInBackground(t *testing.T) {
+	var mu sync.Mutex
+	var written []string
+	writer := newAuditWriter(func(ctx context.Context, event *AuditEvent) error {
+		mu.Lock()
+		defer mu.Unlock()
+		written = append(written, event.JobId)
+		return nil
+	})
+
+	for _, jobId := range []string{"job-1", "job-2", "job-3"} {
+		assert.True(t, writer.enqueue(&AuditEvent{Action: auditActionRequest, JobId: jobId}))
+	}
+
+	// Closing writes the queued events, later events are left to the caller
+	writer.close()
+	assert.Equal(t, []string{"job-1", "job-2", "job-3"}, written)
+	assert.False(t, writer.enqueue(&AuditEvent{Action: auditActionRequest, JobId: "job-4"}))
+	assert.False(t, (*auditWriter)(nil).enqueue(&AuditEvent{}))
+}
+
+func TestStatusPollsAuditOnlyPresignedURLs(t *testing.T) {
+	mockSFNClient := &MockSFNClient{}
+	mockSFNClient.On("DescribeExecution", mock.Anything, mock.Anything).Return(&sfn.DescribeExecutionOutput{Status: "SUCCEEDED"}, nil)
+	mockS3Presigner := &MockS3Presigner{}
+	mockS3Presigner.On("PresignGetObject", mock.Anything, mock.Anything).Return(&v4.PresignedHTTPRequest{
+		URL: "https://test-bucket.s3.amazonaws.com/test-job-123.pcapng",
+	}, nil).Once()
+	mockS3Client := &MockS3Client{}
+	mockS3Client.On("GetObject", mock.Anything, mock.Anything).Return(nil, &types.NoSuchKey{})
+	mockS3Client.On("HeadObject", mock.Anything, mock.Anything).Return(&s3.HeadObjectOutput{}, nil)
+	mockS3Client.On("PutObject", mock.Anything, mock.MatchedBy(func(input *s3.PutObjectInput) bool {
+		return strings.HasPrefix(*input.Key, "audit/")
+	})).Return(&s3.PutObjectOutput{}, nil).Once()
+
+	settings := authzSettings()
+	settings.AuditS3Prefix = "audit/"
+	ds := &Datasource{
+		settings:    settings,
+		sfnClient:   mockSFNClient,
+		s3Client:    mockS3Client,
+		s3Presigner: mockS3Presigner,
+		cache:       newStatusCache(),
+	}
+
+	// Polls served from the cache hand out the same URL without auditing it
+	for i := 0; i < 3; i++ {
+		response := ds.handleStatusAction(userContext("admin", "Admin", 1), queryModel{Action: "status", JobId: "test-job-123"})
+		require.NoError(t, response.Error)
+	}
+	mockS3Client.AssertNumberOfCalls(t, "PutObject", 1)
+	mockS3Presigner.AssertExpectations(t)
+}
@@ -0,0 +1,151 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+const roleAdmin = "Admin"
+
+var errForbidden = errors.New("forbidden")
+
+func forbidden(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", errForbidden, fmt.Sprintf(format, args...))
+}
+
+// actionRoles returns the roles allowed to run a query action.
+func (d *Datasource) actionRoles(action string) []string {
+	switch action {
+	case "request", "retry":
+		return d.settings.RequestRoles
+	default:
+		return d.settings.StatusRoles
+	}
+}
+
+// fromAlertHeader is set by Grafana on queries of alert rules.
+const fromAlertHeader = "FromAlert"
+
+type alertingKey struct{}
+
+func withAlerting(ctx context.Context, alerting bool) context.Context {
+	if !alerting {
+		return ctx
+	}
+	return context.WithValue(ctx, alertingKey{}, true)
+}
+
+func isAlerting(ctx context.Context) bool {
+	alerting, _ := ctx.Value(alertingKey{}).(bool)
+	return alerting
+}
+
+// authorizeAction checks the role of the requesting user against the
+// allowlist of the action. Requests without a user are rejected, except for
+// metrics queries of alert rules, which reveal no jobs.
+func (d *Datasource) authorizeAction(ctx context.Context, action string) error {
+	user := backend.UserFromContext(ctx)
+	if user == nil {
+		if action == "metrics" && isAlerting(ctx) {
+			return nil
+		}
+		return forbidden("no user for '%s' action", action)
+	}
+	if !slices.Contains(d.actionRoles(action), user.Role) {
+		return forbidden("role '%s' may not run '%s' action", user.Role, action)
+	}
+	return nil
+}
+
+// mayDownloadRaw reports whether the user of the request may download
+// unanonymized captures. Calls without a user may not.
+func (d *Datasource) mayDownloadRaw(ctx context.Context) bool {
+	user := backend.UserFromContext(ctx)
+	return user != nil && slices.Contains(d.settings.DownloadRoles, user.Role)
+}
+
+// authorizeJob checks that the user of the request may see the job. Users see
+// the jobs they requested themselves, or all jobs of their organization if
+// ShareJobsWithinOrg is set. Admins see every job, including the ones
+// without metadata. Calls without a user see no job.
+func (d *Datasource) authorizeJob(ctx context.Context, jobId string, meta *JobMetadata) error {
+	user := backend.UserFromContext(ctx)
+	if user == nil {
+		return forbidden("no user to see job '%s'", jobId)
+	}
+	if user.Role == roleAdmin {
+		return nil
+	}
+	if meta == nil {
+		return forbidden("job '%s' has no metadata and is only visible to admins", jobId)
+	}
+
+	orgId := backend.PluginConfigFromContext(ctx).OrgID
+	if meta.OrgId != orgId {
+		return forbidden("job '%s' belongs to another organization", jobId)
+	}
+	if d.settings.ShareJobsWithinOrg {
+		return nil
+	}
+	if meta.User == nil || !strings.EqualFold(meta.User.Login, user.Login) {
+		return forbidden("job '%s' was requested by another user", jobId)
+	}
+	return nil
+}
+
+// loadJob reads the metadata of a job and checks that the user of the
+// request may see it. Without an S3 client there is no metadata and the job
+// is only restricted to calls with a user. A denied user gets errForbidden, a
+// failed read of the metadata the AWS error, never a denial.
+func (d *Datasource) loadJob(ctx context.Context, jobId string) (*JobMetadata, error) {
+	if d.s3Client == nil {
+		if backend.UserFromContext(ctx) == nil {
+			return nil, forbidden("no user to see job '%s'", jobId)
+		}
+		return nil, nil
+	}
+	meta, err := d.readJobMetadata(ctx, jobId)
+	if err != nil && !errors.Is(err, errMetadataNotFound) {
+		d.log(ctx).Error("Failed to read job metadata", "error", err)
+		return nil, err
+	}
+	if err := d.authorizeJob(ctx, jobId, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// loadJobResponse returns the response to a job that could not be loaded,
+// a denial or the failed read of its metadata.
+func loadJobResponse(err error) backend.DataResponse {
+	if errors.Is(err, errForbidden) {
+		return backend.ErrDataResponse(backend.StatusForbidden, err.Error())
+	}
+	return awsErrorResponse(backend.StatusBadGateway, "Failed to read job metadata", err)
+}
+
+// downloadKey returns the key of the capture the user of the request may
+// download: the extracted capture, or the anonymized one for users that may
+// not download unanonymized captures. It is empty if there is none.
+func (d *Datasource) downloadKey(ctx context.Context, jobId string) string {
+	if d.mayDownloadRaw(ctx) {
+		return outputKey(jobId)
+	}
+	if d.s3Client == nil {
+		return ""
+	}
+	exists, err := d.objectExists(ctx, anonymizedOutputKey(jobId))
+	if err != nil {
+		d.log(ctx).Warn("Failed to look up anonymized capture", "error", err)
+		return ""
+	}
+	if !exists {
+		return ""
+	}
+	return anonymizedOutputKey(jobId)
+}
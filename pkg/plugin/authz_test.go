@@ -0,0 +1,345 @@
+package plugin
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	"github.com/emnify/pcap-extractor/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func authzSettings() *models.PluginSettings {
+	return &models.PluginSettings{
+		StepFunctionArn: "arn:aws:states:us-east-1:123456789012:stateMachine:test-state-machine",
+		S3Bucket:        "test-bucket",
+		StatusRoles:     models.DefaultStatusRoles,
+		RequestRoles:    models.DefaultRequestRoles,
+		DownloadRoles:   []string{"Admin"},
+	}
+}
+
+func userContext(login, role string, orgId int64) context.Context {
+	ctx := backend.WithPluginContext(context.Background(), backend.PluginContext{OrgID: orgId})
+	return backend.WithUser(ctx, &backend.User{Login: login, Role: role})
+}
+
+func TestQueryAuthorizesAction(t *testing.T) {
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		action string
+	}{
+		{
+			name:   "viewer may not request",
+			ctx:    userContext("viewer", "Viewer", 1),
+			action: "request",
+		},
+		{
+			name:   "user without role may not check status",
+			ctx:    userContext("nobody", "None", 1),
+			action: "status",
+		},
+		{
+			name:   "request without user",
+			ctx:    context.Background(),
+			action: "status",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockSFNClient := &MockSFNClient{}
+			ds := &Datasource{
+				settings:  authzSettings(),
+				sfnClient: mockSFNClient,
+			}
+
+			queryJSON, err := json.Marshal(map[string]interface{}{
+				"action":  tt.action,
+				"jobId":   "test-job-123",
+				"extract": map[string][]int{"file1.pcap": {1}},
+			})
+			require.NoError(t, err)
+
+			response := ds.query(tt.ctx, backend.PluginContext{}, backend.DataQuery{JSON: queryJSON})
+
+			assert.Equal(t, backend.StatusForbidden, response.Status)
+			require.Error(t, response.Error)
+			mockSFNClient.AssertExpectations(t)
+		})
+	}
+}
+
+func TestAuthorizeJob(t *testing.T) {
+	owned := &JobMetadata{JobId: "test-job-123", OrgId: 1, User: &JobUser{Login: "jdoe"}}
+
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		meta      *JobMetadata
+		shareOrg  bool
+		forbidden bool
+	}{
+		{
+			name: "owner",
+			ctx:  userContext("jdoe", "Viewer", 1),
+			meta: owned,
+		},
+		{
+			name:      "other user",
+			ctx:       userContext("other", "Editor", 1),
+			meta:      owned,
+			forbidden: true,
+		},
+		{
+			name:     "other user with jobs shared in org",
+			ctx:      userContext("other", "Editor", 1),
+			meta:     owned,
+			shareOrg: true,
+		},
+		{
+			name:      "other org with jobs shared in org",
+			ctx:       userContext("other", "Editor", 2),
+			meta:      owned,
+			shareOrg:  true,
+			forbidden: true,
+		},
+		{
+			name: "admin",
+			ctx:  userContext("admin", "Admin", 2),
+			meta: owned,
+		},
+		{
+			name:      "job without metadata",
+			ctx:       userContext("jdoe", "Editor", 1),
+			meta:      nil,
+			forbidden: true,
+		},
+		{
+			name: "job without metadata for admin",
+			ctx:  userContext("admin", "Admin", 1),
+			meta: nil,
+		},
+		{
+			name:      "no user",
+			ctx:       context.Background(),
+			meta:      owned,
+			forbidden: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := authzSettings()
+			settings.ShareJobsWithinOrg = tt.shareOrg
+			ds := &Datasource{settings: settings}
+
+			err := ds.authorizeJob(tt.ctx, "test-job-123", tt.meta)
+			if tt.forbidden {
+				assert.ErrorIs(t, err, errForbidden)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestStatusActionOffersAnonymizedCaptureToRestrictedUsers(t *testing.T) {
+	tests := []struct {
+		name          string
+		anonymized    bool
+		expectedURL   string
+		expectNotices bool
+	}{
+		{
+			name:        "anonymized capture exists",
+			anonymized:  true,
+			expectedURL: "https://test-bucket.s3.amazonaws.com/test-job-123.anonymized.pcapng",
+		},
+		{
+			name:          "no anonymized capture",
+			anonymized:    false,
+			expectNotices: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockSFNClient := &MockSFNClient{}
+			mockSFNClient.On("DescribeExecution", mock.Anything, mock.Anything).Return(&sfn.DescribeExecutionOutput{
+				Status: "SUCCEEDED",
+			}, nil)
+
+			mockS3Client := &MockS3Client{}
+			mockS3Client.On("GetObject", mock.Anything, matchKey("test-job-123.meta.json")).Return(
+				objectBody(`{"jobId":"test-job-123","orgId":1,"user":{"login":"jdoe"}}`), nil)
+			if tt.anonymized {
+				mockS3Client.On("HeadObject", mock.Anything, matchKey("test-job-123.anonymized.pcapng")).Return(&s3.HeadObjectOutput{}, nil)
+			} else {
+				mockS3Client.On("HeadObject", mock.Anything, matchKey("test-job-123.anonymized.pcapng")).Return(nil, &types.NotFound{})
+			}
+
+			mockS3Presigner := &MockS3Presigner{}
+			if tt.anonymized {
+				mockS3Presigner.On("PresignGetObject", mock.Anything, matchKey("test-job-123.anonymized.pcapng")).Return(&v4.PresignedHTTPRequest{
+					URL: tt.expectedURL,
+				}, nil)
+			}
+
+			ds := &Datasource{
+				settings:    authzSettings(),
+				sfnClient:   mockSFNClient,
+				s3Client:    mockS3Client,
+				s3Presigner: mockS3Presigner,
+			}
+
+			response := ds.handleStatusAction(userContext("jdoe", "Editor", 1), queryModel{Action: "status", JobId: "test-job-123"})
+
+			require.NoError(t, response.Error)
+			frame := response.Frames[0]
+			field, _ := frame.FieldByName("download_url")
+			if tt.expectedURL != "" {
+				require.NotNil(t, field)
+				assert.Equal(t, tt.expectedURL, field.At(0))
+			} else {
+				assert.Nil(t, field)
+			}
+			if tt.expectNotices {
+				require.NotNil(t, frame.Meta)
+				assert.Len(t, frame.Meta.Notices, 1)
+			}
+			mockS3Client.AssertExpectations(t)
+			mockS3Presigner.AssertExpectations(t)
+		})
+	}
+}
+
+func TestStatusActionDeniesForeignJobs(t *testing.T) {
+	mockSFNClient := &MockSFNClient{}
+	mockS3Client := &MockS3Client{}
+	mockS3Client.On("GetObject", mock.Anything, matchKey("test-job-123.meta.json")).Return(
+		objectBody(`{"jobId":"test-job-123","orgId":1,"user":{"login":"jdoe"}}`), nil)
+
+	ds := &Datasource{
+		settings:  authzSettings(),
+		sfnClient: mockSFNClient,
+		s3Client:  mockS3Client,
+	}
+
+	response := ds.handleStatusAction(userContext("other", "Editor", 1), queryModel{Action: "status", JobId: "test-job-123"})
+
+	assert.Equal(t, backend.StatusForbidden, response.Status)
+	mockSFNClient.AssertNotCalled(t, "DescribeExecution", mock.Anything, mock.Anything)
+}
+
+func TestStatusActionReportsFailedMetadataReads(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected backend.Status
+	}{
+		{name: "access denied", err: apiError("AccessDenied", "Access Denied"), expected: backend.StatusForbidden},
+		{name: "throttled", err: apiError("SlowDown", "Please reduce your request rate"), expected: backend.StatusTooManyRequests},
+		{name: "unknown", err: errors.New("connection reset"), expected: backend.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockSFNClient := &MockSFNClient{}
+			mockS3Client := &MockS3Client{}
+			mockS3Client.On("GetObject", mock.Anything, matchKey("test-job-123.meta.json")).Return(nil, tt.err)
+			ds := &Datasource{settings: authzSettings(), sfnClient: mockSFNClient, s3Client: mockS3Client}
+
+			response := ds.handleStatusAction(userContext("jdoe", "Editor", 1), queryModel{Action: "status", JobId: "test-job-123"})
+
+			require.Error(t, response.Error)
+			assert.Equal(t, tt.expected, response.Status)
+			assert.Contains(t, response.Error.Error(), "Failed to read job metadata")
+			assert.NotContains(t, response.Error.Error(), "only visible to admins")
+			mockSFNClient.AssertNotCalled(t, "DescribeExecution", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestCallsWithoutUserSeeNoJobs(t *testing.T) {
+	ds := &Datasource{settings: authzSettings(), sfnClient: &MockSFNClient{}}
+
+	assert.False(t, ds.mayDownloadRaw(context.Background()))
+	_, err := ds.loadJob(context.Background(), "test-job-123")
+	assert.ErrorIs(t, err, errForbidden)
+
+	response := ds.handleStatusAction(context.Background(), queryModel{Action: "status", JobId: "test-job-123"})
+	assert.Equal(t, backend.StatusForbidden, response.Status)
+}
+
+func TestBundleOfRestrictedUsersHasAnonymizedCaptureOnly(t *testing.T) {
+	tests := []struct {
+		name             string
+		anonymized       bool
+		expectedStatus   int
+		expectedContents []string
+	}{
+		{
+			name:             "anonymized capture exists",
+			anonymized:       true,
+			expectedStatus:   http.StatusOK,
+			expectedContents: []string{"manifest.json", "test-job-123.anonymized.pcapng"},
+		},
+		{
+			name:           "no anonymized capture",
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockS3Client := &MockS3Client{}
+			mockS3Client.On("GetObject", mock.Anything, matchKey("test-job-123.meta.json")).Return(
+				objectBody(`{"jobId":"test-job-123","orgId":1,"user":{"login":"jdoe"}}`), nil)
+			if tt.anonymized {
+				mockS3Client.On("HeadObject", mock.Anything, matchKey("test-job-123.anonymized.pcapng")).Return(&s3.HeadObjectOutput{}, nil)
+				mockS3Client.On("GetObject", mock.Anything, matchKey("test-job-123.anonymized.pcapng")).Return(objectBody("anonymized"), nil)
+			} else {
+				mockS3Client.On("HeadObject", mock.Anything, matchKey("test-job-123.anonymized.pcapng")).Return(nil, &types.NotFound{})
+			}
+			ds := &Datasource{
+				settings: authzSettings(),
+				s3Client: mockS3Client,
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/bundle?jobId=test-job-123", nil)
+			req = req.WithContext(userContext("jdoe", "Editor", 1))
+			rec := httptest.NewRecorder()
+			ds.handleBundle(rec, req)
+
+			assert.Equal(t, tt.expectedStatus, rec.Code)
+			mockS3Client.AssertExpectations(t)
+			mockS3Client.AssertNotCalled(t, "HeadObject", mock.Anything, matchKey("test-job-123.pcapng"))
+			mockS3Client.AssertNotCalled(t, "GetObject", mock.Anything, matchKey("test-job-123.pcapng"))
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+
+			archive, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+			require.NoError(t, err)
+			var names []string
+			for _, f := range archive.File {
+				names = append(names, f.Name)
+			}
+			assert.Equal(t, tt.expectedContents, names)
+		})
+	}
+}
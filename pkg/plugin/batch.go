@@ -0,0 +1,283 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	sfntypes "github.com/aws/aws-sdk-go-v2/service/sfn/types"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	// maxBatchJobs bounds the number of jobs a single batch status query covers.
+	maxBatchJobs = 200
+
+	// maxListPages bounds how much of the execution history is searched for
+	// jobs matching a prefix.
+	maxListPages = 10
+)
+
+// jobStatus is the outcome of looking up a single job of a batch.
+type jobStatus struct {
+	jobId       string
+	status      string
+	errorText   string
+	cause       string
+	downloadURL string
+	meta        *JobMetadata
+	lookupErr   error
+}
+
+// handleBatchStatusAction looks up the status of a list of jobs, or of all
+// jobs whose ID starts with a prefix, and returns them as one row per job.
+func (d *Datasource) handleBatchStatusAction(ctx context.Context, qm queryModel) backend.DataResponse {
+	var response backend.DataResponse
+
+	jobIds := uniqueJobIds(qm.JobIds)
+	if len(jobIds) > maxBatchJobs {
+		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Too many jobs for a status query, at most %d are supported", maxBatchJobs))
+	}
+
+	// Jobs matching the prefix fill up the batch, most recent first
+	if qm.JobIdPrefix != "" {
+		listed, err := d.listJobIds(ctx, qm.JobIdPrefix, "", maxBatchJobs)
+		if err != nil {
+			d.log(ctx).Error("Failed to list Step Function executions", "error", err)
+			return awsErrorResponse(backend.StatusBadGateway, "Failed to list executions", err)
+		}
+		jobIds = uniqueJobIds(append(jobIds, listed...))
+		if len(jobIds) > maxBatchJobs {
+			jobIds = jobIds[:maxBatchJobs]
+		}
+	}
+
+	d.log(ctx).Info("Processing batch status action", "jobs", len(jobIds), "prefix", qm.JobIdPrefix)
+
+	explicit := map[string]bool{}
+	for _, jobId := range qm.JobIds {
+		explicit[jobId] = true
+	}
+
+	statuses := make([]*jobStatus, len(jobIds))
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, max(d.settings.MaxConcurrentQueries, 1))
+	for i, jobId := range jobIds {
+		wg.Add(1)
+		go func(i int, jobId string) {
+			defer wg.Done()
+			select {
+			case workers <- struct{}{}:
+				defer func() { <-workers }()
+				statuses[i] = d.lookupJob(ctx, jobId)
+			case <-ctx.Done():
+				statuses[i] = &jobStatus{jobId: jobId, errorText: ctx.Err().Error()}
+			}
+		}(i, jobId)
+	}
+	wg.Wait()
+
+	frame := data.NewFrame("step_function_statuses")
+	var (
+		ids, states, errorTexts, causes, urls, requestedBy []string
+		requestedAt                                        []*time.Time
+	)
+	for _, st := range statuses {
+		// Jobs matched by the prefix the user may not see are left out
+		// silently, explicitly requested ones show up with the error.
+		if errors.Is(st.lookupErr, errForbidden) && !explicit[st.jobId] {
+			continue
+		}
+
+		ids = append(ids, st.jobId)
+		states = append(states, st.status)
+		errorTexts = append(errorTexts, st.errorText)
+		causes = append(causes, st.cause)
+		urls = append(urls, st.downloadURL)
+		if st.meta != nil && st.meta.User != nil {
+			requestedBy = append(requestedBy, st.meta.User.Login)
+		} else {
+			requestedBy = append(requestedBy, "")
+		}
+		if st.meta != nil {
+			requestedAt = append(requestedAt, &st.meta.CreatedAt)
+		} else {
+			requestedAt = append(requestedAt, nil)
+		}
+	}
+	frame.Fields = append(frame.Fields,
+		data.NewField("job_id", nil, ids),
+		data.NewField("status", nil, states),
+		data.NewField("error", nil, errorTexts),
+		data.NewField("cause", nil, causes),
+		data.NewField("download_url", nil, urls),
+		data.NewField("requested_by", nil, requestedBy),
+		data.NewField("requested_at", nil, requestedAt),
+	)
+
+	response.Frames = append(response.Frames, frame)
+	return response
+}
+
+// lookupJob describes the execution of a single job of a batch, including
+// the authorization check and the download URL, and audits issued URLs.
+func (d *Datasource) lookupJob(ctx context.Context, jobId string) (st *jobStatus) {
+	st = &jobStatus{jobId: jobId}
+	ctx = withLogJob(ctx, jobId)
+
+	event := newAuditEvent(ctx, auditActionURLIssued, jobId)
+	urlIssued := false
+	defer func() {
+		switch {
+		case errors.Is(st.lookupErr, errForbidden):
+			event.deny(st.errorText)
+		case st.lookupErr != nil:
+			event.fail(st.errorText)
+		}
+		if urlIssued || event.Outcome != auditOutcomeSuccess {
+			d.emitAudit(ctx, event)
+		}
+	}()
+
+	meta, err := d.loadJob(ctx, jobId)
+	if errors.Is(err, errForbidden) {
+		st.setError(err)
+		return st
+	}
+	if err != nil {
+		st.setError(classifyAWSError(err))
+		return st
+	}
+	st.meta = meta
+	if meta != nil {
+		event.Files, event.Packets = meta.Files, meta.Packets
+	}
+
+	states, err := d.describeSubJobs(ctx, subJobs(jobId, meta))
+	if err != nil {
+		d.log(ctx).Warn("Failed to describe Step Function execution", "error", err)
+		st.setError(classifyAWSError(err))
+		return st
+	}
+	result := aggregateExecutions(states)
+
+	st.status = string(result.Status)
+	if result.Error != nil {
+		st.errorText = *result.Error
+	}
+	if result.Cause != nil {
+		st.cause = *result.Cause
+	}
+	if d.quota != nil && st.status != "RUNNING" && st.status != "PENDING_REDRIVE" {
+		d.quota.finish(jobId)
+	}
+
+	// Jobs split across targets have one capture per target, their download
+	// URLs are only handed out by the status of the single job
+	if st.status == "SUCCEEDED" && len(states) == 1 {
+		view := states[0].view
+		if key := view.downloadKey(ctx, jobId); key != "" {
+			url, presigned, err := view.generatePresignedURL(ctx, view.settings.S3Bucket, key)
+			if err != nil {
+				d.log(ctx).Warn("Failed to generate presigned URL for completed execution", "error", err)
+				event.fail(err.Error())
+			} else {
+				st.downloadURL, urlIssued = url, presigned
+			}
+		}
+	}
+	return st
+}
+
+func (st *jobStatus) setError(err error) {
+	st.errorText = err.Error()
+	st.lookupErr = err
+}
+
+// listJobIds returns the IDs of the most recent jobs of all targets whose ID
+// starts with prefix, at most limit of them, optionally only those with the
+// given status. Only the latest maxListPages pages of executions of each
+// target are searched.
+func (d *Datasource) listJobIds(ctx context.Context, prefix string, status sfntypes.ExecutionStatus, limit int) ([]string, error) {
+	var executions []sfntypes.ExecutionListItem
+	for _, target := range d.targetViews() {
+		found := 0
+		paginator := sfn.NewListExecutionsPaginator(target.view.sfnClient, &sfn.ListExecutionsInput{
+			StateMachineArn: aws.String(target.view.settings.StepFunctionArn),
+			StatusFilter:    status,
+			MaxResults:      1000,
+		})
+		for pages := 0; paginator.HasMorePages() && pages < maxListPages && found < limit; pages++ {
+			page, err := paginator.NextPage(ctx)
+			if err != nil && target.view != d {
+				return nil, fmt.Errorf("failed to list the executions of target '%s': %w", target.name, err)
+			}
+			if err != nil {
+				return nil, err
+			}
+			for _, execution := range page.Executions {
+				if execution.Name == nil || !strings.HasPrefix(*execution.Name, prefix) || found >= limit {
+					continue
+				}
+				jobId := d.splitJobId(ctx, target.name, *execution.Name)
+				if !strings.HasPrefix(jobId, prefix) {
+					continue
+				}
+				execution.Name = aws.String(jobId)
+				executions = append(executions, execution)
+				found++
+			}
+		}
+	}
+	sort.SliceStable(executions, func(i, j int) bool {
+		return startedAfter(executions[i].StartDate, executions[j].StartDate)
+	})
+
+	jobIds := make([]string, 0, len(executions))
+	for _, execution := range executions {
+		jobIds = append(jobIds, *execution.Name)
+	}
+	jobIds = uniqueJobIds(jobIds)
+	if len(jobIds) > limit {
+		jobIds = jobIds[:limit]
+	}
+	return jobIds, nil
+}
+
+// splitJobId returns the ID of the job an execution of a target belongs to:
+// the ID of the job split across targets if the execution is one of its
+// sub-jobs, and else the name of the execution.
+func (d *Datasource) splitJobId(ctx context.Context, target, name string) string {
+	jobId, ok := strings.CutSuffix(name, "-"+target)
+	if !ok || len(d.targets) == 0 || d.s3Client == nil {
+		return name
+	}
+	meta, err := d.readJobMetadata(ctx, jobId)
+	if err != nil || !slices.ContainsFunc(meta.SubJobs, func(job SubJob) bool {
+		return job.Target == target && job.JobId == name
+	}) {
+		return name
+	}
+	return jobId
+}
+
+func uniqueJobIds(jobIds []string) []string {
+	seen := map[string]bool{}
+	var unique []string
+	for _, jobId := range jobIds {
+		if jobId == "" || seen[jobId] {
+			continue
+		}
+		seen[jobId] = true
+		unique = append(unique, jobId)
+	}
+	return unique
+}
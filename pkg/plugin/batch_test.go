@@ -0,0 +1,169 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	sfntypes "github.com/aws/aws-sdk-go-v2/service/sfn/types"
+	"github.com/emnify/pcap-extractor/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func matchExecution(jobId string) interface{} {
+	return mock.MatchedBy(func(input *sfn.DescribeExecutionInput) bool {
+		return *input.ExecutionArn == "arn:aws:states:us-east-1:123456789012:execution:test-state-machine:"+jobId
+	})
+}
+
+func TestHandleBatchStatusAction(t *testing.T) {
+	tests := []struct {
+		name             string
+		queryModel       queryModel
+		ctx              context.Context
+		setupSFNMock     func(*MockSFNClient)
+		setupS3Mock      func(*MockS3Client)
+		setupS3Presigner func(*MockS3Presigner)
+		expectedJobs     []string
+		expectedRows     map[string][2]string // job ID to status and error
+	}{
+		{
+			name:       "list of job IDs with duplicates",
+			queryModel: queryModel{Action: "status", JobIds: []string{"job-1", "job-2", "job-1", "job-3"}},
+			ctx:        userContext("admin", "Admin", 1),
+			setupSFNMock: func(mockClient *MockSFNClient) {
+				mockClient.On("DescribeExecution", mock.Anything, matchExecution("job-1")).Return(&sfn.DescribeExecutionOutput{Status: "RUNNING"}, nil).Once()
+				mockClient.On("DescribeExecution", mock.Anything, matchExecution("job-2")).Return(&sfn.DescribeExecutionOutput{
+					Status: "FAILED",
+					Error:  aws.String("Task failed"),
+					Cause:  aws.String("Network timeout"),
+				}, nil).Once()
+				mockClient.On("DescribeExecution", mock.Anything, matchExecution("job-3")).Return(nil, errors.New("ExecutionDoesNotExist")).Once()
+			},
+			expectedJobs: []string{"job-1", "job-2", "job-3"},
+			expectedRows: map[string][2]string{
+				"job-1": {"RUNNING", ""},
+				"job-2": {"FAILED", "Task failed"},
+				"job-3": {"", "ExecutionDoesNotExist"},
+			},
+		},
+		{
+			name:       "prefix lists executions",
+			queryModel: queryModel{Action: "status", JobIdPrefix: "incident-42-"},
+			ctx:        userContext("admin", "Admin", 1),
+			setupSFNMock: func(mockClient *MockSFNClient) {
+				mockClient.On("ListExecutions", mock.Anything, mock.MatchedBy(func(input *sfn.ListExecutionsInput) bool {
+					return input.NextToken == nil
+				})).Return(&sfn.ListExecutionsOutput{
+					Executions: []sfntypes.ExecutionListItem{
+						{Name: aws.String("incident-42-b")},
+						{Name: aws.String("run-1")},
+					},
+					NextToken: aws.String("page-2"),
+				}, nil).Once()
+				mockClient.On("ListExecutions", mock.Anything, mock.MatchedBy(func(input *sfn.ListExecutionsInput) bool {
+					return input.NextToken != nil && *input.NextToken == "page-2"
+				})).Return(&sfn.ListExecutionsOutput{
+					Executions: []sfntypes.ExecutionListItem{
+						{Name: aws.String("incident-42-a")},
+					},
+				}, nil).Once()
+				mockClient.On("DescribeExecution", mock.Anything, matchExecution("incident-42-b")).Return(&sfn.DescribeExecutionOutput{Status: "RUNNING"}, nil).Once()
+				mockClient.On("DescribeExecution", mock.Anything, matchExecution("incident-42-a")).Return(&sfn.DescribeExecutionOutput{Status: "SUCCEEDED"}, nil).Once()
+			},
+			setupS3Presigner: func(mockPresigner *MockS3Presigner) {
+				mockPresigner.On("PresignGetObject", mock.Anything, matchKey("incident-42-a.pcapng")).Return(&v4.PresignedHTTPRequest{
+					URL: "https://test-bucket.s3.amazonaws.com/incident-42-a.pcapng",
+				}, nil)
+			},
+			expectedJobs: []string{"incident-42-b", "incident-42-a"},
+			expectedRows: map[string][2]string{
+				"incident-42-b": {"RUNNING", ""},
+				"incident-42-a": {"SUCCEEDED", ""},
+			},
+		},
+		{
+			name:       "prefix leaves out jobs of other users",
+			queryModel: queryModel{Action: "status", JobIdPrefix: "run-", JobIds: []string{"run-3"}},
+			ctx:        userContext("jdoe", "Editor", 1),
+			setupSFNMock: func(mockClient *MockSFNClient) {
+				mockClient.On("ListExecutions", mock.Anything, mock.Anything).Return(&sfn.ListExecutionsOutput{
+					Executions: []sfntypes.ExecutionListItem{
+						{Name: aws.String("run-1")},
+						{Name: aws.String("run-2")},
+					},
+				}, nil).Once()
+				mockClient.On("DescribeExecution", mock.Anything, matchExecution("run-1")).Return(&sfn.DescribeExecutionOutput{Status: "RUNNING"}, nil).Once()
+			},
+			setupS3Mock: func(mockClient *MockS3Client) {
+				mockClient.On("GetObject", mock.Anything, matchKey("run-1.meta.json")).Return(
+					objectBody(`{"jobId":"run-1","orgId":1,"user":{"login":"jdoe"}}`), nil)
+				mockClient.On("GetObject", mock.Anything, matchKey("run-2.meta.json")).Return(
+					objectBody(`{"jobId":"run-2","orgId":1,"user":{"login":"other"}}`), nil)
+				mockClient.On("GetObject", mock.Anything, matchKey("run-3.meta.json")).Return(nil, &types.NoSuchKey{})
+			},
+			expectedJobs: []string{"run-3", "run-1"},
+			expectedRows: map[string][2]string{
+				"run-3": {"", "forbidden: job 'run-3' has no metadata and is only visible to admins"},
+				"run-1": {"RUNNING", ""},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockSFNClient := &MockSFNClient{}
+			tt.setupSFNMock(mockSFNClient)
+
+			ds := &Datasource{
+				settings: &models.PluginSettings{
+					StepFunctionArn:      "arn:aws:states:us-east-1:123456789012:stateMachine:test-state-machine",
+					S3Bucket:             "test-bucket",
+					MaxConcurrentQueries: 2,
+					DownloadRoles:        []string{"Admin"},
+				},
+				sfnClient: mockSFNClient,
+			}
+
+			var mockS3Client *MockS3Client
+			if tt.setupS3Mock != nil {
+				mockS3Client = &MockS3Client{}
+				tt.setupS3Mock(mockS3Client)
+				ds.s3Client = mockS3Client
+			}
+
+			if tt.setupS3Presigner != nil {
+				mockS3Presigner := &MockS3Presigner{}
+				tt.setupS3Presigner(mockS3Presigner)
+				ds.s3Presigner = mockS3Presigner
+				defer mockS3Presigner.AssertExpectations(t)
+			}
+
+			response := ds.handleBatchStatusAction(tt.ctx, tt.queryModel)
+
+			require.NoError(t, response.Error)
+			require.Len(t, response.Frames, 1)
+			frame := response.Frames[0]
+			assert.Equal(t, "step_function_statuses", frame.Name)
+			require.Equal(t, len(tt.expectedJobs), frame.Rows())
+
+			for i, jobId := range tt.expectedJobs {
+				row := frame.RowCopy(i)
+				assert.Equal(t, jobId, row[0])
+				assert.Equal(t, tt.expectedRows[jobId][0], row[1], jobId)
+				assert.Equal(t, tt.expectedRows[jobId][1], row[2], jobId)
+			}
+
+			mockSFNClient.AssertExpectations(t)
+			if mockS3Client != nil {
+				mockS3Client.AssertExpectations(t)
+			}
+		})
+	}
+}
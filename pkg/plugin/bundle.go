@@ -0,0 +1,260 @@
+package plugin
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// bundleFlushThreshold is the amount of archive data buffered before it is
+// sent to Grafana as one chunk of the resource response.
+const bundleFlushThreshold = 1 << 20
+
+// BundleManifest describes the contents of a bundle archive.
+type BundleManifest struct {
+	JobId        string           `json:"jobId"`
+	CreatedAt    time.Time        `json:"createdAt"`
+	BundledAt    time.Time        `json:"bundledAt"`
+	RequestedBy  *JobUser         `json:"requestedBy,omitempty"`
+	Query        string           `json:"query,omitempty"`
+	From         *time.Time       `json:"from,omitempty"`
+	To           *time.Time       `json:"to,omitempty"`
+	DashboardURL string           `json:"dashboardUrl,omitempty"`
+	Files        int              `json:"files"`
+	Packets      int              `json:"packets"`
+	Extract      map[string][]int `json:"extract,omitempty"`
+	Selection    *FlowSelection   `json:"selection,omitempty"`
+	Contents     []string         `json:"contents"`
+}
+
+// handleBundle streams a ZIP archive containing the extracted capture, the
+// anonymized capture if there is one and a manifest built from the job
+// metadata. Users that may not download unanonymized captures get the
+// anonymized capture only. The archive is built while the S3 objects are
+// read, so neither the archive nor the captures are held in memory or
+// written to disk.
+func (d *Datasource) handleBundle(w http.ResponseWriter, r *http.Request) {
+	ctx := withClientIP(r.Context(), clientIP(r.Header, r.RemoteAddr))
+
+	jobId := r.URL.Query().Get("jobId")
+	ctx = withLogJob(withLogUser(ctx), jobId)
+	event := newAuditEvent(ctx, auditActionDownload, jobId)
+	defer d.emitAudit(ctx, event)
+
+	fail := func(message string, code int) {
+		event.fail(message)
+		http.Error(w, message, code)
+	}
+
+	if err := validateJobId(jobId); err != nil {
+		fail(err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := d.validateSettings(ctx); err != nil {
+		fail(fmt.Sprintf("Incomplete plugin settings: %v", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	meta, err := d.loadJob(ctx, jobId)
+	if errors.Is(err, errForbidden) {
+		event.deny(err.Error())
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		classified := classifyAWSError(err)
+		status := int(classified.status)
+		if status == 0 {
+			status = http.StatusBadGateway
+		}
+		fail(fmt.Sprintf("Failed to read job metadata: %s", classified.Error()), status)
+		return
+	}
+	if meta == nil {
+		meta = &JobMetadata{JobId: jobId}
+	}
+	event.Files, event.Packets = meta.Files, meta.Packets
+
+	// The captures are stored in the bucket of the target the job ran on
+	view, _, err := d.jobTarget(jobId, meta)
+	if err != nil {
+		fail(err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Users that may not download unanonymized captures get a bundle with
+	// the anonymized capture only
+	raw := d.mayDownloadRaw(ctx)
+	key, capture := outputKey(jobId), "extracted capture"
+	if !raw {
+		key, capture = anonymizedOutputKey(jobId), "anonymized capture"
+	}
+
+	exists, err := view.objectExists(ctx, key)
+	if err != nil {
+		d.log(ctx).Error("Failed to look up "+capture, "error", err)
+		classified := classifyAWSError(err)
+		status := int(classified.status)
+		if status == 0 {
+			status = http.StatusBadGateway
+		}
+		fail(fmt.Sprintf("Failed to look up %s: %s", capture, classified.Error()), status)
+		return
+	}
+	if !exists && !raw {
+		fail(fmt.Sprintf("No anonymized capture found for job '%s', and you are not allowed to download unanonymized captures", jobId), http.StatusNotFound)
+		return
+	}
+	if !exists {
+		fail(fmt.Sprintf("No extracted capture found for job '%s'", jobId), http.StatusNotFound)
+		return
+	}
+
+	keys := []string{key}
+	if raw {
+		anonymized, err := view.objectExists(ctx, anonymizedOutputKey(jobId))
+		if err != nil {
+			d.log(ctx).Warn("Failed to look up anonymized capture", "error", err)
+		} else if anonymized {
+			keys = append(keys, anonymizedOutputKey(jobId))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", jobId+".zip"))
+	w.WriteHeader(http.StatusOK)
+
+	out := newFlushWriter(w, bundleFlushThreshold)
+	if err := view.writeBundle(ctx, out, meta, keys); err != nil {
+		// The status line is already sent, all we can do is to stop
+		// writing and leave the client with a truncated archive.
+		d.log(ctx).Error("Failed to stream bundle", "error", err)
+		event.fail(err.Error())
+	}
+	out.Flush()
+}
+
+func (d *Datasource) writeBundle(ctx context.Context, w io.Writer, meta *JobMetadata, keys []string) error {
+	archive := zip.NewWriter(w)
+
+	manifest := newBundleManifest(ctx, meta, keys)
+	entry, err := archive.Create("manifest.json")
+	if err != nil {
+		return fmt.Errorf("failed to add manifest: %w", err)
+	}
+	encoder := json.NewEncoder(entry)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	for _, key := range keys {
+		if err := d.copyObjectToArchive(ctx, archive, key); err != nil {
+			return err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return fmt.Errorf("failed to finish archive: %w", err)
+	}
+	return nil
+}
+
+func (d *Datasource) copyObjectToArchive(ctx context.Context, archive *zip.Writer, key string) error {
+	result, err := d.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(d.settings.S3Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	defer result.Body.Close()
+
+	header := &zip.FileHeader{
+		Name:   key,
+		Method: zip.Deflate,
+	}
+	if result.LastModified != nil {
+		header.Modified = *result.LastModified
+	}
+
+	entry, err := archive.CreateHeader(header)
+	if err != nil {
+		return fmt.Errorf("failed to add %s: %w", key, err)
+	}
+	if _, err := io.Copy(entry, result.Body); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", key, err)
+	}
+	return nil
+}
+
+func (d *Datasource) objectExists(ctx context.Context, key string) (bool, error) {
+	_, err := d.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(d.settings.S3Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func newBundleManifest(ctx context.Context, meta *JobMetadata, keys []string) *BundleManifest {
+	return &BundleManifest{
+		JobId:        meta.JobId,
+		CreatedAt:    meta.CreatedAt,
+		BundledAt:    time.Now().UTC(),
+		RequestedBy:  meta.User,
+		Query:        meta.Query,
+		From:         meta.From,
+		To:           meta.To,
+		DashboardURL: meta.dashboardURL(ctx),
+		Files:        meta.Files,
+		Packets:      meta.Packets,
+		Extract:      meta.Extract,
+		Selection:    meta.Selection,
+		Contents:     append([]string{"manifest.json"}, keys...),
+	}
+}
+
+// flushWriter forwards writes to an http.ResponseWriter and flushes it once
+// the given amount of data has been written since the last flush.
+type flushWriter struct {
+	w         http.ResponseWriter
+	threshold int
+	pending   int
+}
+
+func newFlushWriter(w http.ResponseWriter, threshold int) *flushWriter {
+	return &flushWriter{w: w, threshold: threshold}
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.pending += n
+	if f.pending >= f.threshold {
+		f.Flush()
+	}
+	return n, err
+}
+
+func (f *flushWriter) Flush() {
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	f.pending = 0
+}
@@ -0,0 +1,148 @@
+package plugin
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/emnify/pcap-extractor/pkg/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func matchKey(key string) interface{} {
+	return mock.MatchedBy(func(input interface{}) bool {
+		switch in := input.(type) {
+		case *s3.GetObjectInput:
+			return *in.Key == key
+		case *s3.HeadObjectInput:
+			return *in.Key == key
+		case *s3.PutObjectInput:
+			return *in.Key == key
+		}
+		return false
+	})
+}
+
+func objectBody(content string) *s3.GetObjectOutput {
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(content))}
+}
+
+func TestHandleBundle(t *testing.T) {
+	tests := []struct {
+		name             string
+		jobId            string
+		setupMock        func(*MockS3Client)
+		expectedStatus   int
+		expectedContents []string
+	}{
+		{
+			name:  "bundle with capture, anonymized capture and manifest",
+			jobId: "test-job-123",
+			setupMock: func(mockClient *MockS3Client) {
+				mockClient.On("HeadObject", mock.Anything, matchKey("test-job-123.pcapng")).Return(&s3.HeadObjectOutput{}, nil)
+				mockClient.On("HeadObject", mock.Anything, matchKey("test-job-123.anonymized.pcapng")).Return(&s3.HeadObjectOutput{}, nil)
+				mockClient.On("GetObject", mock.Anything, matchKey("test-job-123.meta.json")).Return(
+					objectBody(`{"jobId":"test-job-123","files":1,"packets":3,"extract":{"file1.pcap":[1,2,3]}}`), nil)
+				mockClient.On("GetObject", mock.Anything, matchKey("test-job-123.pcapng")).Return(objectBody("capture"), nil)
+				mockClient.On("GetObject", mock.Anything, matchKey("test-job-123.anonymized.pcapng")).Return(objectBody("anonymized"), nil)
+			},
+			expectedStatus:   http.StatusOK,
+			expectedContents: []string{"manifest.json", "test-job-123.pcapng", "test-job-123.anonymized.pcapng"},
+		},
+		{
+			name:  "bundle without anonymized capture and metadata",
+			jobId: "test-job-456",
+			setupMock: func(mockClient *MockS3Client) {
+				mockClient.On("HeadObject", mock.Anything, matchKey("test-job-456.pcapng")).Return(&s3.HeadObjectOutput{}, nil)
+				mockClient.On("HeadObject", mock.Anything, matchKey("test-job-456.anonymized.pcapng")).Return(nil, &types.NotFound{})
+				mockClient.On("GetObject", mock.Anything, matchKey("test-job-456.meta.json")).Return(nil, &types.NoSuchKey{})
+				mockClient.On("GetObject", mock.Anything, matchKey("test-job-456.pcapng")).Return(objectBody("capture"), nil)
+			},
+			expectedStatus:   http.StatusOK,
+			expectedContents: []string{"manifest.json", "test-job-456.pcapng"},
+		},
+		{
+			name:  "missing capture",
+			jobId: "test-job-789",
+			setupMock: func(mockClient *MockS3Client) {
+				mockClient.On("GetObject", mock.Anything, matchKey("test-job-789.meta.json")).Return(nil, &types.NoSuchKey{})
+				mockClient.On("HeadObject", mock.Anything, matchKey("test-job-789.pcapng")).Return(nil, &types.NotFound{})
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:  "S3 failure",
+			jobId: "test-job-789",
+			setupMock: func(mockClient *MockS3Client) {
+				mockClient.On("GetObject", mock.Anything, matchKey("test-job-789.meta.json")).Return(nil, &types.NoSuchKey{})
+				mockClient.On("HeadObject", mock.Anything, mock.Anything).Return(nil, errors.New("AccessDenied"))
+			},
+			expectedStatus: http.StatusBadGateway,
+		},
+		{
+			name:           "invalid job ID",
+			jobId:          "../etc/passwd",
+			setupMock:      func(mockClient *MockS3Client) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockS3Client := &MockS3Client{}
+			tt.setupMock(mockS3Client)
+
+			ds := &Datasource{
+				settings: &models.PluginSettings{
+					StepFunctionArn: "arn:aws:states:us-east-1:123456789012:stateMachine:test-state-machine",
+					S3Bucket:        "test-bucket",
+					DownloadRoles:   []string{"Admin"},
+				},
+				s3Client: mockS3Client,
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/bundle?jobId="+tt.jobId, nil).WithContext(userContext("admin", "Admin", 1))
+			rec := httptest.NewRecorder()
+			ds.handleBundle(rec, req)
+
+			assert.Equal(t, tt.expectedStatus, rec.Code)
+			mockS3Client.AssertExpectations(t)
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+
+			assert.Equal(t, "application/zip", rec.Header().Get("Content-Type"))
+			archive, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+			require.NoError(t, err)
+
+			var names []string
+			for _, f := range archive.File {
+				names = append(names, f.Name)
+			}
+			assert.Equal(t, tt.expectedContents, names)
+
+			manifestFile, err := archive.Open("manifest.json")
+			require.NoError(t, err)
+			var manifest BundleManifest
+			require.NoError(t, json.NewDecoder(manifestFile).Decode(&manifest))
+			assert.Equal(t, tt.jobId, manifest.JobId)
+			assert.Equal(t, tt.expectedContents, manifest.Contents)
+
+			captureFile, err := archive.Open(tt.jobId + ".pcapng")
+			require.NoError(t, err)
+			capture, err := io.ReadAll(captureFile)
+			require.NoError(t, err)
+			assert.Equal(t, "capture", string(capture))
+		})
+	}
+}
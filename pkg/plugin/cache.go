@@ -0,0 +1,253 @@
+package plugin
+
+import (
+	"context"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	sfntypes "github.com/aws/aws-sdk-go-v2/service/sfn/types"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// How long execution descriptions are cached, depending on whether the
+	// execution can still change
+	runningStatusTTL  = 5 * time.Second
+	terminalStatusTTL = 10 * time.Minute
+
+	// presignedURLExpiry is the lifetime of presigned download URLs, they are
+	// handed out from the cache until presignedURLMargin before they expire.
+	presignedURLExpiry = time.Hour
+	presignedURLMargin = 10 * time.Minute
+
+	// cacheSweepInterval is how often lookups drop the expired entries of
+	// the whole cache, so that jobs no longer polled do not stay in memory.
+	cacheSweepInterval = time.Minute
+
+	// sharedCallTimeout bounds a call shared by concurrent lookups, which does
+	// not end when the lookup that started it is cancelled.
+	sharedCallTimeout = 30 * time.Second
+)
+
+type cachedExecution struct {
+	result  *sfn.DescribeExecutionOutput
+	expires time.Time
+}
+
+type cachedObject struct {
+	result  *s3.HeadObjectOutput
+	expires time.Time
+}
+
+type cachedURL struct {
+	url     string
+	expires time.Time
+}
+
+// statusCache keeps execution descriptions and presigned URLs for a short
+// time so that many panels polling the same jobs do not run into the Step
+// Functions API limits. Concurrent lookups of the same key share one call.
+type statusCache struct {
+	mu         sync.Mutex
+	now        func() time.Time
+	lastSweep  time.Time
+	executions map[string]cachedExecution
+	objects    map[string]cachedObject
+	urls       map[string]cachedURL
+	group      singleflight.Group
+}
+
+func newStatusCache() *statusCache {
+	return &statusCache{
+		now:        time.Now,
+		executions: map[string]cachedExecution{},
+		objects:    map[string]cachedObject{},
+		urls:       map[string]cachedURL{},
+	}
+}
+
+// execution returns the cached description of the execution, or calls fetch
+// to describe it. A nil cache always calls fetch.
+func (c *statusCache) execution(ctx context.Context, executionArn string, fetch func(context.Context) (*sfn.DescribeExecutionOutput, error)) (*sfn.DescribeExecutionOutput, error) {
+	if c == nil {
+		return fetch(ctx)
+	}
+
+	c.mu.Lock()
+	now := c.now()
+	c.sweep(now)
+	cached, ok := c.executions[executionArn]
+	if ok && !now.Before(cached.expires) {
+		delete(c.executions, executionArn)
+		ok = false
+	}
+	c.mu.Unlock()
+	if ok {
+		return cached.result, nil
+	}
+
+	value, err := c.do(ctx, "execution:"+executionArn, func(ctx context.Context) (interface{}, error) {
+		result, err := fetch(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		ttl := terminalStatusTTL
+		if result.Status == sfntypes.ExecutionStatusRunning || result.Status == sfntypes.ExecutionStatusPendingRedrive {
+			ttl = runningStatusTTL
+		}
+		c.mu.Lock()
+		c.executions[executionArn] = cachedExecution{result: result, expires: c.now().Add(ttl)}
+		c.mu.Unlock()
+		return result, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*sfn.DescribeExecutionOutput), nil
+}
+
+// object returns the cached description of an output object, or calls head
+// to describe it. Outputs do not change once a job has succeeded, so they are
+// kept as long as terminal execution descriptions.
+func (c *statusCache) object(ctx context.Context, bucket, key string, head func(context.Context) (*s3.HeadObjectOutput, error)) (*s3.HeadObjectOutput, error) {
+	if c == nil {
+		return head(ctx)
+	}
+
+	cacheKey := bucket + "/" + key
+	c.mu.Lock()
+	now := c.now()
+	c.sweep(now)
+	cached, ok := c.objects[cacheKey]
+	if ok && !now.Before(cached.expires) {
+		delete(c.objects, cacheKey)
+		ok = false
+	}
+	c.mu.Unlock()
+	if ok {
+		return cached.result, nil
+	}
+
+	value, err := c.do(ctx, "object:"+cacheKey, func(ctx context.Context) (interface{}, error) {
+		result, err := head(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		c.mu.Lock()
+		c.objects[cacheKey] = cachedObject{result: result, expires: c.now().Add(terminalStatusTTL)}
+		c.mu.Unlock()
+		return result, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*s3.HeadObjectOutput), nil
+}
+
+// presignedURL returns a cached presigned URL for the object, or calls
+// presign to create one that is valid for presignedURLExpiry, and reports
+// whether this lookup presigned it. URLs signed with temporary credentials
+// stop working when the credentials expire, presign returns that time if it
+// is known, and the URL is not cached beyond it.
+func (c *statusCache) presignedURL(ctx context.Context, bucket, key string, presign func(context.Context) (string, time.Time, error)) (string, bool, error) {
+	if c == nil {
+		url, _, err := presign(ctx)
+		return url, err == nil, err
+	}
+
+	cacheKey := bucket + "/" + key
+	c.mu.Lock()
+	now := c.now()
+	c.sweep(now)
+	cached, ok := c.urls[cacheKey]
+	if ok && !now.Before(cached.expires) {
+		delete(c.urls, cacheKey)
+		ok = false
+	}
+	c.mu.Unlock()
+	if ok {
+		return cached.url, false, nil
+	}
+
+	// Lookups waiting for the URL another lookup presigns share it, only the
+	// lookup whose call runs presigned it
+	presigned := false
+	value, err := c.do(ctx, "url:"+cacheKey, func(ctx context.Context) (interface{}, error) {
+		presigned = true
+		issued := c.now()
+		url, credentialsExpire, err := presign(ctx)
+		if err != nil {
+			return "", err
+		}
+
+		expires := issued.Add(presignedURLExpiry)
+		if !credentialsExpire.IsZero() && credentialsExpire.Before(expires) {
+			expires = credentialsExpire
+		}
+		c.mu.Lock()
+		c.urls[cacheKey] = cachedURL{url: url, expires: expires.Add(-presignedURLMargin)}
+		c.mu.Unlock()
+		return url, nil
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return value.(string), presigned, nil
+}
+
+// do runs call once for all concurrent lookups of a key. The call keeps the
+// values of the context of the lookup that starts it but not its
+// cancellation, so a cancelled panel does not fail the other lookups waiting
+// for the call. Every lookup still returns as soon as its own context ends.
+func (c *statusCache) do(ctx context.Context, key string, call func(context.Context) (interface{}, error)) (interface{}, error) {
+	results := c.group.DoChan(key, func() (interface{}, error) {
+		shared, cancel := context.WithTimeout(context.WithoutCancel(ctx), sharedCallTimeout)
+		defer cancel()
+		return call(shared)
+	})
+	select {
+	case result := <-results:
+		return result.Val, result.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// sweep drops the expired entries of the whole cache, at most once per
+// cacheSweepInterval. It is called with mu held.
+func (c *statusCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < cacheSweepInterval {
+		return
+	}
+	c.lastSweep = now
+	maps.DeleteFunc(c.executions, func(_ string, cached cachedExecution) bool { return !now.Before(cached.expires) })
+	maps.DeleteFunc(c.objects, func(_ string, cached cachedObject) bool { return !now.Before(cached.expires) })
+	maps.DeleteFunc(c.urls, func(_ string, cached cachedURL) bool { return !now.Before(cached.expires) })
+}
+
+// invalidate drops the cached description of an execution that has changed.
+func (c *statusCache) invalidate(executionArn string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.executions, executionArn)
+}
+
+// clear drops all cached entries.
+func (c *statusCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.executions = map[string]cachedExecution{}
+	c.objects = map[string]cachedObject{}
+	c.urls = map[string]cachedURL{}
+}
@@ -0,0 +1,262 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	sfntypes "github.com/aws/aws-sdk-go-v2/service/sfn/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusCacheExecution(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        string
+		elapsed       time.Duration
+		expectedCalls int32
+	}{
+		{
+			name:          "running execution within TTL",
+			status:        "RUNNING",
+			elapsed:       runningStatusTTL - time.Second,
+			expectedCalls: 1,
+		},
+		{
+			name:          "running execution after TTL",
+			status:        "RUNNING",
+			elapsed:       runningStatusTTL,
+			expectedCalls: 2,
+		},
+		{
+			name:          "succeeded execution within TTL",
+			status:        "SUCCEEDED",
+			elapsed:       terminalStatusTTL - time.Second,
+			expectedCalls: 1,
+		},
+		{
+			name:          "failed execution after TTL",
+			status:        "FAILED",
+			elapsed:       terminalStatusTTL,
+			expectedCalls: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2025, 10, 1, 12, 0, 0, 0, time.UTC)
+			cache := newStatusCache()
+			cache.now = func() time.Time { return now }
+
+			var calls int32
+			fetch := func(ctx context.Context) (*sfn.DescribeExecutionOutput, error) {
+				atomic.AddInt32(&calls, 1)
+				return &sfn.DescribeExecutionOutput{Status: sfntypes.ExecutionStatus(tt.status)}, nil
+			}
+
+			_, err := cache.execution(context.Background(), "arn", fetch)
+			require.NoError(t, err)
+			now = now.Add(tt.elapsed)
+			result, err := cache.execution(context.Background(), "arn", fetch)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.status, string(result.Status))
+			assert.Equal(t, tt.expectedCalls, calls)
+		})
+	}
+}
+
+func TestStatusCacheDeduplicatesConcurrentLookups(t *testing.T) {
+	cache := newStatusCache()
+
+	var calls int32
+	release := make(chan struct{})
+	fetch := func(ctx context.Context) (*sfn.DescribeExecutionOutput, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return &sfn.DescribeExecutionOutput{Status: "RUNNING"}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := cache.execution(context.Background(), "arn", fetch)
+			assert.NoError(t, err)
+			assert.Equal(t, "RUNNING", string(result.Status))
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls)
+}
+
+func TestStatusCacheSharedLookupOutlivesCancelledCaller(t *testing.T) {
+	cache := newStatusCache()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fetch := func(ctx context.Context) (*sfn.DescribeExecutionOutput, error) {
+		close(started)
+		select {
+		case <-release:
+			return &sfn.DescribeExecutionOutput{Status: "SUCCEEDED"}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	// The first caller starts the shared call and gives up
+	first, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := cache.execution(first, "arn", fetch)
+		done <- err
+	}()
+	<-started
+
+	second := make(chan *sfn.DescribeExecutionOutput)
+	go func() {
+		result, err := cache.execution(context.Background(), "arn", fetch)
+		assert.NoError(t, err)
+		second <- result
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+
+	close(release)
+	result := <-second
+	require.NotNil(t, result)
+	assert.Equal(t, "SUCCEEDED", string(result.Status))
+}
+
+func TestStatusCacheDoesNotCacheErrors(t *testing.T) {
+	cache := newStatusCache()
+
+	var calls int32
+	fetch := func(ctx context.Context) (*sfn.DescribeExecutionOutput, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, errors.New("ThrottlingException")
+	}
+
+	_, err := cache.execution(context.Background(), "arn", fetch)
+	assert.Error(t, err)
+	_, err = cache.execution(context.Background(), "arn", fetch)
+	assert.Error(t, err)
+	assert.Equal(t, int32(2), calls)
+}
+
+func TestStatusCacheDropsExpiredEntries(t *testing.T) {
+	now := time.Date(2025, 10, 1, 12, 0, 0, 0, time.UTC)
+	cache := newStatusCache()
+	cache.now = func() time.Time { return now }
+
+	describe := func(status sfntypes.ExecutionStatus) func(context.Context) (*sfn.DescribeExecutionOutput, error) {
+		return func(context.Context) (*sfn.DescribeExecutionOutput, error) {
+			return &sfn.DescribeExecutionOutput{Status: status}, nil
+		}
+	}
+	head := func(context.Context) (*s3.HeadObjectOutput, error) { return &s3.HeadObjectOutput{}, nil }
+	presign := func(context.Context) (string, time.Time, error) { return "https://example.com", time.Time{}, nil }
+
+	for _, arn := range []string{"arn-1", "arn-2", "arn-3"} {
+		_, err := cache.execution(context.Background(), arn, describe(sfntypes.ExecutionStatusSucceeded))
+		require.NoError(t, err)
+	}
+	_, err := cache.object(context.Background(), "bucket", "job-1.pcapng", head)
+	require.NoError(t, err)
+	_, _, err = cache.presignedURL(context.Background(), "bucket", "job-1.pcapng", presign)
+	require.NoError(t, err)
+
+	// Lookups of other jobs drop the expired entries of jobs no longer polled
+	now = now.Add(terminalStatusTTL)
+	_, err = cache.execution(context.Background(), "arn-4", describe(sfntypes.ExecutionStatusRunning))
+	require.NoError(t, err)
+	assert.Len(t, cache.executions, 1)
+	assert.Empty(t, cache.objects)
+	assert.Len(t, cache.urls, 1)
+
+	// Running executions and URLs expire as well
+	now = now.Add(presignedURLExpiry)
+	_, err = cache.execution(context.Background(), "arn-5", describe(sfntypes.ExecutionStatusRunning))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"arn-5"}, slices.Collect(maps.Keys(cache.executions)))
+	assert.Empty(t, cache.urls)
+}
+
+func TestStatusCachePresignedURL(t *testing.T) {
+	now := time.Date(2025, 10, 1, 12, 0, 0, 0, time.UTC)
+	cache := newStatusCache()
+	cache.now = func() time.Time { return now }
+
+	var calls int32
+	presign := func(ctx context.Context) (string, time.Time, error) {
+		n := atomic.AddInt32(&calls, 1)
+		return "https://example.com/" + string(rune('0'+n)), time.Time{}, nil
+	}
+
+	url, presigned, err := cache.presignedURL(context.Background(), "bucket", "key", presign)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/1", url)
+	assert.True(t, presigned)
+
+	// Served from the cache until shortly before the URL expires
+	now = now.Add(presignedURLExpiry - presignedURLMargin - time.Second)
+	url, presigned, err = cache.presignedURL(context.Background(), "bucket", "key", presign)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/1", url)
+	assert.False(t, presigned)
+
+	now = now.Add(time.Second)
+	url, presigned, err = cache.presignedURL(context.Background(), "bucket", "key", presign)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/2", url)
+	assert.True(t, presigned)
+
+	cache.clear()
+	url, _, err = cache.presignedURL(context.Background(), "bucket", "key", presign)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/3", url)
+}
+
+func TestStatusCachePresignedURLWithExpiringCredentials(t *testing.T) {
+	now := time.Date(2025, 10, 1, 12, 0, 0, 0, time.UTC)
+	cache := newStatusCache()
+	cache.now = func() time.Time { return now }
+
+	// Assumed role sessions last 15 minutes by default
+	credentialsExpire := now.Add(15 * time.Minute)
+	var calls int32
+	presign := func(ctx context.Context) (string, time.Time, error) {
+		n := atomic.AddInt32(&calls, 1)
+		return "https://example.com/" + string(rune('0'+n)), credentialsExpire, nil
+	}
+
+	url, _, err := cache.presignedURL(context.Background(), "bucket", "key", presign)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/1", url)
+
+	// Served from the cache until shortly before the credentials expire
+	now = now.Add(15*time.Minute - presignedURLMargin - time.Second)
+	url, _, err = cache.presignedURL(context.Background(), "bucket", "key", presign)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/1", url)
+
+	credentialsExpire = now.Add(time.Hour)
+	now = now.Add(time.Second)
+	url, _, err = cache.presignedURL(context.Background(), "bucket", "key", presign)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/2", url)
+}
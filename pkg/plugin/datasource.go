@@ -3,9 +3,12 @@ package plugin
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"runtime/debug"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -13,13 +16,18 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	sfntypes "github.com/aws/aws-sdk-go-v2/service/sfn/types"
 	"github.com/emnify/pcap-extractor/pkg/models"
 	"github.com/grafana/grafana-aws-sdk/pkg/awsauth"
 	"github.com/grafana/grafana-aws-sdk/pkg/awsds"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/httpclient"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Define separate interfaces to facilitate mocking in tests
@@ -27,6 +35,18 @@ type SFNClientInterface interface {
 	StartExecution(ctx context.Context, params *sfn.StartExecutionInput, optFns ...func(*sfn.Options)) (*sfn.StartExecutionOutput, error)
 	DescribeExecution(ctx context.Context, params *sfn.DescribeExecutionInput, optFns ...func(*sfn.Options)) (*sfn.DescribeExecutionOutput, error)
 	DescribeStateMachine(ctx context.Context, params *sfn.DescribeStateMachineInput, optFns ...func(*sfn.Options)) (*sfn.DescribeStateMachineOutput, error)
+	ListExecutions(ctx context.Context, params *sfn.ListExecutionsInput, optFns ...func(*sfn.Options)) (*sfn.ListExecutionsOutput, error)
+	GetExecutionHistory(ctx context.Context, params *sfn.GetExecutionHistoryInput, optFns ...func(*sfn.Options)) (*sfn.GetExecutionHistoryOutput, error)
+	RedriveExecution(ctx context.Context, params *sfn.RedriveExecutionInput, optFns ...func(*sfn.Options)) (*sfn.RedriveExecutionOutput, error)
+	StopExecution(ctx context.Context, params *sfn.StopExecutionInput, optFns ...func(*sfn.Options)) (*sfn.StopExecutionOutput, error)
+}
+
+type S3ClientInterface interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
 }
 
 type S3PresignerInterface interface {
@@ -36,6 +56,7 @@ type S3PresignerInterface interface {
 var (
 	_ backend.QueryDataHandler      = (*Datasource)(nil)
 	_ backend.CheckHealthHandler    = (*Datasource)(nil)
+	_ backend.CallResourceHandler   = (*Datasource)(nil)
 	_ instancemgmt.InstanceDisposer = (*Datasource)(nil)
 )
 
@@ -76,50 +97,229 @@ func NewDatasource(ctx context.Context, settings backend.DataSourceInstanceSetti
 		HTTPClient:         httpClient,
 	}
 
-	// Get AWS config using Grafana AWS SDK
-	cfg, err := authConfig.GetConfig(ctx, authSettings)
+	// Get AWS config using Grafana AWS SDK, in the region and with the role
+	// of a target or the buckets if given
+	newConfig := func(region, assumeRoleArn, externalId string) (aws.Config, error) {
+		configSettings := roleSettings(authSettings, region, assumeRoleArn, externalId)
+		cfg, err := authConfig.GetConfig(ctx, configSettings)
+		if err != nil {
+			backend.Logger.Error("Failed to get AWS config",
+				"error", err,
+				"CredentialsProfile", awsDS.Profile,
+				"Region", configSettings.Region,
+				"AssumeRoleARN", configSettings.AssumeRoleARN,
+				"AuthType", awsDS.AuthType)
+			return aws.Config{}, fmt.Errorf("failed to get AWS config: %w", err)
+		}
+
+		// Throttled and transient failures are retried with adaptive backoff
+		cfg.Retryer = newRetryer(pluginSettings.MaxRetryAttempts)
+		return cfg, nil
+	}
+
+	cfg, err := newConfig("", "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	// The buckets may need credentials of another account than executions
+	s3Cfg, err := newConfig("", pluginSettings.S3AssumeRoleArn, pluginSettings.S3ExternalId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Upstream queries are sent to Grafana itself
+	grafanaClient, err := httpclient.New()
 	if err != nil {
-		backend.Logger.Error("Failed to get AWS config",
-			"error", err,
-			"CredentialsProfile", awsDS.Profile,
-			"Region", awsDS.Region,
-			"AuthType", awsDS.AuthType)
-		return nil, fmt.Errorf("failed to get AWS config: %w", err)
+		return nil, fmt.Errorf("failed to create Grafana HTTP client: %w", err)
 	}
 
 	// Create Step Functions client
 	sfnClient := sfn.NewFromConfig(cfg)
 
 	// Create S3 client
-	s3Client := s3.NewFromConfig(cfg)
+	s3Client := s3.NewFromConfig(s3Cfg)
 
-	return &Datasource{
+	// Create the clients of every further target in its region
+	targets := make([]*extractionTarget, 0, len(pluginSettings.Targets))
+	for _, target := range pluginSettings.Targets {
+		targetCfg, err := newConfig(target.Region, target.AssumeRoleArn, target.ExternalId)
+		if err != nil {
+			return nil, fmt.Errorf("target %q: %w", target.Name, err)
+		}
+		targetS3Cfg, err := newConfig(target.Region, target.S3AssumeRoleArn, target.S3ExternalId)
+		if err != nil {
+			return nil, fmt.Errorf("buckets of target %q: %w", target.Name, err)
+		}
+		targetS3Client := s3.NewFromConfig(targetS3Cfg)
+		targets = append(targets, &extractionTarget{
+			Target:        target,
+			sfnClient:     &instrumentedSFNClient{client: sfn.NewFromConfig(targetCfg)},
+			s3Client:      &instrumentedS3Client{client: targetS3Client},
+			s3Presigner:   &instrumentedS3Presigner{presigner: s3.NewPresignClient(targetS3Client)},
+			s3Credentials: targetS3Cfg.Credentials,
+		})
+	}
+
+	ds := &Datasource{
 		settings:          pluginSettings,
 		AWSConfigProvider: awsauth.NewConfigProvider(),
-		sfnClient:         sfnClient,
-		s3Client:          s3Client,
-		s3Presigner:       s3.NewPresignClient(s3Client),
-	}, nil
+		sfnClient:         &instrumentedSFNClient{client: sfnClient},
+		s3Client:          &instrumentedS3Client{client: s3Client},
+		s3Presigner:       &instrumentedS3Presigner{presigner: s3.NewPresignClient(s3Client)},
+		s3Credentials:     s3Cfg.Credentials,
+		quota:             newQuotaTracker(pluginSettings),
+		cache:             newStatusCache(),
+		logger:            newLogger(backend.Logger, pluginSettings.LogLevel),
+		grafanaClient:     grafanaClient,
+		targets:           targets,
+	}
+	if pluginSettings.AuditS3Prefix != "" {
+		ds.audit = newAuditWriter(ds.writeAuditEvent)
+	}
+	ds.resourceHandler = ds.newResourceHandler()
+
+	return ds, nil
+}
+
+// roleSettings returns the auth settings of the data source in another region
+// and with another role to assume, each if given. A role of its own replaces
+// the role of the data source together with its external ID.
+func roleSettings(settings awsauth.Settings, region, assumeRoleArn, externalId string) awsauth.Settings {
+	if region != "" {
+		settings.Region = region
+	}
+	if assumeRoleArn != "" {
+		settings.AssumeRoleARN, settings.ExternalID = assumeRoleArn, externalId
+	}
+	return settings
 }
 
 type Datasource struct {
 	AWSConfigProvider awsauth.ConfigProvider
 	settings          *models.PluginSettings
 	sfnClient         SFNClientInterface
-	s3Client          *s3.Client
+	s3Client          S3ClientInterface
 	s3Presigner       S3PresignerInterface
+	s3Credentials     aws.CredentialsProvider // of the presigner, to know when its URLs expire
+	resourceHandler   backend.CallResourceHandler
+	quota             *quotaTracker
+	cache             *statusCache
+	audit             *auditWriter
+	logger            log.Logger
+	grafanaClient     *http.Client
+
+	// Further targets to route source files to, the clients above belong to
+	// the default target
+	targets []*extractionTarget
 }
 
 type queryModel struct {
 	Action  string           `json:"action"`
 	JobId   string           `json:"JobId"`
-	Extract map[string][]int `json:"Extract"` // only for action=request
+	Extract map[string][]int `json:"Extract"` // only for action=request, plain or range encoded
+
+	// Extract as decoded, expanded by expandRequestExtract once it is within
+	// the limits of the request
+	rawExtract map[string]packetList
+
+	// Files of the extract in the order of their first captured packet, optional
+	FileOrder []string `json:"fileOrder"`
+
+	// Selection by time window and flow, an alternative to Extract
+	Selection *FlowSelection `json:"selection"`
+
+	// Query of another data source to build the extract from, an alternative
+	// to Extract
+	Upstream *UpstreamQuery `json:"upstream"`
+
+	// Batch status lookups, only for action=status
+	JobIds      []string `json:"jobIds"`
+	JobIdPrefix string   `json:"jobIdPrefix"`
+
+	// ID of the new job if a retry restarts the job, derived if empty
+	RetryJobId string `json:"retryJobId"`
+
+	// Template variable queries, only for action=variables
+	Variable     string `json:"variable"`
+	StatusFilter string `json:"statusFilter"`
+	S3Prefix     string `json:"s3Prefix"`
+
+	// Optional context of the request action, recorded in the job metadata
+	Query        string `json:"query"`
+	DashboardUID string `json:"dashboardUID"`
+	PanelId      int64  `json:"panelId"`
+
+	// Time range and interval of the originating query, taken from the DataQuery
+	TimeRange backend.TimeRange `json:"-"`
+	Interval  time.Duration     `json:"-"`
 }
 
 type StepFunctionInput struct {
 	JobId   string           `json:"jobId"`
 	Bucket  string           `json:"bucket"`
-	Extract map[string][]int `json:"extract"`
+	Extract map[string][]int `json:"extract,omitempty"`
+
+	// FileOrder lists the files of the extract in the order of their first
+	// captured packet, if the query results had capture times
+	FileOrder []string `json:"fileOrder,omitempty"`
+
+	// Selection replaces the extract of jobs selecting packets by time window
+	// and flow
+	Selection *FlowSelection `json:"selection,omitempty"`
+
+	// ExtractEncoding is "ranges" if the packets of the extract are encoded as
+	// ranges like [[1,500],[720,721]], and empty for plain lists
+	ExtractEncoding string `json:"extractEncoding,omitempty"`
+
+	// W3C trace context of the request, so that the extraction can continue
+	// the trace of the query that started it
+	TraceContext map[string]string `json:"traceContext,omitempty"`
+}
+
+// MarshalJSON encodes the extract as ranges if ExtractEncoding asks for it.
+func (in StepFunctionInput) MarshalJSON() ([]byte, error) {
+	type plain StepFunctionInput
+	if in.ExtractEncoding != models.ExtractEncodingRanges {
+		return json.Marshal(plain(in))
+	}
+	return json.Marshal(struct {
+		plain
+		Extract map[string][]packetRange `json:"extract,omitempty"`
+	}{plain(in), encodeExtract(in.Extract)})
+}
+
+// UnmarshalJSON accepts both plain and range encoded extracts.
+func (in *StepFunctionInput) UnmarshalJSON(b []byte) error {
+	type plain StepFunctionInput
+	aux := struct {
+		*plain
+		Extract map[string]packetList `json:"extract"`
+	}{plain: (*plain)(in)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	extract, err := decodeExtract(aux.Extract)
+	if err != nil {
+		return err
+	}
+	in.Extract = extract
+	return nil
+}
+
+// UnmarshalJSON accepts both plain and range encoded extracts. The extract is
+// kept as decoded until expandRequestExtract checks its size.
+func (qm *queryModel) UnmarshalJSON(b []byte) error {
+	type plain queryModel
+	aux := struct {
+		*plain
+		Extract map[string]packetList `json:"Extract"`
+	}{plain: (*plain)(qm)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	qm.rawExtract = aux.Extract
+	return nil
 }
 
 // Dispose here tells plugin SDK that plugin wants to clean up resources when a new instance
@@ -127,6 +327,9 @@ type StepFunctionInput struct {
 // be disposed and a new one will be created using NewSampleDatasource factory function.
 func (d *Datasource) Dispose() {
 	// Clean up datasource instance resources.
+	d.cache.clear()
+	d.quota.close()
+	d.audit.close()
 }
 
 // QueryData handles multiple queries and returns multiple responses.
@@ -134,72 +337,327 @@ func (d *Datasource) Dispose() {
 // The QueryDataResponse contains a map of RefID to the response for each query, and each response
 // contains Frames ([]*Frame).
 func (d *Datasource) QueryData(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	ctx, span := tracing.DefaultTracer().Start(ctx, "QueryData", trace.WithAttributes(
+		attribute.Int("queries", len(req.Queries)),
+	))
+	defer span.End()
+
 	// create response struct
 	response := backend.NewQueryDataResponse()
 
-	// loop over queries and execute them individually.
+	ctx = withClientIP(ctx, clientIP(req.GetHTTPHeaders(), ""))
+	ctx = withLogUser(ctx)
+	ctx = withAlerting(ctx, req.Headers[fromAlertHeader] == "true")
+	ctx = withUserIdToken(ctx, req.GetHTTPHeader(backend.GrafanaUserSignInTokenHeaderName))
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	workers := make(chan struct{}, max(d.settings.MaxConcurrentQueries, 1))
+
+	// save the response in a hashmap
+	// based on with RefID as identifier
+	setResponse := func(refID string, res backend.DataResponse) {
+		mu.Lock()
+		defer mu.Unlock()
+		response.Responses[refID] = res
+	}
+
+	setCancelled := func(q backend.DataQuery) {
+		res := cancelledResponse(ctx)
+		observeQuery(queryAction(q), res)
+		setResponse(q.RefID, res)
+	}
+
+	// execute the queries concurrently, at most MaxConcurrentQueries at a time
 	for _, q := range req.Queries {
-		res := d.query(ctx, req.PluginContext, q)
+		if ctx.Err() != nil {
+			setCancelled(q)
+			continue
+		}
 
-		// save the response in a hashmap
-		// based on with RefID as identifier
-		response.Responses[q.RefID] = res
+		select {
+		case workers <- struct{}{}:
+		case <-ctx.Done():
+			setCancelled(q)
+			continue
+		}
+
+		wg.Add(1)
+		go func(q backend.DataQuery) {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			setResponse(q.RefID, d.isolatedQuery(ctx, req.PluginContext, q))
+		}(q)
 	}
+	wg.Wait()
 
 	return response, nil
 }
 
-func (d *Datasource) query(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery) backend.DataResponse {
-	if err := d.validateSettings(ctx); err != nil {
-		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Incomplete plugin settings: %v", err.Error()))
+// isolatedQuery runs a single query so that neither a cancelled request nor
+// a panic affects the responses of the other queries.
+func (d *Datasource) isolatedQuery(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery) (response backend.DataResponse) {
+	defer func() {
+		if r := recover(); r != nil {
+			d.log(ctx).Error("Query panicked", "refId", query.RefID, "panic", r, "stack", string(debug.Stack()))
+			response = backend.ErrDataResponse(backend.StatusInternal, fmt.Sprintf("internal error: %v", r))
+		}
+	}()
+
+	if ctx.Err() != nil {
+		return cancelledResponse(ctx)
 	}
+	return d.query(ctx, pCtx, query)
+}
+
+func cancelledResponse(ctx context.Context) backend.DataResponse {
+	response := backend.ErrDataResponse(backend.StatusTimeout, fmt.Sprintf("query cancelled: %v", ctx.Err()))
+	frame := data.NewFrame("error")
+	frameMetaCustom(frame).ErrorCode = errorCodeCancelled
+	response.Frames = append(response.Frames, frame)
+	return response
+}
+
+func (d *Datasource) query(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery) (response backend.DataResponse) {
+	ctx, span := tracing.DefaultTracer().Start(ctx, "query", trace.WithAttributes(
+		attribute.String("ref_id", query.RefID),
+	))
+
+	ctx, executions := withJobExecutions(ctx)
 
 	// Unmarshal the JSON into our queryModel.
 	var qm queryModel
+	defer func() {
+		response = d.annotateResponse(qm, executions, response)
+		observeQuery(qm.Action, response)
+		span.SetAttributes(attribute.String("action", qm.Action), attribute.String("job_id", qm.JobId))
+		endSpan(span, response)
+	}()
+
+	if err := d.validateSettings(ctx); err != nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Incomplete plugin settings: %v", err.Error()))
+	}
 
 	err := json.Unmarshal(query.JSON, &qm)
 	if err != nil {
 		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("json unmarshal: %v", err.Error()))
 	}
+	qm.TimeRange = query.TimeRange
+	qm.Interval = query.Interval
+	ctx = withLogJob(ctx, qm.JobId)
+
+	if err := d.authorizeAction(ctx, qm.Action); err != nil {
+		d.log(ctx).Warn("Denied query action", "action", qm.Action, "error", err)
+		event := newAuditEvent(ctx, qm.Action, qm.JobId)
+		event.deny(err.Error())
+		d.emitAudit(ctx, event)
+		return backend.ErrDataResponse(backend.StatusForbidden, err.Error())
+	}
 
 	switch qm.Action {
 	case "request":
 		return d.handleRequestAction(ctx, qm)
 	case "status":
+		if len(qm.JobIds) > 0 || qm.JobIdPrefix != "" {
+			return d.handleBatchStatusAction(ctx, qm)
+		}
 		return d.handleStatusAction(ctx, qm)
+	case "history":
+		return d.handleHistoryAction(ctx, qm)
+	case "retry":
+		return d.handleRetryAction(ctx, qm)
+	case "variables":
+		return d.handleVariablesAction(ctx, qm)
+	case "metrics":
+		return d.handleMetricsAction(ctx, qm)
 	default:
 		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("unknown action: '%s'", qm.Action))
 	}
 }
 
-func (d *Datasource) handleRequestAction(ctx context.Context, qm queryModel) backend.DataResponse {
-	var response backend.DataResponse
+func (d *Datasource) handleRequestAction(ctx context.Context, qm queryModel) (response backend.DataResponse) {
+	ctx, span := tracing.DefaultTracer().Start(ctx, "handleRequestAction", trace.WithAttributes(
+		attribute.String("job_id", qm.JobId),
+	))
+	defer func() { endSpan(span, response) }()
+
+	event := newAuditEvent(ctx, auditActionRequest, qm.JobId)
+	defer func() {
+		event.failOnError(response)
+		d.emitAudit(ctx, event)
+	}()
+
+	// Size up range encoded extracts before expanding them
+	if err := d.expandRequestExtract(&qm); err != nil {
+		var quotaErr *QuotaError
+		if errors.As(err, &quotaErr) {
+			d.log(ctx).Warn("Request exceeds quota", "error", err)
+			return quotaResponse(quotaErr)
+		}
+		d.log(ctx).Warn("Rejected invalid request", "error", err)
+		return backend.ErrDataResponse(backend.StatusBadRequest, err.Error())
+	}
+	event.countExtract(qm.Extract)
 
 	// Check if we have extract data to process
-	if len(qm.Extract) == 0 {
+	sources := 0
+	for _, given := range []bool{len(qm.Extract) > 0, qm.Selection != nil, qm.Upstream != nil} {
+		if given {
+			sources++
+		}
+	}
+	if sources == 0 {
 		return backend.ErrDataResponse(backend.StatusBadRequest, "Extract parameter is required for request action")
 	}
+	if sources > 1 {
+		return backend.ErrDataResponse(backend.StatusBadRequest, "Extract, selection and upstream cannot be combined in one request")
+	}
 
 	if qm.JobId == "" {
 		return backend.ErrDataResponse(backend.StatusBadRequest, "JobId is required for request action")
 	}
+	// The job ID names the execution and the keys of its metadata and audit
+	// records, reject what Step Functions would reject before writing them
+	if err := validateJobId(qm.JobId); err != nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, err.Error())
+	}
+
+	// Build the extract from the results of the upstream query
+	if qm.Upstream != nil {
+		extract, fileOrder, err := d.upstreamExtract(ctx, *qm.Upstream, qm.TimeRange)
+		var upstreamErr *upstreamError
+		switch {
+		case errors.As(err, &upstreamErr):
+			d.log(ctx).Warn("Upstream query failed", "datasourceUid", qm.Upstream.DatasourceUID, "error", err)
+			return backend.ErrDataResponse(upstreamErr.status, err.Error())
+		case errors.As(err, new(*ExtractError)):
+			return backend.ErrDataResponse(backend.StatusBadRequest, err.Error())
+		case err != nil:
+			d.log(ctx).Error("Upstream query failed", "datasourceUid", qm.Upstream.DatasourceUID, "error", err)
+			return backend.ErrDataResponse(backend.StatusInternal, err.Error())
+		}
+		qm.Extract, qm.FileOrder = extract, fileOrder
+	}
+
+	// Reject bad extracts and selections now rather than deep inside the workflow
+	if err := d.prepareRequest(ctx, &qm); err != nil {
+		d.log(ctx).Warn("Rejected invalid request", "error", err)
+		return backend.ErrDataResponse(backend.StatusBadRequest, err.Error())
+	}
+	event.countExtract(qm.Extract)
+	if qm.Selection != nil {
+		event.Files = len(qm.Selection.Files)
+	}
 
-	backend.Logger.Info("Processing request action", "jobId", qm.JobId, "extract", qm.Extract)
+	// Enforce the limits on the size of the request before its source files
+	// are looked up. Selections count against the limit of files, but the
+	// packets they match cannot be counted before the extraction.
+	if d.quota != nil {
+		if limit := d.quota.selectionLimit(); limit != "" && qm.Selection != nil {
+			return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Selections are not allowed while the %s is limited, use an extract", limit))
+		}
+		if err := d.quota.checkSize(event.Files, event.Packets); err != nil {
+			d.log(ctx).Warn("Request exceeds quota", "error", err)
+			return quotaResponse(err)
+		}
+	}
+
+	if err := d.checkSources(ctx, qm); err != nil {
+		var extractErr *ExtractError
+		if errors.As(err, &extractErr) {
+			d.log(ctx).Warn("Rejected invalid request", "error", err)
+			return backend.ErrDataResponse(backend.StatusBadRequest, err.Error())
+		}
+		d.log(ctx).Error("Failed to check source files", "error", err)
+		return awsErrorResponse(backend.StatusBadGateway, "Failed to check source files", err)
+	}
+
+	if d.quota != nil && qm.Selection != nil {
+		files, err := d.countSelectionFiles(ctx, qm.Selection, d.settings.MaxFilesPerRequest)
+		if err != nil {
+			d.log(ctx).Error("Failed to count source files", "error", err)
+			return awsErrorResponse(backend.StatusBadGateway, "Failed to count source files", err)
+		}
+		event.Files = files
+	}
 
 	sfnInput := StepFunctionInput{
-		JobId:   qm.JobId,
-		Extract: qm.Extract,
-		Bucket:  d.settings.S3Bucket,
+		JobId:     qm.JobId,
+		Extract:   qm.Extract,
+		FileOrder: qm.FileOrder,
+		Selection: qm.Selection,
+		Bucket:    d.settings.S3Bucket,
 	}
 
-	// Call Step Function
-	executionArn, err := d.executeStepFunction(ctx, qm.JobId, sfnInput)
+	// Split the request into one sub-job per target of its source files
+	jobs, err := d.planJobs(qm, sfnInput)
 	if err != nil {
-		backend.Logger.Error("Failed to execute Step Function", "error", err)
-		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Step Function execution failed: %v", err.Error()))
+		return backend.ErrDataResponse(backend.StatusBadRequest, err.Error())
 	}
 
-	backend.Logger.Debug("Step Function executed successfully", "executionArn", executionArn)
+	// Enforce request limits, the reservation is undone if the job does not start
+	if d.quota != nil {
+		if err := d.reserveQuota(ctx, qm.JobId, event.Files, event.Packets); err != nil {
+			d.log(ctx).Warn("Request exceeds quota", "error", err)
+			return quotaResponse(err)
+		}
+		defer func() {
+			if response.Error != nil {
+				d.quota.abort(qm.JobId)
+			}
+		}()
+	}
+
+	// Record the job next to its output before starting it, so that there is
+	// no extraction without a record of who requested it
+	if d.s3Client != nil {
+		meta := newJobMetadata(ctx, qm)
+		if len(jobs) > 1 || jobs[0].Target != models.DefaultTargetName {
+			for _, job := range jobs {
+				meta.SubJobs = append(meta.SubJobs, job.SubJob)
+			}
+		}
+		if err := d.writeJobMetadata(ctx, meta); err != nil {
+			d.log(ctx).Error("Failed to write job metadata", "error", err)
+			return jobMetadataResponse(err)
+		}
+	}
+
+	// Without any started execution the record would block the job ID and
+	// show a job that never ran
+	var started []startedSubJob
+	defer func() {
+		if response.Error != nil && len(started) == 0 {
+			d.deleteJobMetadata(ctx, qm.JobId)
+		}
+	}()
+
+	// Call Step Function of every target, a job split across targets either
+	// runs on all of them or on none
+	for _, job := range jobs {
+		view, err := d.forTarget(job.Target)
+		if err != nil {
+			return backend.ErrDataResponse(backend.StatusInternal, err.Error())
+		}
+		executionArn, err := view.executeStepFunction(ctx, job.JobId, job.input)
+		if err != nil {
+			d.log(ctx).Error("Failed to execute Step Function", "error", err, "target", job.Target)
+			message := "Step Function execution failed"
+			if len(jobs) > 1 {
+				message = fmt.Sprintf("Step Function execution of target '%s' failed", job.Target)
+				if running := d.stopSubJobs(ctx, started, job.Target); len(running) > 0 {
+					message = fmt.Sprintf("%s, the sub-jobs on the targets %s could not be stopped and keep running", message, strings.Join(running, ", "))
+				}
+			}
+			return awsErrorResponse(backend.StatusBadGateway, message, err)
+		}
+		started = append(started, startedSubJob{SubJob: job.SubJob, view: view, executionArn: executionArn})
+		recordJobExecution(ctx, executionArn)
+		d.log(ctx).Debug("Step Function executed successfully", "executionArn", executionArn, "target", job.Target)
+	}
 
 	// Create response frame with execution information
 	frame := data.NewFrame("step_function_request")
@@ -212,35 +670,59 @@ func (d *Datasource) handleRequestAction(ctx context.Context, qm queryModel) bac
 	return response
 }
 
-func (d *Datasource) handleStatusAction(ctx context.Context, qm queryModel) backend.DataResponse {
-	var response backend.DataResponse
+func (d *Datasource) handleStatusAction(ctx context.Context, qm queryModel) (response backend.DataResponse) {
+	ctx, span := tracing.DefaultTracer().Start(ctx, "handleStatusAction", trace.WithAttributes(
+		attribute.String("job_id", qm.JobId),
+	))
+	defer func() { endSpan(span, response) }()
+
+	// Status polls are only audited when they presign a download URL or fail
+	event := newAuditEvent(ctx, auditActionURLIssued, qm.JobId)
+	urlIssued := false
+	defer func() {
+		event.failOnError(response)
+		if urlIssued || event.Outcome != auditOutcomeSuccess {
+			d.emitAudit(ctx, event)
+		}
+	}()
 
 	if qm.JobId == "" {
 		return backend.ErrDataResponse(backend.StatusBadRequest, "JobId is required for status action")
 	}
 
-	backend.Logger.Info("Processing status action", "jobId", qm.JobId)
+	d.log(ctx).Info("Processing status action")
 
-	arn, err := arn.Parse(d.settings.StepFunctionArn)
+	// Load the job metadata recorded by the request action, it decides who
+	// may see the job
+	meta, err := d.loadJob(ctx, qm.JobId)
 	if err != nil {
-		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Failed to parse Step Function ARN: %v", err.Error()))
+		return loadJobResponse(err)
+	}
+	if meta != nil {
+		event.Files, event.Packets = meta.Files, meta.Packets
 	}
 
-	// examplearn:aws:states:eu-west-1:123456789012:execution:my-pcap-extractor:run-1761774923333
-	executionArn := fmt.Sprintf("arn:aws:states:%v:%v:execution:%v:%v", arn.Region, arn.AccountID, strings.Replace(arn.Resource, "stateMachine:", "", 1), qm.JobId)
-	backend.Logger.Info("Trying to describe Step Function execution", "arn", executionArn)
-
-	// Get execution status from Step Functions
-	result, err := d.sfnClient.DescribeExecution(ctx, &sfn.DescribeExecutionInput{
-		ExecutionArn: &executionArn,
-	})
+	// Get execution status from Step Functions, of every target of the job
+	states, err := d.describeSubJobs(ctx, subJobs(qm.JobId, meta))
 	if err != nil {
-		backend.Logger.Error("Failed to describe Step Function execution", "error", err)
-		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Failed to get execution status: %v", err.Error()))
+		d.log(ctx).Error("Failed to describe Step Function execution", "error", err)
+		return awsErrorResponse(backend.StatusBadGateway, "Failed to get execution status", err)
+	}
+	for _, state := range states {
+		recordJobExecution(ctx, state.executionArn)
+	}
+	result := aggregateExecutions(states)
+	executionArn := states[0].executionArn
+	if len(states) > 1 {
+		executionArn = ""
 	}
 
 	status := string(result.Status)
-	backend.Logger.Info("Step Function execution status", "status", status, "executionArn", executionArn)
+	span.SetAttributes(attribute.String("status", status))
+	if d.quota != nil && result.Status != sfntypes.ExecutionStatusRunning && result.Status != sfntypes.ExecutionStatusPendingRedrive {
+		d.quota.finish(qm.JobId)
+	}
+	d.log(ctx).Info("Step Function execution status", "status", status, "executionArn", executionArn, "subJobs", len(states))
 
 	// Create response frame with status information
 	frame := data.NewFrame("step_function_status")
@@ -262,24 +744,172 @@ func (d *Datasource) handleStatusAction(ctx context.Context, qm queryModel) back
 		)
 	}
 
-	// If execution is successful, generate presigned URL
+	switch result.Status {
+	case sfntypes.ExecutionStatusFailed, sfntypes.ExecutionStatusTimedOut, sfntypes.ExecutionStatusAborted:
+		text := fmt.Sprintf("Extraction %s", strings.ToLower(strings.ReplaceAll(status, "_", " ")))
+		if result.Error != nil {
+			text = fmt.Sprintf("%s: %s", text, *result.Error)
+		}
+		if result.Cause != nil {
+			text = fmt.Sprintf("%s (%s)", text, *result.Cause)
+		}
+		setErrorCode(frame, errorCodeExecutionFailed, data.Notice{
+			Severity: data.NoticeSeverityError,
+			Text:     text,
+			Link:     states[0].view.consoleURL(states[0].JobId),
+		})
+	}
+
+	frame.Fields = append(frame.Fields, executionFields(result, executionArn, time.Now())...)
+
+	// Add the job metadata recorded by the request action, if there is any
+	if meta != nil {
+		frame.Fields = append(frame.Fields, metadataFields(meta)...)
+	}
+
+	// If execution is successful, describe the output and generate presigned
+	// URLs, one per sub-job of a job split across targets
+	urls := make([]string, len(states))
 	if status == "SUCCEEDED" {
-		s3Key := fmt.Sprintf("%s.pcapng", qm.JobId)
-		presignedURL, err := d.generatePresignedURL(ctx, d.settings.S3Bucket, s3Key)
-		if err != nil {
-			backend.Logger.Warn("Failed to generate presigned URL for completed execution", "error", err)
-		} else {
+		for i, state := range states {
+			view := state.view
+			s3Key := view.downloadKey(ctx, state.JobId)
+			if len(states) == 1 {
+				frame.Fields = append(frame.Fields, outputFields(view.describeOutput(ctx, s3Key))...)
+			}
+			if s3Key == "" {
+				setErrorCode(frame, errorCodeDownloadNotAllowed, data.Notice{
+					Severity: data.NoticeSeverityWarning,
+					Text:     "You are not allowed to download unanonymized captures and there is no anonymized capture for this job",
+				})
+			} else if presignedURL, presigned, err := view.generatePresignedURL(ctx, view.settings.S3Bucket, s3Key); err != nil {
+				d.log(ctx).Warn("Failed to generate presigned URL for completed execution", "error", err, "target", state.Target)
+				event.fail(err.Error())
+				setErrorCode(frame, errorCodePresignFailed, data.Notice{
+					Severity: data.NoticeSeverityWarning,
+					Text:     fmt.Sprintf("The extraction succeeded, but no download URL could be created: %v", err),
+					Link:     view.consoleURL(state.JobId),
+				})
+			} else {
+				urls[i] = presignedURL
+				urlIssued = urlIssued || presigned
+			}
+		}
+		if len(states) == 1 && urls[0] != "" {
 			frame.Fields = append(frame.Fields,
-				data.NewField("download_url", nil, []string{presignedURL}),
+				data.NewField("download_url", nil, []string{urls[0]}),
 			)
 		}
 	}
 
 	response.Frames = append(response.Frames, frame)
+	if len(states) > 1 {
+		response.Frames = append(response.Frames, subJobsFrame(states, urls))
+	}
 	return response
 }
 
-func (d *Datasource) executeStepFunction(ctx context.Context, name string, input StepFunctionInput) (string, error) {
+// executionFields returns the typed fields describing an execution. The
+// duration of a running execution is the time it has been running so far.
+func executionFields(result *sfn.DescribeExecutionOutput, executionArn string, now time.Time) []*data.Field {
+	var duration *float64
+	if result.StartDate != nil {
+		end := now
+		if result.StopDate != nil {
+			end = *result.StopDate
+		}
+		seconds := end.Sub(*result.StartDate).Seconds()
+		duration = &seconds
+	}
+	if result.ExecutionArn != nil {
+		executionArn = *result.ExecutionArn
+	}
+
+	return []*data.Field{
+		data.NewField("start_date", nil, []*time.Time{result.StartDate}),
+		data.NewField("stop_date", nil, []*time.Time{result.StopDate}),
+		data.NewField("duration", nil, []*float64{duration}).SetConfig(&data.FieldConfig{Unit: "s"}),
+		data.NewField("execution_arn", nil, []string{executionArn}),
+		data.NewField("state_machine_arn", nil, []string{aws.ToString(result.StateMachineArn)}),
+		data.NewField("redrive_count", nil, []int64{int64(aws.ToInt32(result.RedriveCount))}),
+	}
+}
+
+// outputFields returns the size and modification time of the output object,
+// empty if it is not known.
+func outputFields(output *s3.HeadObjectOutput) []*data.Field {
+	var (
+		size     *int64
+		modified *time.Time
+	)
+	if output != nil {
+		size, modified = output.ContentLength, output.LastModified
+	}
+	return []*data.Field{
+		data.NewField("output_size", nil, []*int64{size}).SetConfig(&data.FieldConfig{Unit: "bytes"}),
+		data.NewField("output_modified", nil, []*time.Time{modified}),
+	}
+}
+
+// describeOutput looks up the output object of a job, nil if there is none or
+// it cannot be described.
+func (d *Datasource) describeOutput(ctx context.Context, key string) *s3.HeadObjectOutput {
+	if key == "" || d.s3Client == nil {
+		return nil
+	}
+	output, err := d.cache.object(ctx, d.settings.S3Bucket, key, func(ctx context.Context) (*s3.HeadObjectOutput, error) {
+		return d.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(d.settings.S3Bucket),
+			Key:    aws.String(key),
+		})
+	})
+	if err != nil {
+		d.log(ctx).Warn("Failed to describe output object", "error", err, "key", key)
+		return nil
+	}
+	return output
+}
+
+// describeExecution describes an execution, served from the status cache
+// while the cached description is fresh.
+func (d *Datasource) describeExecution(ctx context.Context, executionArn string) (*sfn.DescribeExecutionOutput, error) {
+	return d.cache.execution(ctx, executionArn, func(ctx context.Context) (*sfn.DescribeExecutionOutput, error) {
+		return d.sfnClient.DescribeExecution(ctx, &sfn.DescribeExecutionInput{
+			ExecutionArn: &executionArn,
+		})
+	})
+}
+
+// executionArn derives the ARN of the execution of a job from the ARN of the
+// state machine, as the job ID is used as the execution name.
+func (d *Datasource) executionArn(jobId string) (string, error) {
+	arn, err := arn.Parse(d.settings.StepFunctionArn)
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse Step Function ARN: %v", err.Error())
+	}
+
+	// examplearn:aws:states:eu-west-1:123456789012:execution:my-pcap-extractor:run-1761774923333
+	return fmt.Sprintf("arn:aws:states:%v:%v:execution:%v:%v", arn.Region, arn.AccountID, strings.Replace(arn.Resource, "stateMachine:", "", 1), jobId), nil
+}
+
+func (d *Datasource) executeStepFunction(ctx context.Context, name string, input StepFunctionInput) (_ string, err error) {
+	ctx, span := tracing.DefaultTracer().Start(ctx, "executeStepFunction", trace.WithAttributes(
+		attribute.String("job_id", name),
+	))
+	defer func() {
+		if err != nil {
+			_ = tracing.Error(span, err)
+		}
+		span.End()
+	}()
+
+	// Pass the trace on to the extraction
+	input.TraceContext = traceContext(ctx)
+	if d.settings.ExtractEncoding == models.ExtractEncodingRanges && len(input.Extract) > 0 {
+		input.ExtractEncoding = models.ExtractEncodingRanges
+	} else {
+		input.ExtractEncoding = ""
+	}
 
 	inputJSON, err := json.Marshal(input)
 	if err != nil {
@@ -298,27 +928,77 @@ func (d *Datasource) executeStepFunction(ctx context.Context, name string, input
 		return "", fmt.Errorf("failed to execute Step Function execution: %w", err)
 	}
 
+	span.SetAttributes(attribute.String("execution_arn", aws.ToString(result.ExecutionArn)))
 	return *result.ExecutionArn, nil
 }
 
-func (d *Datasource) generatePresignedURL(ctx context.Context, bucket, key string) (string, error) {
+// generatePresignedURL returns a download URL for an object and reports
+// whether it was presigned now rather than taken from the cache.
+func (d *Datasource) generatePresignedURL(ctx context.Context, bucket, key string) (_ string, presigned bool, err error) {
+	// The URL itself is a credential and never added to the span
+	ctx, span := tracing.DefaultTracer().Start(ctx, "generatePresignedURL", trace.WithAttributes(
+		attribute.String("bucket", bucket),
+		attribute.String("key", key),
+	))
+	defer func() {
+		if err != nil {
+			_ = tracing.Error(span, err)
+		}
+		span.End()
+	}()
+
 	if d.s3Presigner == nil {
-		return "", fmt.Errorf("S3 presigner is not initialized")
+		return "", false, fmt.Errorf("S3 presigner is not initialized")
 	}
 
-	// Generate presigned URL for GetObject with 1 hour expiration
-	request, err := d.s3Presigner.PresignGetObject(ctx, &s3.GetObjectInput{
-		Bucket: &bucket,
-		Key:    &key,
-	}, func(opts *s3.PresignOptions) {
-		opts.Expires = time.Hour * 1
+	return d.cache.presignedURL(ctx, bucket, key, func(ctx context.Context) (string, time.Time, error) {
+		// The URL is valid no longer than the credentials it is signed with,
+		// and is not presigned for longer than that
+		expiry := presignedURLExpiry
+		credentialsExpire := d.presignCredentialsExpire(ctx)
+		if !credentialsExpire.IsZero() {
+			remaining := time.Until(credentialsExpire).Truncate(time.Second)
+			if remaining <= 0 {
+				return "", time.Time{}, fmt.Errorf("failed to generate presigned URL: the credentials expired at %s", credentialsExpire.UTC().Format(time.RFC3339))
+			}
+			expiry = min(expiry, remaining)
+		}
+
+		// Generate presigned URL for GetObject with at most 1 hour expiration
+		request, err := d.s3Presigner.PresignGetObject(ctx, &s3.GetObjectInput{
+			Bucket: &bucket,
+			Key:    &key,
+		}, func(opts *s3.PresignOptions) {
+			opts.Expires = expiry
+		})
+
+		if err != nil {
+			return "", time.Time{}, fmt.Errorf("failed to generate presigned URL: %w", err)
+		}
+
+		return request.URL, credentialsExpire, nil
 	})
+}
 
-	if err != nil {
-		return "", fmt.Errorf("failed to generate presigned URL: %w", err)
+// presignCredentialsExpire returns when the credentials download URLs are
+// signed with expire, zero if they do not or it is not known. Cached
+// credentials that expire within presignedURLMargin are refreshed first, so
+// that the URL can be cached for longer than the margin.
+func (d *Datasource) presignCredentialsExpire(ctx context.Context) time.Time {
+	if d.s3Credentials == nil {
+		return time.Time{}
 	}
-
-	return request.URL, nil
+	credentials, err := d.s3Credentials.Retrieve(ctx)
+	if err != nil || !credentials.CanExpire {
+		return time.Time{}
+	}
+	if cache, ok := d.s3Credentials.(interface{ Invalidate() }); ok && time.Until(credentials.Expires) < presignedURLMargin {
+		cache.Invalidate()
+		if refreshed, err := d.s3Credentials.Retrieve(ctx); err == nil && refreshed.CanExpire {
+			credentials = refreshed
+		}
+	}
+	return credentials.Expires
 }
 
 // CheckHealth handles health checks sent from Grafana to the plugin.
@@ -356,6 +1036,22 @@ func (d *Datasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRe
 		messages = append(messages, "Step Function is accessible")
 	}
 
+	// Test the Step Functions of the further targets
+	for _, target := range d.targets {
+		if target.sfnClient == nil {
+			continue
+		}
+		_, err := target.sfnClient.DescribeStateMachine(ctx, &sfn.DescribeStateMachineInput{
+			StateMachineArn: aws.String(target.StepFunctionArn),
+		})
+		if err != nil {
+			res.Status = backend.HealthStatusError
+			res.Message = fmt.Sprintf("Cannot access Step Function of target %s: %v", target.Name, err)
+			return res, nil
+		}
+		messages = append(messages, fmt.Sprintf("Step Function of target %s is accessible", target.Name))
+	}
+
 	messages = append(messages, "S3 Bucket access is not being tested.")
 
 	// Combine all success messages
@@ -3,15 +3,23 @@ package plugin
 import (
 	"context"
 	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/aws-sdk-go-v2/service/sfn"
 	"github.com/emnify/pcap-extractor/pkg/models"
+	"github.com/grafana/grafana-aws-sdk/pkg/awsauth"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 // MockSFNClient is a mock implementation of the Step Functions client
@@ -22,6 +30,14 @@ type MockSFNClient struct {
 // MockS3Presigner is a mock implementation of the S3 presigner
 type MockS3Presigner struct {
 	mock.Mock
+
+	mu      sync.Mutex
+	expires time.Duration // of the latest presigned URL
+}
+
+// MockS3Client is a mock implementation of the S3 client
+type MockS3Client struct {
+	mock.Mock
 }
 
 func (m *MockSFNClient) StartExecution(ctx context.Context, params *sfn.StartExecutionInput, optFns ...func(*sfn.Options)) (*sfn.StartExecutionOutput, error) {
@@ -48,7 +64,47 @@ func (m *MockSFNClient) DescribeStateMachine(ctx context.Context, params *sfn.De
 	return args.Get(0).(*sfn.DescribeStateMachineOutput), args.Error(1)
 }
 
+func (m *MockSFNClient) ListExecutions(ctx context.Context, params *sfn.ListExecutionsInput, optFns ...func(*sfn.Options)) (*sfn.ListExecutionsOutput, error) {
+	args := m.Called(ctx, params)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*sfn.ListExecutionsOutput), args.Error(1)
+}
+
+func (m *MockSFNClient) GetExecutionHistory(ctx context.Context, params *sfn.GetExecutionHistoryInput, optFns ...func(*sfn.Options)) (*sfn.GetExecutionHistoryOutput, error) {
+	args := m.Called(ctx, params)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*sfn.GetExecutionHistoryOutput), args.Error(1)
+}
+
+func (m *MockSFNClient) RedriveExecution(ctx context.Context, params *sfn.RedriveExecutionInput, optFns ...func(*sfn.Options)) (*sfn.RedriveExecutionOutput, error) {
+	args := m.Called(ctx, params)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*sfn.RedriveExecutionOutput), args.Error(1)
+}
+
+func (m *MockSFNClient) StopExecution(ctx context.Context, params *sfn.StopExecutionInput, optFns ...func(*sfn.Options)) (*sfn.StopExecutionOutput, error) {
+	args := m.Called(ctx, params)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*sfn.StopExecutionOutput), args.Error(1)
+}
+
 func (m *MockS3Presigner) PresignGetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error) {
+	var options s3.PresignOptions
+	for _, fn := range optFns {
+		fn(&options)
+	}
+	m.mu.Lock()
+	m.expires = options.Expires
+	m.mu.Unlock()
+
 	args := m.Called(ctx, params)
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
@@ -56,6 +112,46 @@ func (m *MockS3Presigner) PresignGetObject(ctx context.Context, params *s3.GetOb
 	return args.Get(0).(*v4.PresignedHTTPRequest), args.Error(1)
 }
 
+func (m *MockS3Client) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	args := m.Called(ctx, params)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.GetObjectOutput), args.Error(1)
+}
+
+func (m *MockS3Client) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	args := m.Called(ctx, params)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.HeadObjectOutput), args.Error(1)
+}
+
+func (m *MockS3Client) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	args := m.Called(ctx, params)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.ListObjectsV2Output), args.Error(1)
+}
+
+func (m *MockS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	args := m.Called(ctx, params)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.PutObjectOutput), args.Error(1)
+}
+
+func (m *MockS3Client) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	args := m.Called(ctx, params)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(*s3.DeleteObjectOutput), args.Error(1)
+}
+
 func TestHandleRequestAction(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -249,7 +345,7 @@ func TestHandleStatusAction(t *testing.T) {
 				assert.Len(t, response.Frames, 1)
 				frame := response.Frames[0]
 				assert.Equal(t, "step_function_status", frame.Name)
-				assert.Len(t, frame.Fields, 1)
+				assert.Len(t, frame.Fields, 7) // status and execution details
 				
 				// Check status field
 				statusField := frame.Fields[0]
@@ -280,7 +376,7 @@ func TestHandleStatusAction(t *testing.T) {
 				assert.Len(t, response.Frames, 1)
 				frame := response.Frames[0]
 				assert.Equal(t, "step_function_status", frame.Name)
-				assert.Len(t, frame.Fields, 1)
+				assert.Len(t, frame.Fields, 7) // status and execution details
 				
 				// Check status field
 				statusField := frame.Fields[0]
@@ -317,7 +413,7 @@ func TestHandleStatusAction(t *testing.T) {
 				assert.Len(t, response.Frames, 1)
 				frame := response.Frames[0]
 				assert.Equal(t, "step_function_status", frame.Name)
-				assert.Len(t, frame.Fields, 2) // status and download_url
+				assert.Len(t, frame.Fields, 10) // status, execution details, output details and download_url
 				
 				// Check status field
 				statusField := frame.Fields[0]
@@ -327,7 +423,7 @@ func TestHandleStatusAction(t *testing.T) {
 				assert.Equal(t, "SUCCEEDED", statusValue)
 				
 				// Check download_url field
-				downloadField := frame.Fields[1]
+				downloadField := frame.Fields[9]
 				assert.Equal(t, "download_url", downloadField.Name)
 				downloadValue, ok := downloadField.At(0).(string)
 				assert.True(t, ok)
@@ -356,7 +452,7 @@ func TestHandleStatusAction(t *testing.T) {
 				assert.Len(t, response.Frames, 1)
 				frame := response.Frames[0]
 				assert.Equal(t, "step_function_status", frame.Name)
-				assert.Len(t, frame.Fields, 3) // status, error, cause
+				assert.Len(t, frame.Fields, 9) // status, error, cause and execution details
 				
 				// Check status field
 				statusField := frame.Fields[0]
@@ -446,13 +542,14 @@ func TestHandleStatusAction(t *testing.T) {
 				settings: &models.PluginSettings{
 					StepFunctionArn: stepFunctionArn,
 					S3Bucket:        "test-bucket",
+					DownloadRoles:   []string{"Admin"},
 				},
 				sfnClient:   mockSFNClient,
 				s3Presigner: mockS3Presigner,
 			}
 
 			// Execute the function
-			ctx := context.Background()
+			ctx := userContext("admin", "Admin", 1)
 			response := ds.handleStatusAction(ctx, tt.queryModel)
 
 			// Validate response status
@@ -475,6 +572,73 @@ func TestHandleStatusAction(t *testing.T) {
 	}
 }
 
+func TestStatusActionTypedFields(t *testing.T) {
+	start := time.Date(2025, 10, 1, 12, 0, 0, 0, time.UTC)
+	stop := start.Add(90 * time.Second)
+	modified := stop.Add(-time.Second)
+	executionArn := "arn:aws:states:us-east-1:123456789012:execution:test-state-machine:test-job-123"
+	stateMachineArn := "arn:aws:states:us-east-1:123456789012:stateMachine:test-state-machine"
+	redriveCount := int32(1)
+	size := int64(4096)
+
+	mockSFNClient := &MockSFNClient{}
+	mockSFNClient.On("DescribeExecution", mock.Anything, mock.Anything).Return(&sfn.DescribeExecutionOutput{
+		Status:          "SUCCEEDED",
+		ExecutionArn:    &executionArn,
+		StateMachineArn: &stateMachineArn,
+		StartDate:       &start,
+		StopDate:        &stop,
+		RedriveCount:    &redriveCount,
+	}, nil)
+	mockS3Client := &MockS3Client{}
+	mockS3Client.On("GetObject", mock.Anything, mock.Anything).Return(nil, &types.NoSuchKey{})
+	mockS3Client.On("HeadObject", mock.Anything, matchKey("test-job-123.pcapng")).Return(&s3.HeadObjectOutput{
+		ContentLength: &size,
+		LastModified:  &modified,
+	}, nil).Once()
+	mockS3Presigner := &MockS3Presigner{}
+	mockS3Presigner.On("PresignGetObject", mock.Anything, mock.Anything).Return(&v4.PresignedHTTPRequest{URL: "https://example.com/presigned"}, nil)
+
+	ds := &Datasource{
+		settings: &models.PluginSettings{
+			StepFunctionArn: stateMachineArn,
+			S3Bucket:        "test-bucket",
+			DownloadRoles:   []string{"Admin"},
+		},
+		sfnClient:   mockSFNClient,
+		s3Client:    mockS3Client,
+		s3Presigner: mockS3Presigner,
+		cache:       newStatusCache(),
+	}
+
+	// The second poll is served from the cache without describing the output again
+	for i := 0; i < 2; i++ {
+		response := ds.handleStatusAction(userContext("admin", "Admin", 1), queryModel{Action: "status", JobId: "test-job-123"})
+		assert.NoError(t, response.Error)
+
+		frame := response.Frames[0]
+		value := func(name string) interface{} {
+			field, _ := frame.FieldByName(name)
+			if !assert.NotNil(t, field, name) {
+				return nil
+			}
+			return field.At(0)
+		}
+		assert.Equal(t, &start, value("start_date"))
+		assert.Equal(t, &stop, value("stop_date"))
+		duration := value("duration").(*float64)
+		assert.Equal(t, 90.0, *duration)
+		assert.Equal(t, executionArn, value("execution_arn"))
+		assert.Equal(t, stateMachineArn, value("state_machine_arn"))
+		assert.Equal(t, int64(1), value("redrive_count"))
+		assert.Equal(t, &size, value("output_size"))
+		assert.Equal(t, &modified, value("output_modified"))
+		assert.Equal(t, "https://example.com/presigned", value("download_url"))
+	}
+
+	mockS3Client.AssertExpectations(t)
+}
+
 func TestCheckHealth(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -586,4 +750,193 @@ func TestCheckHealth(t *testing.T) {
 			assert.Equal(t, tt.expectedMsg, result.Message)
 		})
 	}
-}
\ No newline at end of file
+}
+
+func TestQueryData(t *testing.T) {
+	settings := &models.PluginSettings{
+		StepFunctionArn:      "arn:aws:states:us-east-1:123456789012:stateMachine:test-state-machine",
+		S3Bucket:             "test-bucket",
+		StatusRoles:          models.DefaultStatusRoles,
+		MaxConcurrentQueries: 2,
+	}
+
+	var running, maxRunning int32
+	mockSFNClient := &MockSFNClient{}
+	mockSFNClient.On("DescribeExecution", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		current := atomic.AddInt32(&running, 1)
+		for {
+			observed := atomic.LoadInt32(&maxRunning)
+			if current <= observed || atomic.CompareAndSwapInt32(&maxRunning, observed, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+	}).Return(&sfn.DescribeExecutionOutput{Status: "RUNNING"}, nil)
+
+	ds := &Datasource{
+		settings:  settings,
+		sfnClient: mockSFNClient,
+	}
+
+	req := &backend.QueryDataRequest{}
+	for i, action := range []string{"status", "status", "status", "status", "unknown"} {
+		req.Queries = append(req.Queries, backend.DataQuery{
+			RefID: fmt.Sprintf("%c", 'A'+i),
+			JSON:  []byte(fmt.Sprintf(`{"action":%q,"jobId":"test-job-%d"}`, action, i)),
+		})
+	}
+
+	ctx := backend.WithUser(context.Background(), &backend.User{Login: "jdoe", Role: "Viewer"})
+	response, err := ds.QueryData(ctx, req)
+	assert.NoError(t, err)
+	assert.Len(t, response.Responses, 5)
+	for _, refID := range []string{"A", "B", "C", "D"} {
+		assert.NoError(t, response.Responses[refID].Error, refID)
+	}
+	assert.Contains(t, response.Responses["E"].Error.Error(), "unknown action")
+	assert.LessOrEqual(t, maxRunning, int32(2))
+	mockSFNClient.AssertNumberOfCalls(t, "DescribeExecution", 4)
+
+	t.Run("cancelled request", func(t *testing.T) {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		response, err := ds.QueryData(cancelled, req)
+		assert.NoError(t, err)
+		assert.Len(t, response.Responses, 5)
+		for refID, res := range response.Responses {
+			assert.Equal(t, backend.StatusTimeout, res.Status, refID)
+		}
+	})
+}
+
+func TestRoleSettings(t *testing.T) {
+	base := awsauth.Settings{
+		CredentialsProfile: "grafana",
+		AssumeRoleARN:      "arn:aws:iam::111111111111:role/pcap-extractor",
+		ExternalID:         "grafana-ext",
+		Region:             "us-east-1",
+	}
+
+	tests := []struct {
+		name          string
+		region        string
+		assumeRoleArn string
+		externalId    string
+		expected      awsauth.Settings
+	}{
+		{
+			name:     "data source settings",
+			expected: base,
+		},
+		{
+			name:   "other region",
+			region: "eu-west-1",
+			expected: awsauth.Settings{
+				CredentialsProfile: "grafana",
+				AssumeRoleARN:      "arn:aws:iam::111111111111:role/pcap-extractor",
+				ExternalID:         "grafana-ext",
+				Region:             "eu-west-1",
+			},
+		},
+		{
+			name:          "own role replaces external ID",
+			region:        "eu-west-1",
+			assumeRoleArn: "arn:aws:iam::222222222222:role/pcap-captures",
+			expected: awsauth.Settings{
+				CredentialsProfile: "grafana",
+				AssumeRoleARN:      "arn:aws:iam::222222222222:role/pcap-captures",
+				Region:             "eu-west-1",
+			},
+		},
+		{
+			name:          "own role with external ID",
+			assumeRoleArn: "arn:aws:iam::222222222222:role/pcap-captures",
+			externalId:    "captures-ext",
+			expected: awsauth.Settings{
+				CredentialsProfile: "grafana",
+				AssumeRoleARN:      "arn:aws:iam::222222222222:role/pcap-captures",
+				ExternalID:         "captures-ext",
+				Region:             "us-east-1",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, roleSettings(base, tt.region, tt.assumeRoleArn, tt.externalId))
+		})
+	}
+}
+
+func TestGeneratePresignedURLWithRoleCredentials(t *testing.T) {
+	now := time.Now()
+	mockS3Presigner := &MockS3Presigner{}
+	mockS3Presigner.On("PresignGetObject", mock.Anything, mock.Anything).Return(&v4.PresignedHTTPRequest{URL: "https://example.com/presigned"}, nil).Twice()
+
+	ds := &Datasource{
+		settings:    &models.PluginSettings{S3Bucket: "test-bucket"},
+		s3Presigner: mockS3Presigner,
+		s3Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{CanExpire: true, Expires: now.Add(15 * time.Minute)}, nil
+		}),
+		cache: newStatusCache(),
+	}
+
+	_, _, err := ds.generatePresignedURL(context.Background(), "test-bucket", "test-job-123.pcapng")
+	assert.NoError(t, err)
+
+	// The URL stops working with the role session, it is presigned again
+	// before that even though it was presigned for an hour
+	ds.cache.now = func() time.Time { return now.Add(10 * time.Minute) }
+	_, _, err = ds.generatePresignedURL(context.Background(), "test-bucket", "test-job-123.pcapng")
+	assert.NoError(t, err)
+	mockS3Presigner.AssertExpectations(t)
+	assert.LessOrEqual(t, mockS3Presigner.expires, 15*time.Minute)
+}
+
+func TestGeneratePresignedURLRefreshesExpiringCredentials(t *testing.T) {
+	mockS3Presigner := &MockS3Presigner{}
+	mockS3Presigner.On("PresignGetObject", mock.Anything, mock.Anything).Return(&v4.PresignedHTTPRequest{URL: "https://example.com/presigned"}, nil).Once()
+
+	// The cached session ends within the margin, the next one lasts an hour
+	sessions := []time.Duration{5 * time.Minute, time.Hour}
+	retrieved := 0
+	ds := &Datasource{
+		settings:    &models.PluginSettings{S3Bucket: "test-bucket"},
+		s3Presigner: mockS3Presigner,
+		s3Credentials: aws.NewCredentialsCache(aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			session := sessions[min(retrieved, len(sessions)-1)]
+			retrieved++
+			return aws.Credentials{AccessKeyID: "key", SecretAccessKey: "secret", CanExpire: true, Expires: time.Now().Add(session)}, nil
+		})),
+		cache: newStatusCache(),
+	}
+
+	// Polls within the hour get the URL signed with the new session
+	for i := 0; i < 3; i++ {
+		_, _, err := ds.generatePresignedURL(context.Background(), "test-bucket", "test-job-123.pcapng")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 2, retrieved)
+	assert.Greater(t, mockS3Presigner.expires, 50*time.Minute)
+	mockS3Presigner.AssertExpectations(t)
+}
+
+func TestGeneratePresignedURLWithExpiredCredentials(t *testing.T) {
+	mockS3Presigner := &MockS3Presigner{}
+	ds := &Datasource{
+		settings:    &models.PluginSettings{S3Bucket: "test-bucket"},
+		s3Presigner: mockS3Presigner,
+		s3Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{CanExpire: true, Expires: time.Now().Add(-time.Minute)}, nil
+		}),
+		cache: newStatusCache(),
+	}
+
+	_, _, err := ds.generatePresignedURL(context.Background(), "test-bucket", "test-job-123.pcapng")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "the credentials expired")
+	mockS3Presigner.AssertNotCalled(t, "PresignGetObject", mock.Anything, mock.Anything)
+}
@@ -0,0 +1,155 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// newRetryer returns the retryer used for all AWS clients: throttled and
+// transient failures are retried with jittered exponential backoff, and the
+// client side rate limiter backs off further while AWS keeps throttling.
+func newRetryer(maxAttempts int) func() aws.Retryer {
+	return func() aws.Retryer {
+		return retry.AddWithMaxAttempts(retry.NewAdaptiveMode(), max(maxAttempts, 1))
+	}
+}
+
+// awsError classifies an error returned by an AWS call.
+type awsError struct {
+	status   backend.Status
+	code     string
+	message  string
+	attempts int
+}
+
+func (e *awsError) Error() string {
+	if e.attempts > 1 {
+		return fmt.Sprintf("%s (gave up after %d attempts)", e.message, e.attempts)
+	}
+	return e.message
+}
+
+// classifyAWSError maps an error of an AWS call to the backend status and a
+// message that tells the user whether the query, the configuration or AWS is
+// at fault. Errors it does not recognize are left with a zero status, callers
+// of AWS fall back to StatusBadGateway for them.
+func classifyAWSError(err error) *awsError {
+	classified := &awsError{message: err.Error()}
+
+	var maxAttempts *retry.MaxAttemptsError
+	if errors.As(err, &maxAttempts) {
+		classified.attempts = maxAttempts.Attempt
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		classified.status = backend.StatusTimeout
+		classified.message = "AWS request timed out"
+		return classified
+	}
+	if errors.Is(err, context.Canceled) {
+		classified.status = backend.StatusTimeout
+		classified.message = "AWS request was cancelled"
+		return classified
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		classified.code = apiErr.ErrorCode()
+		detail := apiErr.ErrorMessage()
+
+		switch classified.code {
+		case "AccessDenied", "AccessDeniedException", "UnrecognizedClientException", "InvalidClientTokenId",
+			"ExpiredToken", "ExpiredTokenException", "KMSAccessDeniedException":
+			classified.status = backend.StatusForbidden
+			classified.message = fmt.Sprintf("Access denied by AWS, check the IAM permissions of the data source: %s", detail)
+			return classified
+		case "ExecutionDoesNotExist":
+			classified.status = backend.StatusNotFound
+			classified.message = "Job not found"
+			return classified
+		case "StateMachineDoesNotExist":
+			classified.status = backend.StatusNotFound
+			classified.message = "Step Function not found, check the Step Function ARN of the data source"
+			return classified
+		case "NoSuchKey", "NotFound", "NoSuchBucket":
+			classified.status = backend.StatusNotFound
+			classified.message = fmt.Sprintf("S3 object not found: %s", detail)
+			return classified
+		case "InvalidName", "InvalidArn", "InvalidExecutionInput", "ValidationException", "InvalidToken":
+			classified.status = backend.StatusBadRequest
+			classified.message = fmt.Sprintf("Invalid request: %s", detail)
+			return classified
+		case "ExecutionAlreadyExists":
+			classified.status = backend.StatusBadRequest
+			classified.message = "A job with this ID already exists"
+			return classified
+		case "ExecutionLimitExceeded":
+			classified.status = backend.StatusTooManyRequests
+			classified.message = "Too many extraction jobs are running, try again later"
+			return classified
+		case "ThrottlingException", "Throttling", "TooManyRequestsException", "RequestLimitExceeded",
+			"SlowDown", "ProvisionedThroughputExceededException":
+			classified.status = backend.StatusTooManyRequests
+			classified.message = "AWS is throttling requests, try again shortly"
+			return classified
+		}
+	}
+
+	// Failures before a request reaches AWS: the credentials of the data
+	// source, the retry quota of the client or the connection
+	var signingErr *v4.SigningError
+	if errors.As(err, &signingErr) || strings.Contains(err.Error(), "get identity: ") {
+		classified.status = backend.StatusBadGateway
+		classified.message = fmt.Sprintf("AWS credentials of the data source are not available, check its authentication settings: %s", err)
+		return classified
+	}
+	var quotaErr ratelimit.QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		classified.status = backend.StatusTooManyRequests
+		classified.message = "Too many AWS requests failed recently, try again shortly"
+		return classified
+	}
+	var sendErr *smithyhttp.RequestSendError
+	if errors.As(err, &sendErr) {
+		classified.status = backend.StatusBadGateway
+		classified.message = fmt.Sprintf("AWS could not be reached, try again shortly: %s", sendErr.Err)
+		return classified
+	}
+
+	var responseErr *smithyhttp.ResponseError
+	if errors.As(err, &responseErr) && responseErr.HTTPStatusCode() >= 500 {
+		classified.status = backend.StatusBadGateway
+		classified.message = fmt.Sprintf("AWS is unavailable (HTTP %d), try again shortly", responseErr.HTTPStatusCode())
+	}
+	return classified
+}
+
+// awsErrorResponse returns an error response for a failed AWS call, with the
+// message prefixed by what was attempted. Unrecognized errors get the
+// fallback status.
+func awsErrorResponse(fallback backend.Status, prefix string, err error) backend.DataResponse {
+	classified := classifyAWSError(err)
+	status := classified.status
+	if status == 0 {
+		status = fallback
+	}
+	response := backend.ErrDataResponse(status, fmt.Sprintf("%s: %s", prefix, classified.Error()))
+
+	frame := data.NewFrame("error")
+	custom := frameMetaCustom(frame)
+	custom.ErrorCode = errorCodeForStatus(status)
+	custom.AWSErrorCode = classified.code
+	response.Frames = append(response.Frames, frame)
+	return response
+}
@@ -0,0 +1,154 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emnify/pcap-extractor/pkg/models"
+)
+
+func apiError(code, message string) error {
+	return &smithy.OperationError{
+		ServiceID:     "SFN",
+		OperationName: "StartExecution",
+		Err:           &smithy.GenericAPIError{Code: code, Message: message},
+	}
+}
+
+func TestClassifyAWSError(t *testing.T) {
+	serverError := &smithyhttp.ResponseError{
+		Response: &smithyhttp.Response{Response: &http.Response{StatusCode: http.StatusServiceUnavailable}},
+		Err:      errors.New("service unavailable"),
+	}
+
+	tests := []struct {
+		name            string
+		err             error
+		expectedStatus  backend.Status
+		expectedMessage string
+	}{
+		{
+			name:            "access denied",
+			err:             apiError("AccessDeniedException", "not authorized to perform states:StartExecution"),
+			expectedStatus:  backend.StatusForbidden,
+			expectedMessage: "Access denied by AWS, check the IAM permissions of the data source: not authorized to perform states:StartExecution",
+		},
+		{
+			name:            "unknown job",
+			err:             apiError("ExecutionDoesNotExist", "Execution Does Not Exist"),
+			expectedStatus:  backend.StatusNotFound,
+			expectedMessage: "Job not found",
+		},
+		{
+			name:            "duplicate job",
+			err:             apiError("ExecutionAlreadyExists", "Execution Already Exists"),
+			expectedStatus:  backend.StatusBadRequest,
+			expectedMessage: "A job with this ID already exists",
+		},
+		{
+			name:            "throttled after retries",
+			err:             &retry.MaxAttemptsError{Attempt: 5, Err: apiError("ThrottlingException", "Rate exceeded")},
+			expectedStatus:  backend.StatusTooManyRequests,
+			expectedMessage: "AWS is throttling requests, try again shortly (gave up after 5 attempts)",
+		},
+		{
+			name:            "server error",
+			err:             fmt.Errorf("operation error: %w", serverError),
+			expectedStatus:  backend.StatusBadGateway,
+			expectedMessage: "AWS is unavailable (HTTP 503), try again shortly",
+		},
+		{
+			name:            "deadline exceeded",
+			err:             fmt.Errorf("operation error: %w", context.DeadlineExceeded),
+			expectedStatus:  backend.StatusTimeout,
+			expectedMessage: "AWS request timed out",
+		},
+		{
+			name:            "no credentials",
+			err:             fmt.Errorf("operation error SFN: StartExecution, get identity: %w", errors.New("failed to refresh cached credentials, no EC2 IMDS role found")),
+			expectedStatus:  backend.StatusBadGateway,
+			expectedMessage: "AWS credentials of the data source are not available, check its authentication settings: operation error SFN: StartExecution, get identity: failed to refresh cached credentials, no EC2 IMDS role found",
+		},
+		{
+			name:            "signing without credentials",
+			err:             fmt.Errorf("operation error: %w", &v4.SigningError{Err: errors.New("failed to retrieve credentials: expired")}),
+			expectedStatus:  backend.StatusBadGateway,
+			expectedMessage: "AWS credentials of the data source are not available, check its authentication settings: operation error: failed to sign request: failed to retrieve credentials: expired",
+		},
+		{
+			name:            "retry quota exceeded",
+			err:             fmt.Errorf("operation error: %w", ratelimit.QuotaExceededError{Available: 0, Requested: 5}),
+			expectedStatus:  backend.StatusTooManyRequests,
+			expectedMessage: "Too many AWS requests failed recently, try again shortly",
+		},
+		{
+			name:            "connection failed",
+			err:             &retry.MaxAttemptsError{Attempt: 3, Err: &smithyhttp.RequestSendError{Err: errors.New("dial tcp: lookup states.eu-west-1.amazonaws.com: no such host")}},
+			expectedStatus:  backend.StatusBadGateway,
+			expectedMessage: "AWS could not be reached, try again shortly: dial tcp: lookup states.eu-west-1.amazonaws.com: no such host (gave up after 3 attempts)",
+		},
+		{
+			name:            "unrecognized error",
+			err:             errors.New("something else"),
+			expectedStatus:  0,
+			expectedMessage: "something else",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			classified := classifyAWSError(tt.err)
+			assert.Equal(t, tt.expectedStatus, classified.status)
+			assert.Equal(t, tt.expectedMessage, classified.Error())
+		})
+	}
+}
+
+func TestRequestActionSurfacesAWSErrors(t *testing.T) {
+	mockSFNClient := &MockSFNClient{}
+	mockSFNClient.On("StartExecution", mock.Anything, mock.Anything).
+		Return(nil, &retry.MaxAttemptsError{Attempt: 5, Err: apiError("ExecutionLimitExceeded", "Execution Limit Exceeded")})
+
+	ds := &Datasource{
+		settings: &models.PluginSettings{
+			StepFunctionArn: "arn:aws:states:eu-west-1:123456789012:stateMachine:test",
+			S3Bucket:        "test-bucket",
+		},
+		sfnClient: mockSFNClient,
+	}
+
+	response := ds.handleRequestAction(context.Background(), queryModel{
+		Action:  "request",
+		JobId:   "job-1",
+		Extract: map[string][]int{"file1.pcap": {1}},
+	})
+
+	require.Error(t, response.Error)
+	assert.Equal(t, backend.StatusTooManyRequests, response.Status)
+	assert.Equal(t, "Step Function execution failed: Too many extraction jobs are running, try again later (gave up after 5 attempts)", response.Error.Error())
+}
+
+func TestUnrecognizedAWSErrorsAreBadGateway(t *testing.T) {
+	mockSFNClient := &MockSFNClient{}
+	mockSFNClient.On("DescribeExecution", mock.Anything, mock.Anything).Return(nil, errors.New("something else"))
+	ds := &Datasource{settings: authzSettings(), sfnClient: mockSFNClient}
+
+	response := ds.handleStatusAction(userContext("admin", "Admin", 1), queryModel{Action: "status", JobId: "job-1"})
+
+	require.Error(t, response.Error)
+	assert.Equal(t, backend.StatusBadGateway, response.Status)
+	assert.Equal(t, "Failed to get execution status: something else", response.Error.Error())
+}
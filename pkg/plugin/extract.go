@@ -0,0 +1,530 @@
+package plugin
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	// maxExtractProblems bounds how many problems of an extract are reported.
+	maxExtractProblems = 10
+
+	// maxExpandedPackets bounds the number of packets the ranges of all files
+	// of an extract may expand to.
+	maxExpandedPackets = 1_000_000
+)
+
+// packetRange is an inclusive range of packet numbers.
+type packetRange [2]int
+
+// compressPackets sorts and dedupes packet numbers into ranges of
+// consecutive numbers.
+func compressPackets(packets []int) []packetRange {
+	sorted := slices.Clone(packets)
+	slices.Sort(sorted)
+	sorted = slices.Compact(sorted)
+
+	var ranges []packetRange
+	for _, packet := range sorted {
+		if n := len(ranges); n > 0 && ranges[n-1][1]+1 == packet {
+			ranges[n-1][1] = packet
+			continue
+		}
+		ranges = append(ranges, packetRange{packet, packet})
+	}
+	return ranges
+}
+
+// mergeRanges sorts ranges and merges the ones that overlap or adjoin, so
+// that they cover the same packets as compressPackets of their packets.
+func mergeRanges(ranges []packetRange) []packetRange {
+	sorted := slices.Clone(ranges)
+	slices.SortFunc(sorted, func(a, b packetRange) int { return cmp.Compare(a[0], b[0]) })
+
+	var merged []packetRange
+	for _, r := range sorted {
+		// The gap is computed unsigned so that extreme ranges cannot overflow
+		if n := len(merged); n > 0 && (r[0] <= merged[n-1][1] || uint64(r[0])-uint64(merged[n-1][1]) == 1) {
+			merged[n-1][1] = max(merged[n-1][1], r[1])
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// rangeWidth returns the number of packets of a range, or false if it covers
+// more than maxExpandedPackets.
+func rangeWidth(r packetRange) (int, bool) {
+	// The width is computed unsigned so that extreme ranges cannot overflow
+	width := uint64(r[1]) - uint64(r[0])
+	if width >= maxExpandedPackets {
+		return 0, false
+	}
+	return int(width) + 1, true
+}
+
+// packetList decodes the packets of a file from a plain list of packet
+// numbers, a list of ranges like [[1,500],[720,721]] or a string like
+// "1-500,720". Lists may mix packet numbers and ranges. The packets are kept
+// as ranges until the extract is expanded.
+type packetList []packetRange
+
+func (l *packetList) UnmarshalJSON(b []byte) error {
+	var text string
+	if err := json.Unmarshal(b, &text); err == nil {
+		ranges, err := parsePacketRanges(text)
+		if err != nil {
+			return err
+		}
+		return l.set(ranges)
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(b, &items); err != nil {
+		return fmt.Errorf("packets must be a list or a string of ranges: %w", err)
+	}
+	ranges := make([]packetRange, 0, len(items))
+	for _, item := range items {
+		var packet int
+		if err := json.Unmarshal(item, &packet); err == nil {
+			ranges = append(ranges, packetRange{packet, packet})
+			continue
+		}
+		var r []int
+		if err := json.Unmarshal(item, &r); err != nil || len(r) != 2 {
+			return fmt.Errorf("invalid packet or range %s, expected a number or [first, last]", item)
+		}
+		ranges = append(ranges, packetRange{r[0], r[1]})
+	}
+	return l.set(ranges)
+}
+
+func (l *packetList) set(ranges []packetRange) error {
+	for _, r := range ranges {
+		if r[0] > r[1] {
+			return fmt.Errorf("packet range %d-%d ends before it starts", r[0], r[1])
+		}
+	}
+	*l = ranges
+	return nil
+}
+
+// parsePacketRanges parses comma separated packet numbers and ranges like
+// "1-500,720".
+func parsePacketRanges(text string) ([]packetRange, error) {
+	var ranges []packetRange
+	for _, part := range strings.Split(text, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(part, "-")
+		from, err := strconv.Atoi(strings.TrimSpace(first))
+		to := from
+		if err == nil && isRange {
+			to, err = strconv.Atoi(strings.TrimSpace(last))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid packet range %q, expected a number or first-last", part)
+		}
+		ranges = append(ranges, packetRange{from, to})
+	}
+	return ranges, nil
+}
+
+// decodeExtract expands an extract whose packets may be range encoded. The
+// ranges of all files together may expand to at most maxExpandedPackets, so
+// that a short request cannot exhaust the memory of the plugin.
+func decodeExtract(raw map[string]packetList) (map[string][]int, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	total := 0
+	for _, ranges := range raw {
+		for _, r := range ranges {
+			width, ok := rangeWidth(r)
+			if !ok || total+width > maxExpandedPackets {
+				return nil, fmt.Errorf("packet ranges cover more than %d packets", maxExpandedPackets)
+			}
+			total += width
+		}
+	}
+
+	extract := make(map[string][]int, len(raw))
+	for file, ranges := range raw {
+		extract[file] = expandRanges(ranges)
+	}
+	return extract, nil
+}
+
+// countExtract returns the number of distinct packets and of ranges of
+// consecutive packets of a range encoded extract without expanding it.
+// Counts beyond maxExpandedPackets are capped.
+func countExtract(raw map[string]packetList) (packets int, ranges int) {
+	for _, list := range raw {
+		merged := mergeRanges(list)
+		ranges += len(merged)
+		for _, r := range merged {
+			width, ok := rangeWidth(r)
+			if !ok {
+				width = maxExpandedPackets
+			}
+			packets = min(packets+width, maxExpandedPackets)
+		}
+	}
+	return packets, ranges
+}
+
+// expandRequestExtract checks the range encoded extract of a request against
+// the limits of packets and ranges per request, and only then expands it.
+func (d *Datasource) expandRequestExtract(qm *queryModel) error {
+	if qm.rawExtract == nil {
+		return nil
+	}
+	packets, ranges := countExtract(qm.rawExtract)
+	if limit := d.settings.MaxPacketsPerRequest; limit > 0 && packets > limit {
+		return &QuotaError{Limit: "Maximum packets per request", Max: limit, Current: packets}
+	}
+	if limit := d.settings.MaxRangesPerRequest; limit > 0 && ranges > limit {
+		return &ExtractError{Problems: []string{fmt.Sprintf("the packets form %d ranges, at most %d are allowed", ranges, limit)}}
+	}
+
+	extract, err := decodeExtract(qm.rawExtract)
+	if err != nil {
+		return &ExtractError{Problems: []string{err.Error()}}
+	}
+	qm.Extract, qm.rawExtract = extract, nil
+	return nil
+}
+
+// encodeExtract range encodes the packets of an extract.
+func encodeExtract(extract map[string][]int) map[string][]packetRange {
+	if extract == nil {
+		return nil
+	}
+	encoded := make(map[string][]packetRange, len(extract))
+	for file, packets := range extract {
+		encoded[file] = compressPackets(packets)
+	}
+	return encoded
+}
+
+// expandRanges returns the packet numbers of ranges.
+func expandRanges(ranges []packetRange) []int {
+	var packets []int
+	for _, r := range ranges {
+		for i := 0; i <= r[1]-r[0]; i++ {
+			packets = append(packets, r[0]+i)
+		}
+	}
+	return packets
+}
+
+// extractFiles returns the sorted files of the extract of a request, whether
+// it is expanded yet or not.
+func (qm queryModel) extractFiles() []string {
+	if qm.rawExtract != nil {
+		return slices.Sorted(maps.Keys(qm.rawExtract))
+	}
+	return slices.Sorted(maps.Keys(qm.Extract))
+}
+
+// extractSize returns the number of files and packets of the extract of a
+// request, whether it is expanded yet or not.
+func (qm queryModel) extractSize() (files int, packets int) {
+	if qm.rawExtract != nil {
+		packets, _ = countExtract(qm.rawExtract)
+		return len(qm.rawExtract), packets
+	}
+	for _, numbers := range qm.Extract {
+		packets += len(numbers)
+	}
+	return len(qm.Extract), packets
+}
+
+// ExtractError lists the problems found in the extract or the selection of
+// a request.
+type ExtractError struct {
+	Problems []string
+
+	// selection marks problems of a selection rather than an extract
+	selection bool
+}
+
+func (e *ExtractError) Error() string {
+	problems := e.Problems
+	if len(problems) > maxExtractProblems {
+		problems = append(slices.Clone(problems[:maxExtractProblems]), fmt.Sprintf("and %d more", len(e.Problems)-maxExtractProblems))
+	}
+	subject := "extract"
+	if e.selection {
+		subject = "selection"
+	}
+	return fmt.Sprintf("Invalid %s: %s", subject, strings.Join(problems, "; "))
+}
+
+// prepareRequest validates and normalizes the extract or the selection of a
+// request. Whether its source files exist is checked by checkSources, once
+// the request is known to be within the limits.
+func (d *Datasource) prepareRequest(ctx context.Context, qm *queryModel) error {
+	if qm.Selection != nil {
+		if len(qm.FileOrder) > 0 {
+			return &ExtractError{Problems: []string{"fileOrder requires an extract"}, selection: true}
+		}
+		selection, err := d.normalizeSelection(*qm.Selection, qm.TimeRange)
+		if err != nil {
+			return err
+		}
+		qm.Selection = selection
+		d.log(ctx).Info("Processing request action", selection.logArgs()...)
+		return nil
+	}
+
+	extract, err := d.normalizeExtract(qm.Extract)
+	if err != nil {
+		return err
+	}
+	qm.Extract = extract
+	if err := checkFileOrder(qm.FileOrder, extract); err != nil {
+		return err
+	}
+
+	// The extract can be megabytes long, only its summary is logged
+	d.log(ctx).Info("Processing request action", summarizeExtract(extract).logArgs()...)
+	return nil
+}
+
+// checkSources verifies that the source files of the extract or the
+// selection of a prepared request exist.
+func (d *Datasource) checkSources(ctx context.Context, qm queryModel) error {
+	if qm.Selection == nil {
+		return d.checkSourceFiles(ctx, slices.Sorted(maps.Keys(qm.Extract)))
+	}
+	if qm.Selection.S3Prefix != "" {
+		return d.checkSourcePrefix(ctx, qm.Selection.S3Prefix)
+	}
+	return d.checkSourceFiles(ctx, qm.Selection.Files)
+}
+
+// normalizeExtract validates the extract of a request and returns it with
+// the packet numbers of every file sorted and deduplicated.
+func (d *Datasource) normalizeExtract(extract map[string][]int) (map[string][]int, error) {
+	files := make([]string, 0, len(extract))
+	for file := range extract {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	var problems []string
+	ranges := 0
+	normalized := make(map[string][]int, len(extract))
+	for _, file := range files {
+		if err := d.validateSourceFile(file); err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+
+		packets := extract[file]
+		if len(packets) == 0 {
+			problems = append(problems, fmt.Sprintf("file %q has no packets", file))
+			continue
+		}
+		valid := true
+		for _, packet := range packets {
+			if packet <= 0 {
+				problems = append(problems, fmt.Sprintf("file %q: packet number %d is not positive", file, packet))
+				valid = false
+				break
+			}
+			if limit := d.settings.MaxPacketNumber; limit > 0 && packet > limit {
+				problems = append(problems, fmt.Sprintf("file %q: packet number %d exceeds the maximum of %d", file, packet, limit))
+				valid = false
+				break
+			}
+		}
+		if !valid {
+			continue
+		}
+
+		fileRanges := compressPackets(packets)
+		ranges += len(fileRanges)
+		normalized[file] = expandRanges(fileRanges)
+	}
+	if limit := d.settings.MaxRangesPerRequest; limit > 0 && ranges > limit {
+		problems = append(problems, fmt.Sprintf("the packets form %d ranges, at most %d are allowed", ranges, limit))
+	}
+
+	if len(problems) > 0 {
+		return nil, &ExtractError{Problems: problems}
+	}
+	return normalized, nil
+}
+
+// checkFileOrder verifies that an order of files lists each file of the
+// extract exactly once.
+func checkFileOrder(order []string, extract map[string][]int) error {
+	if len(order) == 0 {
+		return nil
+	}
+	var problems []string
+	seen := make(map[string]bool, len(order))
+	for _, file := range order {
+		switch _, ok := extract[file]; {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("fileOrder lists %q, which is not in the extract", file))
+		case seen[file]:
+			problems = append(problems, fmt.Sprintf("fileOrder lists %q more than once", file))
+		}
+		seen[file] = true
+	}
+	for _, file := range slices.Sorted(maps.Keys(extract)) {
+		if !seen[file] {
+			problems = append(problems, fmt.Sprintf("fileOrder does not list %q", file))
+		}
+	}
+	if len(problems) > 0 {
+		return &ExtractError{Problems: problems}
+	}
+	return nil
+}
+
+// validateSourceFile checks that a source file is a plain S3 key below one of
+// the allowed prefixes.
+func (d *Datasource) validateSourceFile(file string) error {
+	return d.validateSourceKey("source file", file, file)
+}
+
+// validateSourcePrefix checks that a prefix of source files is a plain S3
+// key, optionally ending in a slash, below one of the allowed prefixes.
+func (d *Datasource) validateSourcePrefix(prefix string) error {
+	return d.validateSourceKey("source prefix", prefix, strings.TrimSuffix(prefix, "/"))
+}
+
+func (d *Datasource) validateSourceKey(kind, key, path string) error {
+	if key == "" {
+		return fmt.Errorf("empty %s name", kind)
+	}
+	if limit := d.settings.MaxFileNameLength; limit > 0 && len(key) > limit {
+		return fmt.Errorf("%s %.40q... is longer than %d characters", kind, key, limit)
+	}
+	if strings.IndexFunc(key, unicode.IsControl) >= 0 || strings.ContainsRune(key, unicode.ReplacementChar) {
+		return fmt.Errorf("%s %q contains control or invalid characters", kind, key)
+	}
+	if strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return fmt.Errorf("%s %q must be a relative key without backslashes", kind, key)
+	}
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("%s %q must not contain empty, '.' or '..' path segments", kind, key)
+		}
+	}
+	if prefixes := d.settings.SourcePrefixes; len(prefixes) > 0 && !slices.ContainsFunc(prefixes, func(prefix string) bool {
+		return strings.HasPrefix(key, prefix)
+	}) {
+		return fmt.Errorf("%s %q is not below an allowed prefix (%s)", kind, key, strings.Join(prefixes, ", "))
+	}
+	return nil
+}
+
+// sourceBucket returns the bucket holding the source files.
+func (d *Datasource) sourceBucket() string {
+	if d.settings.SourceBucket != "" {
+		return d.settings.SourceBucket
+	}
+	return d.settings.S3Bucket
+}
+
+// checkSourceFiles verifies that source files exist in the source bucket of
+// their target. Files that do not exist are reported as an ExtractError,
+// failed lookups as the AWS error.
+func (d *Datasource) checkSourceFiles(ctx context.Context, files []string) error {
+	if !d.settings.CheckSourceFiles {
+		return nil
+	}
+
+	names, routed := d.routeFiles(files)
+	var missing []string
+	for _, name := range names {
+		view, err := d.forTarget(name)
+		if err != nil {
+			return err
+		}
+		targetMissing, err := view.missingSourceFiles(ctx, routed[name])
+		if err != nil {
+			return err
+		}
+		missing = append(missing, targetMissing...)
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return &ExtractError{Problems: missing}
+	}
+	return nil
+}
+
+// missingSourceFiles looks up source files in the source bucket and describes
+// the ones that do not exist.
+func (d *Datasource) missingSourceFiles(ctx context.Context, files []string) ([]string, error) {
+	if d.s3Client == nil {
+		return nil, nil
+	}
+	bucket := d.sourceBucket()
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		missing  []string
+		firstErr error
+	)
+	workers := make(chan struct{}, max(d.settings.MaxConcurrentQueries, 1))
+	for _, file := range files {
+		wg.Add(1)
+		go func(file string) {
+			defer wg.Done()
+			select {
+			case workers <- struct{}{}:
+				defer func() { <-workers }()
+			case <-ctx.Done():
+				mu.Lock()
+				defer mu.Unlock()
+				if firstErr == nil {
+					firstErr = ctx.Err()
+				}
+				return
+			}
+
+			_, err := d.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(file),
+			})
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+			case classifyAWSError(err).code == "NotFound" || classifyAWSError(err).code == "NoSuchKey":
+				missing = append(missing, fmt.Sprintf("source file %q does not exist", file))
+			case firstErr == nil:
+				firstErr = err
+			}
+		}(file)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return missing, nil
+}
@@ -0,0 +1,322 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	"github.com/emnify/pcap-extractor/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressPackets(t *testing.T) {
+	assert.Nil(t, compressPackets(nil))
+	assert.Equal(t, []packetRange{{1, 3}, {7, 7}, {9, 10}}, compressPackets([]int{10, 2, 1, 3, 9, 7, 2}))
+	assert.Equal(t, []int{1, 2, 3, 7, 9, 10}, expandRanges([]packetRange{{1, 3}, {7, 7}, {9, 10}}))
+}
+
+func TestNormalizeExtract(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings models.PluginSettings
+		extract  map[string][]int
+		expected map[string][]int
+		problems []string
+	}{
+		{
+			name:     "sorts and dedupes packets",
+			extract:  map[string][]int{"2024/01/a.pcap": {5, 3, 3, 4}, "b.pcap": {1}},
+			expected: map[string][]int{"2024/01/a.pcap": {3, 4, 5}, "b.pcap": {1}},
+		},
+		{
+			name:    "rejects non-positive packets and empty lists",
+			extract: map[string][]int{"a.pcap": {3, 0}, "b.pcap": {-1}, "c.pcap": {}},
+			problems: []string{
+				`file "a.pcap": packet number 0 is not positive`,
+				`file "b.pcap": packet number -1 is not positive`,
+				`file "c.pcap" has no packets`,
+			},
+		},
+		{
+			name:    "rejects bad file names",
+			extract: map[string][]int{"": {1}, "/etc/passwd": {1}, "a/../../b.pcap": {1}, "a//b.pcap": {1}, "a\\b.pcap": {1}, "a\nb.pcap": {1}},
+			problems: []string{
+				"empty source file name",
+				`source file "/etc/passwd" must be a relative key without backslashes`,
+				`source file "a\nb.pcap" contains control or invalid characters`,
+				`source file "a/../../b.pcap" must not contain empty, '.' or '..' path segments`,
+				`source file "a//b.pcap" must not contain empty, '.' or '..' path segments`,
+				`source file "a\\b.pcap" must be a relative key without backslashes`,
+			},
+		},
+		{
+			name:     "enforces prefixes and maximums",
+			settings: models.PluginSettings{SourcePrefixes: []string{"captures/"}, MaxPacketNumber: 100, MaxFileNameLength: 20, MaxRangesPerRequest: 1},
+			extract:  map[string][]int{"other/a.pcap": {1}, "captures/a.pcap": {1, 3, 101}, "captures/b.pcap": {1, 3}, "captures/very-long-name.pcap": {1}},
+			problems: []string{
+				`file "captures/a.pcap": packet number 101 exceeds the maximum of 100`,
+				`source file "captures/very-long-name.pcap"... is longer than 20 characters`,
+				`source file "other/a.pcap" is not below an allowed prefix (captures/)`,
+				"the packets form 2 ranges, at most 1 are allowed",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := &Datasource{settings: &tt.settings}
+			normalized, err := ds.normalizeExtract(tt.extract)
+			if tt.problems == nil {
+				require.NoError(t, err)
+				assert.Equal(t, tt.expected, normalized)
+				return
+			}
+			var extractErr *ExtractError
+			require.True(t, errors.As(err, &extractErr))
+			assert.Equal(t, tt.problems, extractErr.Problems)
+		})
+	}
+}
+
+func TestExtractErrorMessage(t *testing.T) {
+	err := &ExtractError{Problems: make([]string, maxExtractProblems+3)}
+	for i := range err.Problems {
+		err.Problems[i] = "problem"
+	}
+	assert.True(t, strings.HasPrefix(err.Error(), "Invalid extract: problem; "))
+	assert.True(t, strings.HasSuffix(err.Error(), "; and 3 more"))
+}
+
+func TestRequestActionValidatesExtract(t *testing.T) {
+	executionArn := "arn:aws:states:us-east-1:123456789012:execution:test-state-machine:test-job-123"
+	settings := authzSettings()
+	settings.CheckSourceFiles = true
+	settings.SourceBucket = "source-bucket"
+
+	mockS3Client := &MockS3Client{}
+	mockS3Client.On("HeadObject", mock.Anything, mock.MatchedBy(func(input *s3.HeadObjectInput) bool {
+		return *input.Bucket == "source-bucket" && *input.Key == "missing.pcap"
+	})).Return(nil, apiError("NotFound", "Not Found"))
+	mockS3Client.On("HeadObject", mock.Anything, mock.Anything).Return(&s3.HeadObjectOutput{}, nil)
+	mockS3Client.On("PutObject", mock.Anything, mock.Anything).Return(&s3.PutObjectOutput{}, nil)
+	mockSFNClient := &MockSFNClient{}
+	mockSFNClient.On("StartExecution", mock.Anything, mock.Anything).Return(&sfn.StartExecutionOutput{ExecutionArn: aws.String(executionArn)}, nil)
+	ds := &Datasource{settings: settings, sfnClient: mockSFNClient, s3Client: mockS3Client}
+	ctx := userContext("jdoe", "Editor", 1)
+
+	// Missing source files are rejected before the job starts
+	resp := ds.handleRequestAction(ctx, queryModel{Action: "request", JobId: "test-job-123", Extract: map[string][]int{"a.pcap": {1}, "missing.pcap": {1}}})
+	require.Error(t, resp.Error)
+	assert.Equal(t, backend.StatusBadRequest, resp.Status)
+	assert.Equal(t, `Invalid extract: source file "missing.pcap" does not exist`, resp.Error.Error())
+	mockSFNClient.AssertNotCalled(t, "StartExecution", mock.Anything, mock.Anything)
+
+	// The order of files must list the files of the extract
+	resp = ds.handleRequestAction(ctx, queryModel{Action: "request", JobId: "test-job-123", Extract: map[string][]int{"a.pcap": {1}, "b.pcap": {1}}, FileOrder: []string{"c.pcap", "a.pcap", "a.pcap"}})
+	require.Error(t, resp.Error)
+	assert.Equal(t, `Invalid extract: fileOrder lists "c.pcap", which is not in the extract; fileOrder lists "a.pcap" more than once; fileOrder does not list "b.pcap"`, resp.Error.Error())
+
+	// Valid extracts are passed on normalized
+	resp = ds.handleRequestAction(ctx, queryModel{Action: "request", JobId: "test-job-123", Extract: map[string][]int{"a.pcap": {3, 1, 3, 2}}})
+	require.NoError(t, resp.Error)
+	var input StepFunctionInput
+	params := mockSFNClient.Calls[0].Arguments.Get(1).(*sfn.StartExecutionInput)
+	require.NoError(t, json.Unmarshal([]byte(*params.Input), &input))
+	assert.Equal(t, map[string][]int{"a.pcap": {1, 2, 3}}, input.Extract)
+}
+
+func TestCheckSourceFilesAWSError(t *testing.T) {
+	settings := authzSettings()
+	settings.CheckSourceFiles = true
+	mockS3Client := &MockS3Client{}
+	mockS3Client.On("HeadObject", mock.Anything, mock.Anything).Return(nil, apiError("AccessDenied", "Access Denied"))
+	ds := &Datasource{settings: settings, s3Client: mockS3Client}
+
+	err := ds.checkSourceFiles(context.Background(), []string{"a.pcap"})
+	require.Error(t, err)
+	assert.Equal(t, "AccessDenied", classifyAWSError(err).code)
+}
+
+func TestCheckSourceFilesStopsWaitingWhenCancelled(t *testing.T) {
+	settings := authzSettings()
+	settings.CheckSourceFiles = true
+	settings.MaxConcurrentQueries = 1
+	mockS3Client := &MockS3Client{}
+	mockS3Client.On("HeadObject", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		<-args.Get(0).(context.Context).Done()
+	}).Return(nil, context.Canceled)
+	ds := &Datasource{settings: settings, s3Client: mockS3Client}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	// The files waiting for a worker are not looked up any more
+	err := ds.checkSourceFiles(ctx, []string{"a.pcap", "b.pcap", "c.pcap"})
+	assert.ErrorIs(t, err, context.Canceled)
+	mockS3Client.AssertNumberOfCalls(t, "HeadObject", 1)
+}
+
+func TestPacketListDecoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		json     string
+		expected packetList
+		err      string
+	}{
+		{name: "plain list", json: `[3, 1, 2]`, expected: packetList{{3, 3}, {1, 1}, {2, 2}}},
+		{name: "ranges", json: `[[1, 3], [720, 721]]`, expected: packetList{{1, 3}, {720, 721}}},
+		{name: "mixed", json: `[[1, 2], 5]`, expected: packetList{{1, 2}, {5, 5}}},
+		{name: "string", json: `"1-3, 720"`, expected: packetList{{1, 3}, {720, 720}}},
+		{name: "empty string", json: `""`, expected: packetList{}},
+		{name: "reversed range", json: `[[5, 1]]`, err: "packet range 5-1 ends before it starts"},
+		{name: "bad range", json: `[[1, 2, 3]]`, err: "invalid packet or range [1, 2, 3], expected a number or [first, last]"},
+		{name: "bad string", json: `"1-x"`, err: `invalid packet range "1-x", expected a number or first-last`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var packets packetList
+			err := json.Unmarshal([]byte(tt.json), &packets)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			if len(tt.expected) == 0 {
+				assert.Empty(t, packets)
+				return
+			}
+			assert.Equal(t, tt.expected, packets)
+		})
+	}
+}
+
+func TestDecodeExtract(t *testing.T) {
+	tests := []struct {
+		name     string
+		json     string
+		expected map[string][]int
+		err      string
+	}{
+		{name: "expanded", json: `{"a.pcap": [3, [1, 2]], "b.pcap": "5-6"}`, expected: map[string][]int{"a.pcap": {3, 1, 2}, "b.pcap": {5, 6}}},
+		{name: "too many packets", json: `{"a.pcap": [[1, 2000000]]}`, err: "packet ranges cover more than 1000000 packets"},
+		{name: "extreme range", json: `{"a.pcap": [[-9223372036854775808, 9223372036854775807]]}`, err: "packet ranges cover more than 1000000 packets"},
+		{name: "too many packets across files", json: `{"a.pcap": [[1, 600000]], "b.pcap": [[1, 600000]]}`, err: "packet ranges cover more than 1000000 packets"},
+		{name: "overlapping ranges count twice", json: `{"a.pcap": [[1, 600000], [1, 600000]]}`, err: "packet ranges cover more than 1000000 packets"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var raw map[string]packetList
+			require.NoError(t, json.Unmarshal([]byte(tt.json), &raw))
+			extract, err := decodeExtract(raw)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, extract)
+		})
+	}
+}
+
+func TestCountExtract(t *testing.T) {
+	var raw map[string]packetList
+	require.NoError(t, json.Unmarshal([]byte(`{"a.pcap": [[1, 3], [2, 5], 7, 6, [10, 10]], "b.pcap": "1-999999,1-999999", "c.pcap": [[-9223372036854775808, 9223372036854775807]]}`), &raw))
+	packets, ranges := countExtract(raw)
+	assert.Equal(t, maxExpandedPackets, packets)
+	assert.Equal(t, 4, ranges)
+
+	delete(raw, "c.pcap")
+	delete(raw, "b.pcap")
+	packets, ranges = countExtract(raw)
+	assert.Equal(t, 8, packets)
+	assert.Equal(t, 2, ranges)
+}
+
+func TestExpandRequestExtract(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings models.PluginSettings
+		json     string
+		err      string
+	}{
+		{name: "within limits", settings: models.PluginSettings{MaxPacketsPerRequest: 10, MaxRangesPerRequest: 2}, json: `{"a.pcap": "1-5", "b.pcap": [1, 1, 2]}`},
+		{name: "too many packets", settings: models.PluginSettings{MaxPacketsPerRequest: 10}, json: `{"a.pcap": "1-999999", "b.pcap": "1-999999"}`, err: "Maximum packets per request exceeded: 1000000 of 10"},
+		{name: "too many ranges", settings: models.PluginSettings{MaxRangesPerRequest: 1}, json: `{"a.pcap": [1, 3]}`, err: "Invalid extract: the packets form 2 ranges, at most 1 are allowed"},
+		{name: "too many packets without limits", json: `{"a.pcap": "1-999999", "b.pcap": "1-999999"}`, err: "Invalid extract: packet ranges cover more than 1000000 packets"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := &Datasource{settings: &tt.settings}
+			var qm queryModel
+			require.NoError(t, json.Unmarshal([]byte(`{"action": "request", "Extract": `+tt.json+`}`), &qm))
+			err := ds.expandRequestExtract(&qm)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				assert.Nil(t, qm.Extract)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, map[string][]int{"a.pcap": {1, 2, 3, 4, 5}, "b.pcap": {1, 1, 2}}, qm.Extract)
+		})
+	}
+}
+
+func TestQueryModelRangeEncodedExtract(t *testing.T) {
+	var qm queryModel
+	require.NoError(t, json.Unmarshal([]byte(`{"action": "request", "JobId": "test-job-123", "Extract": {"a.pcap": [[1, 3], 7], "b.pcap": "10-11"}}`), &qm))
+	assert.Equal(t, "request", qm.Action)
+	assert.Equal(t, "test-job-123", qm.JobId)
+	require.NoError(t, (&Datasource{settings: &models.PluginSettings{}}).expandRequestExtract(&qm))
+	assert.Equal(t, map[string][]int{"a.pcap": {1, 2, 3, 7}, "b.pcap": {10, 11}}, qm.Extract)
+}
+
+func TestStepFunctionInputEncoding(t *testing.T) {
+	input := StepFunctionInput{JobId: "test-job-123", Bucket: "test-bucket", Extract: map[string][]int{"a.pcap": {1, 2, 3, 7}}}
+
+	plain, err := json.Marshal(input)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"jobId": "test-job-123", "bucket": "test-bucket", "extract": {"a.pcap": [1, 2, 3, 7]}}`, string(plain))
+
+	input.ExtractEncoding = models.ExtractEncodingRanges
+	ranges, err := json.Marshal(input)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"jobId": "test-job-123", "bucket": "test-bucket", "extract": {"a.pcap": [[1, 3], [7, 7]]}, "extractEncoding": "ranges"}`, string(ranges))
+
+	// Both forms decode to the same extract
+	for _, encoded := range [][]byte{plain, ranges} {
+		var decoded StepFunctionInput
+		require.NoError(t, json.Unmarshal(encoded, &decoded))
+		assert.Equal(t, input.Extract, decoded.Extract)
+		assert.Equal(t, "test-job-123", decoded.JobId)
+	}
+}
+
+func TestExecuteStepFunctionRangeEncoding(t *testing.T) {
+	settings := authzSettings()
+	settings.ExtractEncoding = models.ExtractEncodingRanges
+	mockSFNClient := &MockSFNClient{}
+	mockSFNClient.On("StartExecution", mock.Anything, mock.MatchedBy(func(input *sfn.StartExecutionInput) bool {
+		return strings.Contains(*input.Input, `"extract":{"a.pcap":[[1,500]]}`) && strings.Contains(*input.Input, `"extractEncoding":"ranges"`)
+	})).Return(&sfn.StartExecutionOutput{ExecutionArn: aws.String("arn")}, nil)
+	ds := &Datasource{settings: settings, sfnClient: mockSFNClient}
+
+	packets := make([]int, 500)
+	for i := range packets {
+		packets[i] = i + 1
+	}
+	_, err := ds.executeStepFunction(context.Background(), "test-job-123", StepFunctionInput{JobId: "test-job-123", Extract: map[string][]int{"a.pcap": packets}})
+	require.NoError(t, err)
+	mockSFNClient.AssertExpectations(t)
+}
@@ -0,0 +1,252 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/emnify/pcap-extractor/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// Machine-readable codes in the custom frame metadata, so panels can explain
+// what went wrong without parsing messages.
+const (
+	errorCodeInvalidRequest     = "invalid_request"
+	errorCodeForbidden          = "forbidden"
+	errorCodeNotFound           = "not_found"
+	errorCodeQuotaExceeded      = "quota_exceeded"
+	errorCodeThrottled          = "throttled"
+	errorCodeTimeout            = "timeout"
+	errorCodeCancelled          = "cancelled"
+	errorCodeAWSUnavailable     = "aws_unavailable"
+	errorCodeInternal           = "internal"
+	errorCodeExecutionFailed    = "execution_failed"
+	errorCodePresignFailed      = "presign_failed"
+	errorCodeDownloadNotAllowed = "download_not_allowed"
+)
+
+// FrameMetaCustom is the custom metadata of all frames returned by queries.
+type FrameMetaCustom struct {
+	ErrorCode    string `json:"errorCode,omitempty"`
+	AWSErrorCode string `json:"awsErrorCode,omitempty"`
+}
+
+func errorCodeForStatus(status backend.Status) string {
+	switch status {
+	case backend.StatusBadRequest:
+		return errorCodeInvalidRequest
+	case backend.StatusForbidden, backend.StatusUnauthorized:
+		return errorCodeForbidden
+	case backend.StatusNotFound:
+		return errorCodeNotFound
+	case backend.StatusTooManyRequests:
+		return errorCodeThrottled
+	case backend.StatusTimeout:
+		return errorCodeTimeout
+	case backend.StatusBadGateway:
+		return errorCodeAWSUnavailable
+	default:
+		return errorCodeInternal
+	}
+}
+
+// frameMetaCustom returns the custom metadata of a frame, adding it if the
+// frame has none.
+func frameMetaCustom(frame *data.Frame) *FrameMetaCustom {
+	if frame.Meta == nil {
+		frame.Meta = &data.FrameMeta{}
+	}
+	custom, ok := frame.Meta.Custom.(*FrameMetaCustom)
+	if !ok {
+		custom = &FrameMetaCustom{}
+		frame.Meta.Custom = custom
+	}
+	return custom
+}
+
+// setErrorCode records an error code in the frame metadata, together with a
+// notice for the user.
+func setErrorCode(frame *data.Frame, code string, notice data.Notice) {
+	frameMetaCustom(frame).ErrorCode = code
+	frame.AppendNotices(notice)
+}
+
+// jobExecutions collects the executions a query resolved its job to, so its
+// response describes and links to the executions on the targets they ran on.
+type jobExecutions struct {
+	arns []string
+}
+
+type jobExecutionsKey struct{}
+
+func withJobExecutions(ctx context.Context) (context.Context, *jobExecutions) {
+	executions := &jobExecutions{}
+	return context.WithValue(ctx, jobExecutionsKey{}, executions), executions
+}
+
+// recordJobExecution notes an execution of the job of the query.
+func recordJobExecution(ctx context.Context, executionArn string) {
+	if executions, ok := ctx.Value(jobExecutionsKey{}).(*jobExecutions); ok && !slices.Contains(executions.arns, executionArn) {
+		executions.arns = append(executions.arns, executionArn)
+	}
+}
+
+// annotateResponse adds the executed query to all frames of a response and,
+// for errors, a frame carrying the error code and a notice linking to the
+// execution in the AWS console.
+func (d *Datasource) annotateResponse(qm queryModel, executions *jobExecutions, response backend.DataResponse) backend.DataResponse {
+	executionArns := d.jobExecutionArns(qm.JobId, executions)
+	if response.Error != nil {
+		if len(response.Frames) == 0 {
+			response.Frames = append(response.Frames, data.NewFrame("error"))
+		}
+		frame := response.Frames[0]
+		custom := frameMetaCustom(frame)
+		if custom.ErrorCode == "" {
+			custom.ErrorCode = errorCodeForStatus(response.Status)
+		}
+		link := ""
+		if len(executionArns) > 0 {
+			link = executionConsoleURL(executionArns[0])
+		}
+		frame.AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityError,
+			Text:     response.Error.Error(),
+			Link:     link,
+		})
+	}
+
+	executed := d.executedQueryString(qm, executionArns)
+	for _, frame := range response.Frames {
+		if frame.Meta == nil {
+			frame.Meta = &data.FrameMeta{}
+		}
+		if frame.Meta.ExecutedQueryString == "" {
+			frame.Meta.ExecutedQueryString = executed
+		}
+	}
+	return response
+}
+
+// jobExecutionArns returns the executions of the job of a query, the ones
+// the query resolved it to. Without other targets the job can only run on
+// the state machine of the data source.
+func (d *Datasource) jobExecutionArns(jobId string, executions *jobExecutions) []string {
+	if executions != nil && len(executions.arns) > 0 {
+		return executions.arns
+	}
+	if jobId == "" || d.settings == nil || len(d.targets) > 0 {
+		return nil
+	}
+	executionArn, err := d.executionArn(jobId)
+	if err != nil {
+		return nil
+	}
+	return []string{executionArn}
+}
+
+// stateMachineArns returns the state machines of the targets, the default
+// one first.
+func (d *Datasource) stateMachineArns() string {
+	var arns []string
+	for _, target := range d.targetViews() {
+		arns = append(arns, target.view.settings.StepFunctionArn)
+	}
+	return strings.Join(arns, ", ")
+}
+
+// requestStateMachineArns returns the state machines a request goes to.
+func (d *Datasource) requestStateMachineArns(qm queryModel) string {
+	var keys []string
+	switch {
+	case qm.Selection != nil && qm.Selection.S3Prefix != "":
+		keys = []string{qm.Selection.S3Prefix}
+	case qm.Selection != nil:
+		keys = qm.Selection.Files
+	default:
+		keys = qm.extractFiles()
+	}
+	names, _ := d.routeFiles(keys)
+	if len(names) == 0 {
+		names = []string{models.DefaultTargetName}
+	}
+	var arns []string
+	for _, name := range names {
+		if view, err := d.forTarget(name); err == nil {
+			arns = append(arns, view.settings.StepFunctionArn)
+		}
+	}
+	return strings.Join(arns, ", ")
+}
+
+// executedQueryString describes the AWS calls behind a query.
+func (d *Datasource) executedQueryString(qm queryModel, executionArns []string) string {
+	executions := strings.Join(executionArns, ", ")
+	switch qm.Action {
+	case "request":
+		stateMachines := d.requestStateMachineArns(qm)
+		if qm.Selection != nil {
+			source := fmt.Sprintf("%d files", len(qm.Selection.Files))
+			if qm.Selection.S3Prefix != "" {
+				source = fmt.Sprintf("the files below %q", qm.Selection.S3Prefix)
+			}
+			return fmt.Sprintf("StartExecution of %s as job %s selecting the packets of %s", stateMachines, qm.JobId, source)
+		}
+		files, packets := qm.extractSize()
+		return fmt.Sprintf("StartExecution of %s as job %s with %d files and %d packets", stateMachines, qm.JobId, files, packets)
+	case "status":
+		if len(qm.JobIds) > 0 || qm.JobIdPrefix != "" {
+			return fmt.Sprintf("DescribeExecution of %d jobs and the executions of %s starting with %q", len(qm.JobIds), d.stateMachineArns(), qm.JobIdPrefix)
+		}
+		if executions != "" {
+			return fmt.Sprintf("DescribeExecution of %s", executions)
+		}
+	case "history":
+		if executions != "" {
+			return fmt.Sprintf("GetExecutionHistory of %s", executions)
+		}
+	case "retry":
+		if executions != "" {
+			return fmt.Sprintf("RedriveExecution or StartExecution for %s", executions)
+		}
+	case "metrics":
+		return fmt.Sprintf("ListExecutions of %s from %s to %s", d.stateMachineArns(),
+			qm.TimeRange.From.UTC().Format(time.RFC3339), qm.TimeRange.To.UTC().Format(time.RFC3339))
+	case "variables":
+		switch qm.Variable {
+		case variableJobIds:
+			return fmt.Sprintf("ListExecutions of %s", d.stateMachineArns())
+		case variablePrefixes, variableObjects:
+			return fmt.Sprintf("ListObjectsV2 of s3://%s/%s", d.settings.S3Bucket, qm.S3Prefix)
+		}
+	}
+	return ""
+}
+
+// consoleURL links to the execution of a job in the AWS console, empty if
+// there is no job.
+func (d *Datasource) consoleURL(jobId string) string {
+	if jobId == "" || d.settings == nil {
+		return ""
+	}
+	executionArn, err := d.executionArn(jobId)
+	if err != nil {
+		return ""
+	}
+	return executionConsoleURL(executionArn)
+}
+
+// executionConsoleURL links to an execution in the AWS console.
+func executionConsoleURL(executionArn string) string {
+	parsed, err := arn.Parse(executionArn)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("https://%s.console.aws.amazon.com/states/home?region=%s#/v2/executions/details/%s",
+		parsed.Region, parsed.Region, executionArn)
+}
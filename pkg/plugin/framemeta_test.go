@@ -0,0 +1,160 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+const consoleLink = "https://us-east-1.console.aws.amazon.com/states/home?region=us-east-1#/v2/executions/details/arn:aws:states:us-east-1:123456789012:execution:test-state-machine:test-job-123"
+
+func TestQueryFrameMeta(t *testing.T) {
+	tests := []struct {
+		name             string
+		query            map[string]interface{}
+		setupSFNMock     func(*MockSFNClient)
+		setupPresigner   func(*MockS3Presigner)
+		expectedStatus   backend.Status
+		expectedExecuted string
+		expectedCode     string
+		expectedAWSCode  string
+		expectedNotice   *data.Notice
+	}{
+		{
+			name:  "running job",
+			query: map[string]interface{}{"action": "status", "JobId": "test-job-123"},
+			setupSFNMock: func(mockClient *MockSFNClient) {
+				mockClient.On("DescribeExecution", mock.Anything, mock.Anything).Return(&sfn.DescribeExecutionOutput{Status: "RUNNING"}, nil)
+			},
+			expectedStatus:   backend.StatusOK,
+			expectedExecuted: "DescribeExecution of arn:aws:states:us-east-1:123456789012:execution:test-state-machine:test-job-123",
+		},
+		{
+			name:  "failed job",
+			query: map[string]interface{}{"action": "status", "JobId": "test-job-123"},
+			setupSFNMock: func(mockClient *MockSFNClient) {
+				mockClient.On("DescribeExecution", mock.Anything, mock.Anything).Return(&sfn.DescribeExecutionOutput{
+					Status: "FAILED",
+					Error:  aws.String("States.TaskFailed"),
+					Cause:  aws.String("capture-01.pcap not found"),
+				}, nil)
+			},
+			expectedStatus:   backend.StatusOK,
+			expectedExecuted: "DescribeExecution of arn:aws:states:us-east-1:123456789012:execution:test-state-machine:test-job-123",
+			expectedCode:     errorCodeExecutionFailed,
+			expectedNotice: &data.Notice{
+				Severity: data.NoticeSeverityError,
+				Text:     "Extraction failed: States.TaskFailed (capture-01.pcap not found)",
+				Link:     consoleLink,
+			},
+		},
+		{
+			name:  "presign failure is a warning",
+			query: map[string]interface{}{"action": "status", "JobId": "test-job-123"},
+			setupSFNMock: func(mockClient *MockSFNClient) {
+				mockClient.On("DescribeExecution", mock.Anything, mock.Anything).Return(&sfn.DescribeExecutionOutput{Status: "SUCCEEDED"}, nil)
+			},
+			setupPresigner: func(mockPresigner *MockS3Presigner) {
+				mockPresigner.On("PresignGetObject", mock.Anything, mock.Anything).Return(nil, errors.New("no credentials"))
+			},
+			expectedStatus:   backend.StatusOK,
+			expectedExecuted: "DescribeExecution of arn:aws:states:us-east-1:123456789012:execution:test-state-machine:test-job-123",
+			expectedCode:     errorCodePresignFailed,
+			expectedNotice: &data.Notice{
+				Severity: data.NoticeSeverityWarning,
+				Text:     "The extraction succeeded, but no download URL could be created: failed to generate presigned URL: no credentials",
+				Link:     consoleLink,
+			},
+		},
+		{
+			name:  "AWS error",
+			query: map[string]interface{}{"action": "status", "JobId": "test-job-123"},
+			setupSFNMock: func(mockClient *MockSFNClient) {
+				mockClient.On("DescribeExecution", mock.Anything, mock.Anything).Return(nil,
+					&retry.MaxAttemptsError{Attempt: 5, Err: apiError("ThrottlingException", "Rate exceeded")})
+			},
+			expectedStatus:   backend.StatusTooManyRequests,
+			expectedExecuted: "DescribeExecution of arn:aws:states:us-east-1:123456789012:execution:test-state-machine:test-job-123",
+			expectedCode:     errorCodeThrottled,
+			expectedAWSCode:  "ThrottlingException",
+			expectedNotice: &data.Notice{
+				Severity: data.NoticeSeverityError,
+				Text:     "Failed to get execution status: AWS is throttling requests, try again shortly (gave up after 5 attempts)",
+				Link:     consoleLink,
+			},
+		},
+		{
+			name:             "missing job ID",
+			query:            map[string]interface{}{"action": "status", "JobId": ""},
+			setupSFNMock:     func(mockClient *MockSFNClient) {},
+			expectedStatus:   backend.StatusBadRequest,
+			expectedExecuted: "",
+			expectedCode:     errorCodeInvalidRequest,
+			expectedNotice: &data.Notice{
+				Severity: data.NoticeSeverityError,
+				Text:     "JobId is required for status action",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockSFNClient := &MockSFNClient{}
+			tt.setupSFNMock(mockSFNClient)
+			mockS3Presigner := &MockS3Presigner{}
+			if tt.setupPresigner != nil {
+				tt.setupPresigner(mockS3Presigner)
+			}
+
+			ds := &Datasource{
+				settings:    authzSettings(),
+				sfnClient:   mockSFNClient,
+				s3Presigner: mockS3Presigner,
+			}
+
+			queryJSON, err := json.Marshal(tt.query)
+			require.NoError(t, err)
+
+			response := ds.query(userContext("admin", "Admin", 1), backend.PluginContext{}, backend.DataQuery{JSON: queryJSON})
+
+			if tt.expectedStatus == backend.StatusOK {
+				assert.NoError(t, response.Error)
+			} else {
+				assert.Equal(t, tt.expectedStatus, response.Status)
+			}
+			require.NotEmpty(t, response.Frames)
+			meta := response.Frames[0].Meta
+			require.NotNil(t, meta)
+			assert.Equal(t, tt.expectedExecuted, meta.ExecutedQueryString)
+
+			if tt.expectedCode == "" {
+				assert.Nil(t, meta.Custom)
+				assert.Empty(t, meta.Notices)
+				return
+			}
+			custom, ok := meta.Custom.(*FrameMetaCustom)
+			require.True(t, ok)
+			assert.Equal(t, tt.expectedCode, custom.ErrorCode)
+			assert.Equal(t, tt.expectedAWSCode, custom.AWSErrorCode)
+			require.Len(t, meta.Notices, 1)
+			assert.Equal(t, *tt.expectedNotice, meta.Notices[0])
+		})
+	}
+}
+
+func TestConsoleURL(t *testing.T) {
+	ds := &Datasource{settings: authzSettings()}
+
+	assert.Equal(t, consoleLink, ds.consoleURL("test-job-123"))
+	assert.Equal(t, "", ds.consoleURL(""))
+	assert.Equal(t, "", (&Datasource{}).consoleURL("test-job-123"))
+}
@@ -0,0 +1,194 @@
+package plugin
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	sfntypes "github.com/aws/aws-sdk-go-v2/service/sfn/types"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// maxHistoryPages bounds how many pages of 1000 events are read for the
+// history of a single execution.
+const maxHistoryPages = 10
+
+// handleHistoryAction returns the events of the execution of a job as one row
+// per event, for state timeline and table panels.
+func (d *Datasource) handleHistoryAction(ctx context.Context, qm queryModel) backend.DataResponse {
+	var response backend.DataResponse
+
+	if qm.JobId == "" {
+		return backend.ErrDataResponse(backend.StatusBadRequest, "JobId is required for history action")
+	}
+
+	d.log(ctx).Info("Processing history action")
+
+	meta, err := d.loadJob(ctx, qm.JobId)
+	if err != nil {
+		return loadJobResponse(err)
+	}
+
+	view, jobId, err := d.jobTarget(qm.JobId, meta)
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, err.Error())
+	}
+	executionArn, err := view.executionArn(jobId)
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, err.Error())
+	}
+	recordJobExecution(ctx, executionArn)
+
+	events, err := view.executionHistory(ctx, executionArn)
+	if err != nil {
+		d.log(ctx).Error("Failed to get Step Function execution history", "error", err)
+		return awsErrorResponse(backend.StatusBadGateway, "Failed to get execution history", err)
+	}
+
+	response.Frames = append(response.Frames, historyFrame(events))
+	return response
+}
+
+// executionHistory returns the events of an execution in chronological order.
+func (d *Datasource) executionHistory(ctx context.Context, executionArn string) ([]sfntypes.HistoryEvent, error) {
+	var events []sfntypes.HistoryEvent
+	paginator := sfn.NewGetExecutionHistoryPaginator(d.sfnClient, &sfn.GetExecutionHistoryInput{
+		ExecutionArn:         aws.String(executionArn),
+		IncludeExecutionData: aws.Bool(false),
+		MaxResults:           1000,
+	})
+	for pages := 0; paginator.HasMorePages() && pages < maxHistoryPages; pages++ {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, page.Events...)
+	}
+	return events, nil
+}
+
+// historyFrame turns execution events into a frame. Events inside a state
+// carry the name of that state. The duration of an event is the time since
+// the event it completes: the entry of the state for a state exit, the start
+// of the execution for its end, and the preceding event otherwise.
+func historyFrame(events []sfntypes.HistoryEvent) *data.Frame {
+	var (
+		timestamps                            []time.Time
+		ids                                   []int64
+		types, stateNames, errorTexts, causes []string
+		durations                             []*float64
+		executionStarted                      *time.Time
+	)
+	eventTimes := map[int64]time.Time{}
+	eventStates := map[int64]string{}
+	stateEntered := map[string]time.Time{}
+
+	for _, event := range events {
+		timestamp := aws.ToTime(event.Timestamp)
+		eventTimes[event.Id] = timestamp
+
+		var since *time.Time
+		stateName := ""
+		switch {
+		case event.StateEnteredEventDetails != nil:
+			stateName = aws.ToString(event.StateEnteredEventDetails.Name)
+			stateEntered[stateName] = timestamp
+		case event.StateExitedEventDetails != nil:
+			stateName = aws.ToString(event.StateExitedEventDetails.Name)
+			if entered, ok := stateEntered[stateName]; ok {
+				since = &entered
+			}
+		case event.Type == sfntypes.HistoryEventTypeExecutionStarted:
+			executionStarted = &timestamp
+		case isExecutionEnd(event.Type):
+			since = executionStarted
+		default:
+			stateName = eventStates[event.PreviousEventId]
+			if previous, ok := eventTimes[event.PreviousEventId]; ok {
+				since = &previous
+			}
+		}
+		// Events following a state exit are outside of that state
+		if event.StateExitedEventDetails == nil {
+			eventStates[event.Id] = stateName
+		}
+
+		var duration *float64
+		if since != nil {
+			seconds := timestamp.Sub(*since).Seconds()
+			duration = &seconds
+		}
+		errorText, cause := eventError(event)
+
+		timestamps = append(timestamps, timestamp)
+		ids = append(ids, event.Id)
+		types = append(types, string(event.Type))
+		stateNames = append(stateNames, stateName)
+		durations = append(durations, duration)
+		errorTexts = append(errorTexts, errorText)
+		causes = append(causes, cause)
+	}
+
+	frame := data.NewFrame("step_function_history",
+		data.NewField("time", nil, timestamps),
+		data.NewField("event_id", nil, ids),
+		data.NewField("type", nil, types),
+		data.NewField("state", nil, stateNames),
+		data.NewField("duration", nil, durations).SetConfig(&data.FieldConfig{Unit: "s"}),
+		data.NewField("error", nil, errorTexts),
+		data.NewField("cause", nil, causes),
+	)
+	return frame
+}
+
+func isExecutionEnd(eventType sfntypes.HistoryEventType) bool {
+	switch eventType {
+	case sfntypes.HistoryEventTypeExecutionSucceeded,
+		sfntypes.HistoryEventTypeExecutionFailed,
+		sfntypes.HistoryEventTypeExecutionAborted,
+		sfntypes.HistoryEventTypeExecutionTimedOut:
+		return true
+	}
+	return false
+}
+
+// eventError returns the error and cause of a failure event.
+func eventError(event sfntypes.HistoryEvent) (string, string) {
+	switch {
+	case event.ExecutionFailedEventDetails != nil:
+		return aws.ToString(event.ExecutionFailedEventDetails.Error), aws.ToString(event.ExecutionFailedEventDetails.Cause)
+	case event.ExecutionAbortedEventDetails != nil:
+		return aws.ToString(event.ExecutionAbortedEventDetails.Error), aws.ToString(event.ExecutionAbortedEventDetails.Cause)
+	case event.ExecutionTimedOutEventDetails != nil:
+		return aws.ToString(event.ExecutionTimedOutEventDetails.Error), aws.ToString(event.ExecutionTimedOutEventDetails.Cause)
+	case event.TaskFailedEventDetails != nil:
+		return aws.ToString(event.TaskFailedEventDetails.Error), aws.ToString(event.TaskFailedEventDetails.Cause)
+	case event.TaskTimedOutEventDetails != nil:
+		return aws.ToString(event.TaskTimedOutEventDetails.Error), aws.ToString(event.TaskTimedOutEventDetails.Cause)
+	case event.TaskStartFailedEventDetails != nil:
+		return aws.ToString(event.TaskStartFailedEventDetails.Error), aws.ToString(event.TaskStartFailedEventDetails.Cause)
+	case event.TaskSubmitFailedEventDetails != nil:
+		return aws.ToString(event.TaskSubmitFailedEventDetails.Error), aws.ToString(event.TaskSubmitFailedEventDetails.Cause)
+	case event.LambdaFunctionFailedEventDetails != nil:
+		return aws.ToString(event.LambdaFunctionFailedEventDetails.Error), aws.ToString(event.LambdaFunctionFailedEventDetails.Cause)
+	case event.LambdaFunctionTimedOutEventDetails != nil:
+		return aws.ToString(event.LambdaFunctionTimedOutEventDetails.Error), aws.ToString(event.LambdaFunctionTimedOutEventDetails.Cause)
+	case event.LambdaFunctionStartFailedEventDetails != nil:
+		return aws.ToString(event.LambdaFunctionStartFailedEventDetails.Error), aws.ToString(event.LambdaFunctionStartFailedEventDetails.Cause)
+	case event.LambdaFunctionScheduleFailedEventDetails != nil:
+		return aws.ToString(event.LambdaFunctionScheduleFailedEventDetails.Error), aws.ToString(event.LambdaFunctionScheduleFailedEventDetails.Cause)
+	case event.ActivityFailedEventDetails != nil:
+		return aws.ToString(event.ActivityFailedEventDetails.Error), aws.ToString(event.ActivityFailedEventDetails.Cause)
+	case event.ActivityTimedOutEventDetails != nil:
+		return aws.ToString(event.ActivityTimedOutEventDetails.Error), aws.ToString(event.ActivityTimedOutEventDetails.Cause)
+	case event.ActivityScheduleFailedEventDetails != nil:
+		return aws.ToString(event.ActivityScheduleFailedEventDetails.Error), aws.ToString(event.ActivityScheduleFailedEventDetails.Cause)
+	case event.MapRunFailedEventDetails != nil:
+		return aws.ToString(event.MapRunFailedEventDetails.Error), aws.ToString(event.MapRunFailedEventDetails.Cause)
+	case event.EvaluationFailedEventDetails != nil:
+		return aws.ToString(event.EvaluationFailedEventDetails.Error), aws.ToString(event.EvaluationFailedEventDetails.Cause)
+	}
+	return "", ""
+}
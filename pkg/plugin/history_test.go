@@ -0,0 +1,110 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	sfntypes "github.com/aws/aws-sdk-go-v2/service/sfn/types"
+	"github.com/emnify/pcap-extractor/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleHistoryAction(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(seconds int) *time.Time {
+		timestamp := start.Add(time.Duration(seconds) * time.Second)
+		return &timestamp
+	}
+
+	mockSFNClient := &MockSFNClient{}
+	mockSFNClient.On("GetExecutionHistory", mock.Anything, mock.MatchedBy(func(input *sfn.GetExecutionHistoryInput) bool {
+		return *input.ExecutionArn == "arn:aws:states:us-east-1:123456789012:execution:test-state-machine:job-1" && input.NextToken == nil
+	})).Return(&sfn.GetExecutionHistoryOutput{
+		Events: []sfntypes.HistoryEvent{
+			{Id: 1, Timestamp: at(0), Type: sfntypes.HistoryEventTypeExecutionStarted},
+			{Id: 2, PreviousEventId: 1, Timestamp: at(1), Type: sfntypes.HistoryEventTypeTaskStateEntered,
+				StateEnteredEventDetails: &sfntypes.StateEnteredEventDetails{Name: aws.String("ExtractPackets")}},
+			{Id: 3, PreviousEventId: 2, Timestamp: at(2), Type: sfntypes.HistoryEventTypeLambdaFunctionScheduled},
+		},
+		NextToken: aws.String("page-2"),
+	}, nil).Once()
+	mockSFNClient.On("GetExecutionHistory", mock.Anything, mock.MatchedBy(func(input *sfn.GetExecutionHistoryInput) bool {
+		return input.NextToken != nil && *input.NextToken == "page-2"
+	})).Return(&sfn.GetExecutionHistoryOutput{
+		Events: []sfntypes.HistoryEvent{
+			{Id: 4, PreviousEventId: 3, Timestamp: at(62), Type: sfntypes.HistoryEventTypeLambdaFunctionTimedOut,
+				LambdaFunctionTimedOutEventDetails: &sfntypes.LambdaFunctionTimedOutEventDetails{
+					Error: aws.String("States.Timeout"),
+					Cause: aws.String("Lambda timed out reading capture-01.pcap"),
+				}},
+			{Id: 5, PreviousEventId: 4, Timestamp: at(63), Type: sfntypes.HistoryEventTypeTaskStateExited,
+				StateExitedEventDetails: &sfntypes.StateExitedEventDetails{Name: aws.String("ExtractPackets")}},
+			{Id: 6, PreviousEventId: 5, Timestamp: at(64), Type: sfntypes.HistoryEventTypeExecutionFailed,
+				ExecutionFailedEventDetails: &sfntypes.ExecutionFailedEventDetails{
+					Error: aws.String("States.Timeout"),
+				}},
+		},
+	}, nil).Once()
+
+	ds := &Datasource{
+		settings: &models.PluginSettings{
+			StepFunctionArn: "arn:aws:states:us-east-1:123456789012:stateMachine:test-state-machine",
+			S3Bucket:        "test-bucket",
+		},
+		sfnClient: mockSFNClient,
+	}
+
+	response := ds.handleHistoryAction(userContext("admin", "Admin", 1), queryModel{Action: "history", JobId: "job-1"})
+	require.NoError(t, response.Error)
+	require.Len(t, response.Frames, 1)
+
+	frame := response.Frames[0]
+	assert.Equal(t, "step_function_history", frame.Name)
+	require.Equal(t, 6, frame.Rows())
+
+	field := func(name string) func(int) interface{} {
+		f, _ := frame.FieldByName(name)
+		require.NotNil(t, f, name)
+		return f.At
+	}
+	duration := func(i int) interface{} {
+		if d := field("duration")(i).(*float64); d != nil {
+			return *d
+		}
+		return nil
+	}
+
+	assert.Equal(t, *at(0), field("time")(0))
+	assert.Equal(t, "ExecutionStarted", field("type")(0))
+	assert.Equal(t, nil, duration(0))
+
+	assert.Equal(t, "ExtractPackets", field("state")(2))
+
+	assert.Equal(t, "ExtractPackets", field("state")(3))
+	assert.Equal(t, 60.0, duration(3))
+	assert.Equal(t, "States.Timeout", field("error")(3))
+	assert.Equal(t, "Lambda timed out reading capture-01.pcap", field("cause")(3))
+
+	assert.Equal(t, "ExtractPackets", field("state")(4))
+	assert.Equal(t, 62.0, duration(4))
+
+	assert.Equal(t, "", field("state")(5))
+	assert.Equal(t, 64.0, duration(5))
+	assert.Equal(t, "States.Timeout", field("error")(5))
+
+	mockSFNClient.AssertExpectations(t)
+}
+
+func TestHandleHistoryActionRequiresJobId(t *testing.T) {
+	ds := &Datasource{settings: &models.PluginSettings{}}
+
+	response := ds.handleHistoryAction(context.Background(), queryModel{Action: "history"})
+	require.Error(t, response.Error)
+	assert.Equal(t, backend.StatusBadRequest, response.Status)
+}
@@ -0,0 +1,223 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The collectors are registered with the default registry, which the plugin
+// SDK exposes through Grafana's plugin metrics endpoint. Labels are limited
+// to actions, outcomes, operations and error codes, never job IDs.
+var (
+	queriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pcap_extractor",
+		Name:      "queries_total",
+		Help:      "Queries by action and outcome, the outcome is success or the error code.",
+	}, []string{"action", "outcome"})
+
+	awsRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "pcap_extractor",
+		Name:      "aws_request_duration_seconds",
+		Help:      "Duration of AWS calls including retries, by service and operation.",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"service", "operation"})
+
+	awsErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pcap_extractor",
+		Name:      "aws_errors_total",
+		Help:      "Failed AWS calls by service, operation and AWS error code.",
+	}, []string{"service", "operation", "code"})
+
+	trackedJobs = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "pcap_extractor",
+		Name:      "tracked_jobs",
+		Help:      "Jobs currently counted as running against the quotas.",
+	})
+)
+
+// queryActions are the actions counted under their own name, others are
+// counted as unknown.
+var queryActions = []string{"request", "status", "history", "retry", "variables", "metrics"}
+
+// observeQuery counts a finished query.
+func observeQuery(action string, response backend.DataResponse) {
+	if !slices.Contains(queryActions, action) {
+		action = "unknown"
+	}
+	outcome := "success"
+	if response.Error != nil {
+		outcome = errorCodeInternal
+		if len(response.Frames) > 0 && response.Frames[0].Meta != nil {
+			if custom, ok := response.Frames[0].Meta.Custom.(*FrameMetaCustom); ok && custom.ErrorCode != "" {
+				outcome = custom.ErrorCode
+			}
+		}
+	}
+	queriesTotal.WithLabelValues(action, outcome).Inc()
+}
+
+// queryAction returns the action of a query that was not run.
+func queryAction(query backend.DataQuery) string {
+	var qm struct {
+		Action string `json:"action"`
+	}
+	_ = json.Unmarshal(query.JSON, &qm)
+	return qm.Action
+}
+
+// instrument runs an AWS call in a client span and records its metrics. The
+// span carries the AWS request ID, taken from the metadata of the result or
+// from the error.
+func instrument[T any](ctx context.Context, service, operation string, call func(context.Context) (T, error), metadata func(T) middleware.Metadata) (out T, err error) {
+	ctx, span := tracing.DefaultTracer().Start(ctx, service+"."+operation, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("rpc.system", "aws-api"),
+		attribute.String("rpc.service", service),
+		attribute.String("rpc.method", operation),
+	))
+	defer span.End()
+	defer observeAWSCall(service, operation, time.Now(), &err)
+
+	out, err = call(ctx)
+	if err != nil {
+		var responseErr *awshttp.ResponseError
+		if errors.As(err, &responseErr) && responseErr.ServiceRequestID() != "" {
+			span.SetAttributes(attribute.String("aws.request_id", responseErr.ServiceRequestID()))
+		}
+		if code := classifyAWSError(err).code; code != "" {
+			span.SetAttributes(attribute.String("aws.error_code", code))
+		}
+		_ = tracing.Error(span, err)
+		return out, err
+	}
+	if metadata != nil {
+		if requestID, ok := awsmiddleware.GetRequestIDMetadata(metadata(out)); ok {
+			span.SetAttributes(attribute.String("aws.request_id", requestID))
+		}
+	}
+	return out, nil
+}
+
+// observeAWSCall records the duration of an AWS call that started at start
+// and, if *err is set, its error code.
+func observeAWSCall(service, operation string, start time.Time, err *error) {
+	awsRequestDuration.WithLabelValues(service, operation).Observe(time.Since(start).Seconds())
+	if *err == nil {
+		return
+	}
+	code := classifyAWSError(*err).code
+	if code == "" {
+		code = "unknown"
+	}
+	awsErrorsTotal.WithLabelValues(service, operation, code).Inc()
+}
+
+// instrumentedSFNClient records metrics and traces of all Step Functions
+// calls.
+type instrumentedSFNClient struct {
+	client SFNClientInterface
+}
+
+func (c *instrumentedSFNClient) StartExecution(ctx context.Context, params *sfn.StartExecutionInput, optFns ...func(*sfn.Options)) (*sfn.StartExecutionOutput, error) {
+	return instrument(ctx, "sfn", "StartExecution", func(ctx context.Context) (*sfn.StartExecutionOutput, error) {
+		return c.client.StartExecution(ctx, params, optFns...)
+	}, func(out *sfn.StartExecutionOutput) middleware.Metadata { return out.ResultMetadata })
+}
+
+func (c *instrumentedSFNClient) DescribeExecution(ctx context.Context, params *sfn.DescribeExecutionInput, optFns ...func(*sfn.Options)) (*sfn.DescribeExecutionOutput, error) {
+	return instrument(ctx, "sfn", "DescribeExecution", func(ctx context.Context) (*sfn.DescribeExecutionOutput, error) {
+		return c.client.DescribeExecution(ctx, params, optFns...)
+	}, func(out *sfn.DescribeExecutionOutput) middleware.Metadata { return out.ResultMetadata })
+}
+
+func (c *instrumentedSFNClient) DescribeStateMachine(ctx context.Context, params *sfn.DescribeStateMachineInput, optFns ...func(*sfn.Options)) (*sfn.DescribeStateMachineOutput, error) {
+	return instrument(ctx, "sfn", "DescribeStateMachine", func(ctx context.Context) (*sfn.DescribeStateMachineOutput, error) {
+		return c.client.DescribeStateMachine(ctx, params, optFns...)
+	}, func(out *sfn.DescribeStateMachineOutput) middleware.Metadata { return out.ResultMetadata })
+}
+
+func (c *instrumentedSFNClient) ListExecutions(ctx context.Context, params *sfn.ListExecutionsInput, optFns ...func(*sfn.Options)) (*sfn.ListExecutionsOutput, error) {
+	return instrument(ctx, "sfn", "ListExecutions", func(ctx context.Context) (*sfn.ListExecutionsOutput, error) {
+		return c.client.ListExecutions(ctx, params, optFns...)
+	}, func(out *sfn.ListExecutionsOutput) middleware.Metadata { return out.ResultMetadata })
+}
+
+func (c *instrumentedSFNClient) GetExecutionHistory(ctx context.Context, params *sfn.GetExecutionHistoryInput, optFns ...func(*sfn.Options)) (*sfn.GetExecutionHistoryOutput, error) {
+	return instrument(ctx, "sfn", "GetExecutionHistory", func(ctx context.Context) (*sfn.GetExecutionHistoryOutput, error) {
+		return c.client.GetExecutionHistory(ctx, params, optFns...)
+	}, func(out *sfn.GetExecutionHistoryOutput) middleware.Metadata { return out.ResultMetadata })
+}
+
+func (c *instrumentedSFNClient) RedriveExecution(ctx context.Context, params *sfn.RedriveExecutionInput, optFns ...func(*sfn.Options)) (*sfn.RedriveExecutionOutput, error) {
+	return instrument(ctx, "sfn", "RedriveExecution", func(ctx context.Context) (*sfn.RedriveExecutionOutput, error) {
+		return c.client.RedriveExecution(ctx, params, optFns...)
+	}, func(out *sfn.RedriveExecutionOutput) middleware.Metadata { return out.ResultMetadata })
+}
+
+func (c *instrumentedSFNClient) StopExecution(ctx context.Context, params *sfn.StopExecutionInput, optFns ...func(*sfn.Options)) (*sfn.StopExecutionOutput, error) {
+	return instrument(ctx, "sfn", "StopExecution", func(ctx context.Context) (*sfn.StopExecutionOutput, error) {
+		return c.client.StopExecution(ctx, params, optFns...)
+	}, func(out *sfn.StopExecutionOutput) middleware.Metadata { return out.ResultMetadata })
+}
+
+// instrumentedS3Client records metrics and traces of all S3 calls.
+type instrumentedS3Client struct {
+	client S3ClientInterface
+}
+
+func (c *instrumentedS3Client) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	return instrument(ctx, "s3", "GetObject", func(ctx context.Context) (*s3.GetObjectOutput, error) {
+		return c.client.GetObject(ctx, params, optFns...)
+	}, func(out *s3.GetObjectOutput) middleware.Metadata { return out.ResultMetadata })
+}
+
+func (c *instrumentedS3Client) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	return instrument(ctx, "s3", "HeadObject", func(ctx context.Context) (*s3.HeadObjectOutput, error) {
+		return c.client.HeadObject(ctx, params, optFns...)
+	}, func(out *s3.HeadObjectOutput) middleware.Metadata { return out.ResultMetadata })
+}
+
+func (c *instrumentedS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	return instrument(ctx, "s3", "PutObject", func(ctx context.Context) (*s3.PutObjectOutput, error) {
+		return c.client.PutObject(ctx, params, optFns...)
+	}, func(out *s3.PutObjectOutput) middleware.Metadata { return out.ResultMetadata })
+}
+
+func (c *instrumentedS3Client) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	return instrument(ctx, "s3", "ListObjectsV2", func(ctx context.Context) (*s3.ListObjectsV2Output, error) {
+		return c.client.ListObjectsV2(ctx, params, optFns...)
+	}, func(out *s3.ListObjectsV2Output) middleware.Metadata { return out.ResultMetadata })
+}
+
+func (c *instrumentedS3Client) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	return instrument(ctx, "s3", "DeleteObject", func(ctx context.Context) (*s3.DeleteObjectOutput, error) {
+		return c.client.DeleteObject(ctx, params, optFns...)
+	}, func(out *s3.DeleteObjectOutput) middleware.Metadata { return out.ResultMetadata })
+}
+
+// instrumentedS3Presigner records metrics and traces of presigning download
+// URLs.
+type instrumentedS3Presigner struct {
+	presigner S3PresignerInterface
+}
+
+func (p *instrumentedS3Presigner) PresignGetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error) {
+	return instrument(ctx, "s3", "PresignGetObject", func(ctx context.Context) (*v4.PresignedHTTPRequest, error) {
+		return p.presigner.PresignGetObject(ctx, params, optFns...)
+	}, nil)
+}
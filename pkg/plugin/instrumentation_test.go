@@ -0,0 +1,82 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	"github.com/emnify/pcap-extractor/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserveQuery(t *testing.T) {
+	mockSFNClient := &MockSFNClient{}
+	mockSFNClient.On("DescribeExecution", mock.Anything, mock.Anything).Return(&sfn.DescribeExecutionOutput{Status: "RUNNING"}, nil)
+	ds := &Datasource{settings: authzSettings(), sfnClient: mockSFNClient}
+
+	run := func(ctx context.Context, query map[string]interface{}) {
+		queryJSON, err := json.Marshal(query)
+		require.NoError(t, err)
+		ds.query(ctx, backend.PluginContext{}, backend.DataQuery{JSON: queryJSON})
+	}
+
+	succeeded := testutil.ToFloat64(queriesTotal.WithLabelValues("status", "success"))
+	denied := testutil.ToFloat64(queriesTotal.WithLabelValues("request", errorCodeForbidden))
+	unknown := testutil.ToFloat64(queriesTotal.WithLabelValues("unknown", errorCodeInvalidRequest))
+
+	run(userContext("jdoe", "Viewer", 1), map[string]interface{}{"action": "status", "JobId": "test-job-123"})
+	run(userContext("jdoe", "Viewer", 1), map[string]interface{}{"action": "request", "JobId": "test-job-123"})
+	run(userContext("jdoe", "Viewer", 1), map[string]interface{}{"action": "drop table jobs"})
+
+	assert.Equal(t, succeeded+1, testutil.ToFloat64(queriesTotal.WithLabelValues("status", "success")))
+	assert.Equal(t, denied+1, testutil.ToFloat64(queriesTotal.WithLabelValues("request", errorCodeForbidden)))
+	assert.Equal(t, unknown+1, testutil.ToFloat64(queriesTotal.WithLabelValues("unknown", errorCodeInvalidRequest)))
+}
+
+func TestInstrumentedSFNClient(t *testing.T) {
+	mockSFNClient := &MockSFNClient{}
+	mockSFNClient.On("StartExecution", mock.Anything, mock.Anything).Return(nil, apiError("ExecutionAlreadyExists", "Execution Already Exists")).Once()
+	mockSFNClient.On("StartExecution", mock.Anything, mock.Anything).Return(nil, errors.New("connection reset")).Once()
+	client := &instrumentedSFNClient{client: mockSFNClient}
+
+	calls := func() uint64 {
+		var metric dto.Metric
+		require.NoError(t, awsRequestDuration.WithLabelValues("sfn", "StartExecution").(prometheus.Histogram).Write(&metric))
+		return metric.GetHistogram().GetSampleCount()
+	}
+	before := calls()
+	exists := testutil.ToFloat64(awsErrorsTotal.WithLabelValues("sfn", "StartExecution", "ExecutionAlreadyExists"))
+	unknown := testutil.ToFloat64(awsErrorsTotal.WithLabelValues("sfn", "StartExecution", "unknown"))
+
+	_, err := client.StartExecution(context.Background(), &sfn.StartExecutionInput{})
+	assert.Error(t, err)
+	_, err = client.StartExecution(context.Background(), &sfn.StartExecutionInput{})
+	assert.Error(t, err)
+
+	assert.Equal(t, exists+1, testutil.ToFloat64(awsErrorsTotal.WithLabelValues("sfn", "StartExecution", "ExecutionAlreadyExists")))
+	assert.Equal(t, unknown+1, testutil.ToFloat64(awsErrorsTotal.WithLabelValues("sfn", "StartExecution", "unknown")))
+	assert.Equal(t, before+2, calls())
+}
+
+func TestTrackedJobsGauge(t *testing.T) {
+	before := testutil.ToFloat64(trackedJobs)
+	quota := newQuotaTracker(&models.PluginSettings{})
+
+	require.Nil(t, quota.reserve("job-1", jobOwner{Login: "jdoe"}, 1, 1))
+	require.Nil(t, quota.reserve("job-2", jobOwner{Login: "jdoe"}, 1, 1))
+	assert.Equal(t, before+2, testutil.ToFloat64(trackedJobs))
+
+	quota.finish("job-1")
+	assert.Equal(t, before+1, testutil.ToFloat64(trackedJobs))
+
+	quota.close()
+	assert.Equal(t, before, testutil.ToFloat64(trackedJobs))
+}
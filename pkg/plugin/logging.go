@@ -0,0 +1,141 @@
+package plugin
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/emnify/pcap-extractor/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// urlQueryPattern matches the query string of URLs, which holds the
+// credentials of presigned URLs.
+var urlQueryPattern = regexp.MustCompile(`(https?://[^\s?#"']+)\?[^\s"']*`)
+
+// datasourceLogger drops messages below the log level of the data source and
+// redacts URL query strings from all string and error values.
+type datasourceLogger struct {
+	logger log.Logger
+	level  log.Level
+}
+
+// newLogger returns the logger of a data source with the given log level.
+func newLogger(logger log.Logger, level string) log.Logger {
+	return &datasourceLogger{logger: logger, level: parseLogLevel(level)}
+}
+
+func parseLogLevel(level string) log.Level {
+	switch level {
+	case models.LogLevelDebug:
+		return log.Debug
+	case models.LogLevelWarn:
+		return log.Warn
+	case models.LogLevelError:
+		return log.Error
+	default:
+		return log.Info
+	}
+}
+
+func (l *datasourceLogger) Debug(msg string, args ...interface{}) {
+	if l.level <= log.Debug {
+		l.logger.Debug(msg, redactArgs(args)...)
+	}
+}
+
+func (l *datasourceLogger) Info(msg string, args ...interface{}) {
+	if l.level <= log.Info {
+		l.logger.Info(msg, redactArgs(args)...)
+	}
+}
+
+func (l *datasourceLogger) Warn(msg string, args ...interface{}) {
+	if l.level <= log.Warn {
+		l.logger.Warn(msg, redactArgs(args)...)
+	}
+}
+
+func (l *datasourceLogger) Error(msg string, args ...interface{}) {
+	l.logger.Error(msg, redactArgs(args)...)
+}
+
+func (l *datasourceLogger) With(args ...interface{}) log.Logger {
+	return &datasourceLogger{logger: l.logger.With(redactArgs(args)...), level: l.level}
+}
+
+func (l *datasourceLogger) Level() log.Level {
+	return max(l.level, l.logger.Level())
+}
+
+func (l *datasourceLogger) FromContext(ctx context.Context) log.Logger {
+	return &datasourceLogger{logger: l.logger.FromContext(ctx), level: l.level}
+}
+
+// log returns the logger of the data source carrying the job ID and user of
+// ctx.
+func (d *Datasource) log(ctx context.Context) log.Logger {
+	if d.logger == nil {
+		return backend.Logger.FromContext(ctx)
+	}
+	return d.logger.FromContext(ctx)
+}
+
+// withLogUser adds the login of the user of ctx to all log lines of ctx.
+func withLogUser(ctx context.Context) context.Context {
+	if user := backend.UserFromContext(ctx); user != nil {
+		return log.WithContextualAttributes(ctx, []any{"user", user.Login})
+	}
+	return ctx
+}
+
+// withLogJob adds a job ID to all log lines of ctx.
+func withLogJob(ctx context.Context, jobId string) context.Context {
+	if jobId == "" {
+		return ctx
+	}
+	return log.WithContextualAttributes(ctx, []any{"jobId", jobId})
+}
+
+func redactArgs(args []interface{}) []interface{} {
+	redacted := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			redacted[i] = redact(v)
+		case error:
+			redacted[i] = redact(v.Error())
+		default:
+			redacted[i] = arg
+		}
+	}
+	return redacted
+}
+
+// redact removes the query strings of URLs from s, so that no presigned URL
+// ends up in the logs.
+func redact(s string) string {
+	return urlQueryPattern.ReplaceAllString(s, "$1?REDACTED")
+}
+
+// extractSummary describes an extract by its size and the hash also
+// recorded in the job metadata, in place of the list of packets which can be
+// megabytes long.
+type extractSummary struct {
+	Files   int
+	Packets int
+	Hash    string
+}
+
+func summarizeExtract(extract map[string][]int) extractSummary {
+	summary := extractSummary{Files: len(extract), Hash: extractHash(extract)}
+	for _, packets := range extract {
+		summary.Packets += len(packets)
+	}
+	return summary
+}
+
+// logArgs returns the summary as key value pairs for a log line.
+func (s extractSummary) logArgs() []interface{} {
+	return []interface{}{"files", s.Files, "packets", s.Packets, "extractHash", s.Hash}
+}
@@ -0,0 +1,139 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	"github.com/emnify/pcap-extractor/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingLogger records log lines as text, including the contextual
+// attributes of the context it was taken from.
+type recordingLogger struct {
+	mu    *sync.Mutex
+	lines *[]string
+	args  []interface{}
+}
+
+func newRecordingLogger() *recordingLogger {
+	return &recordingLogger{mu: &sync.Mutex{}, lines: &[]string{}}
+}
+
+func (l *recordingLogger) record(level, msg string, args []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	*l.lines = append(*l.lines, fmt.Sprintf("%s %s %v", level, msg, append(append([]interface{}{}, l.args...), args...)))
+}
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) { l.record("debug", msg, args) }
+func (l *recordingLogger) Info(msg string, args ...interface{})  { l.record("info", msg, args) }
+func (l *recordingLogger) Warn(msg string, args ...interface{})  { l.record("warn", msg, args) }
+func (l *recordingLogger) Error(msg string, args ...interface{}) { l.record("error", msg, args) }
+func (l *recordingLogger) Level() log.Level                      { return log.Debug }
+
+func (l *recordingLogger) With(args ...interface{}) log.Logger {
+	return &recordingLogger{mu: l.mu, lines: l.lines, args: append(append([]interface{}{}, l.args...), args...)}
+}
+
+func (l *recordingLogger) FromContext(ctx context.Context) log.Logger {
+	return l.With(log.ContextualAttributesFromContext(ctx)...)
+}
+
+func (l *recordingLogger) text() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(*l.lines, "\n")
+}
+
+func TestLogLevel(t *testing.T) {
+	recorder := newRecordingLogger()
+	logger := newLogger(recorder, models.LogLevelWarn)
+
+	logger.Debug("Debug line")
+	logger.Info("Info line")
+	logger.Warn("Warn line")
+	logger.Error("Error line")
+
+	assert.Equal(t, "warn Warn line []\nerror Error line []", recorder.text())
+	assert.Equal(t, log.Warn, logger.Level())
+}
+
+func TestLoggerRedactsURLs(t *testing.T) {
+	recorder := newRecordingLogger()
+	logger := newLogger(recorder, models.LogLevelDebug)
+
+	url := "https://test-bucket.s3.amazonaws.com/results/job.pcap?X-Amz-Credential=AKIA&X-Amz-Signature=abcdef"
+	logger.Info("Issued URL", "url", url, "error", errors.New("failed to fetch "+url+": timeout"), "count", 3)
+
+	text := recorder.text()
+	assert.NotContains(t, text, "X-Amz-Signature")
+	assert.NotContains(t, text, "AKIA")
+	assert.Contains(t, text, "https://test-bucket.s3.amazonaws.com/results/job.pcap?REDACTED timeout")
+	assert.Contains(t, text, "count 3")
+}
+
+func TestSummarizeExtract(t *testing.T) {
+	summary := summarizeExtract(map[string][]int{"a.pcap": {1, 2, 3}, "b.pcap": {7}})
+	assert.Equal(t, 2, summary.Files)
+	assert.Equal(t, 4, summary.Packets)
+	assert.Equal(t, extractHash(map[string][]int{"a.pcap": {1, 2, 3}, "b.pcap": {7}}), summary.Hash)
+
+	// Equal extracts hash equally, different ones do not
+	assert.Equal(t, summary.Hash, summarizeExtract(map[string][]int{"b.pcap": {7}, "a.pcap": {1, 2, 3}}).Hash)
+	assert.NotEqual(t, summary.Hash, summarizeExtract(map[string][]int{"a.pcap": {1, 2, 3}, "b.pcap": {8}}).Hash)
+}
+
+func TestQueryLogging(t *testing.T) {
+	recorder := newRecordingLogger()
+
+	mockSFNClient := &MockSFNClient{}
+	mockSFNClient.On("StartExecution", mock.Anything, mock.Anything).Return(&sfn.StartExecutionOutput{
+		ExecutionArn: aws.String("arn:aws:states:us-east-1:123456789012:execution:test-state-machine:test-job-123"),
+	}, nil)
+	mockSFNClient.On("DescribeExecution", mock.Anything, mock.Anything).Return(&sfn.DescribeExecutionOutput{Status: "SUCCEEDED"}, nil)
+	mockPresigner := &MockS3Presigner{}
+	mockPresigner.On("PresignGetObject", mock.Anything, mock.Anything).Return(&v4.PresignedHTTPRequest{
+		URL: "https://test-bucket.s3.amazonaws.com/results/test-job-123.pcap?X-Amz-Signature=abcdef",
+	}, nil)
+	ds := &Datasource{
+		settings:    authzSettings(),
+		sfnClient:   mockSFNClient,
+		s3Presigner: mockPresigner,
+		logger:      newLogger(recorder, models.LogLevelDebug),
+	}
+
+	run := func(query map[string]interface{}) {
+		queryJSON, err := json.Marshal(query)
+		require.NoError(t, err)
+		resp, err := ds.QueryData(userContext("jdoe", "Admin", 1), &backend.QueryDataRequest{
+			Queries: []backend.DataQuery{{RefID: "A", JSON: queryJSON}},
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.Responses["A"].Error)
+	}
+	run(map[string]interface{}{
+		"action":  "request",
+		"JobId":   "test-job-123",
+		"Extract": map[string][]int{"file-with-secret-name.pcap": {1, 2, 3}},
+	})
+	run(map[string]interface{}{"action": "status", "JobId": "test-job-123"})
+
+	text := recorder.text()
+	assert.Contains(t, text, "info Processing request action [user jdoe jobId test-job-123 files 1 packets 3 extractHash ")
+	assert.Contains(t, text, "info Processing status action [user jdoe jobId test-job-123]")
+	assert.NotContains(t, text, "file-with-secret-name.pcap")
+	assert.NotContains(t, text, "X-Amz-Signature")
+}
@@ -0,0 +1,242 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// JobMetadata is the record of an extraction job that is stored next to the
+// extracted capture as {jobId}.meta.json. It answers who requested the job,
+// when, from where and for what.
+type JobMetadata struct {
+	JobId         string           `json:"jobId"`
+	CreatedAt     time.Time        `json:"createdAt"`
+	User          *JobUser         `json:"user,omitempty"`
+	OrgId         int64            `json:"orgId,omitempty"`
+	DatasourceUID string           `json:"datasourceUID,omitempty"`
+	From          *time.Time       `json:"from,omitempty"`
+	To            *time.Time       `json:"to,omitempty"`
+	Query         string           `json:"query,omitempty"`
+	DashboardUID  string           `json:"dashboardUID,omitempty"`
+	PanelId       int64            `json:"panelId,omitempty"`
+	Files         int              `json:"files"`
+	Packets       int              `json:"packets"`
+	Extract       map[string][]int `json:"extract,omitempty"`
+	ExtractHash   string           `json:"extractHash"`
+	Selection     *FlowSelection   `json:"selection,omitempty"`
+	RetryOf       string           `json:"retryOf,omitempty"`
+
+	// SubJobs of a job routed to other targets than the default one
+	SubJobs []SubJob `json:"subJobs,omitempty"`
+}
+
+// JobUser is the Grafana user that requested a job.
+type JobUser struct {
+	Login string `json:"login"`
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email,omitempty"`
+	Role  string `json:"role,omitempty"`
+}
+
+// metadataDeleteTimeout bounds the removal of the record of a job that did
+// not start.
+const metadataDeleteTimeout = 10 * time.Second
+
+var errMetadataNotFound = errors.New("job metadata not found")
+
+// errJobExists is returned when a job ID is requested again, its metadata
+// would otherwise be taken over by the new requester.
+var errJobExists = errors.New("job already exists")
+
+func metadataKey(jobId string) string {
+	return fmt.Sprintf("%s.meta.json", jobId)
+}
+
+func outputKey(jobId string) string {
+	return fmt.Sprintf("%s.pcapng", jobId)
+}
+
+func anonymizedOutputKey(jobId string) string {
+	return fmt.Sprintf("%s.anonymized.pcapng", jobId)
+}
+
+// newJobMetadata builds the metadata record for a request action from the
+// query and the plugin context of the request.
+func newJobMetadata(ctx context.Context, qm queryModel) *JobMetadata {
+	pCtx := backend.PluginConfigFromContext(ctx)
+
+	meta := &JobMetadata{
+		JobId:        qm.JobId,
+		CreatedAt:    time.Now().UTC(),
+		OrgId:        pCtx.OrgID,
+		Query:        qm.Query,
+		DashboardUID: qm.DashboardUID,
+		PanelId:      qm.PanelId,
+		Files:        len(qm.Extract),
+		Extract:      qm.Extract,
+		ExtractHash:  extractHash(qm.Extract),
+		Selection:    qm.Selection,
+	}
+	if qm.Selection != nil {
+		meta.Files = len(qm.Selection.Files)
+	}
+	if pCtx.DataSourceInstanceSettings != nil {
+		meta.DatasourceUID = pCtx.DataSourceInstanceSettings.UID
+	}
+	if user := backend.UserFromContext(ctx); user != nil {
+		meta.User = &JobUser{
+			Login: user.Login,
+			Name:  user.Name,
+			Email: user.Email,
+			Role:  user.Role,
+		}
+	}
+	for _, packets := range qm.Extract {
+		meta.Packets += len(packets)
+	}
+	if !qm.TimeRange.From.IsZero() && !qm.TimeRange.To.IsZero() {
+		from, to := qm.TimeRange.From.UTC(), qm.TimeRange.To.UTC()
+		meta.From, meta.To = &from, &to
+	}
+	return meta
+}
+
+// extractHash returns a SHA-256 over the extract map that does not depend on
+// the order of files or packet numbers, so identical selections can be
+// recognized.
+func extractHash(extract map[string][]int) string {
+	files := make([]string, 0, len(extract))
+	for file := range extract {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	hash := sha256.New()
+	for _, file := range files {
+		packets := append([]int(nil), extract[file]...)
+		sort.Ints(packets)
+		fmt.Fprintf(hash, "%s:%v\n", file, packets)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// writeJobMetadata records a new job. The record is only written if the job
+// has none yet, so the owner of an existing job cannot be replaced.
+func (d *Datasource) writeJobMetadata(ctx context.Context, meta *JobMetadata) error {
+	body, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal job metadata: %w", err)
+	}
+
+	_, err = d.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(d.settings.S3Bucket),
+		Key:         aws.String(metadataKey(meta.JobId)),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+		IfNoneMatch: aws.String("*"),
+	})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "PreconditionFailed" || apiErr.ErrorCode() == "ConditionalRequestConflict") {
+		return fmt.Errorf("%w: job '%s' already exists, choose another job ID", errJobExists, meta.JobId)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write job metadata: %w", err)
+	}
+	return nil
+}
+
+// deleteJobMetadata removes the record of a job whose execution did not
+// start, so that its ID can be requested again. The record is removed even
+// if the request was cancelled.
+func (d *Datasource) deleteJobMetadata(ctx context.Context, jobId string) {
+	if d.s3Client == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), metadataDeleteTimeout)
+	defer cancel()
+
+	_, err := d.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(d.settings.S3Bucket),
+		Key:    aws.String(metadataKey(jobId)),
+	})
+	if err != nil {
+		d.log(ctx).Error("Failed to delete the metadata of a job that did not start", "error", err, "jobId", jobId)
+	}
+}
+
+// jobMetadataResponse returns the response to a failed write of job metadata.
+func jobMetadataResponse(err error) backend.DataResponse {
+	if errors.Is(err, errJobExists) {
+		return backend.ErrDataResponse(backend.StatusBadRequest, err.Error())
+	}
+	return awsErrorResponse(backend.StatusBadGateway, "Failed to record job metadata", err)
+}
+
+func (d *Datasource) readJobMetadata(ctx context.Context, jobId string) (*JobMetadata, error) {
+	result, err := d.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(d.settings.S3Bucket),
+		Key:    aws.String(metadataKey(jobId)),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, errMetadataNotFound
+		}
+		return nil, fmt.Errorf("failed to read job metadata: %w", err)
+	}
+	defer result.Body.Close()
+
+	var meta JobMetadata
+	if err := json.NewDecoder(result.Body).Decode(&meta); err != nil {
+		return nil, fmt.Errorf("failed to decode job metadata: %w", err)
+	}
+	return &meta, nil
+}
+
+// metadataFields returns the fields describing the job metadata that are
+// appended to status frames.
+func metadataFields(meta *JobMetadata) []*data.Field {
+	requestedBy := ""
+	if meta.User != nil {
+		requestedBy = meta.User.Login
+	}
+	return []*data.Field{
+		data.NewField("requested_by", nil, []string{requestedBy}),
+		data.NewField("requested_at", nil, []time.Time{meta.CreatedAt}),
+		data.NewField("files", nil, []int64{int64(meta.Files)}),
+		data.NewField("packets", nil, []int64{int64(meta.Packets)}),
+		data.NewField("extract_hash", nil, []string{meta.ExtractHash}),
+	}
+}
+
+// dashboardURL returns a link to the dashboard panel the job was requested
+// from, if Grafana's app URL is known.
+func (m *JobMetadata) dashboardURL(ctx context.Context) string {
+	if m.DashboardUID == "" {
+		return ""
+	}
+	appURL, err := backend.GrafanaConfigFromContext(ctx).AppURL()
+	if err != nil {
+		return ""
+	}
+	link := fmt.Sprintf("%s/d/%s", strings.TrimRight(appURL, "/"), m.DashboardUID)
+	if m.PanelId != 0 {
+		link = fmt.Sprintf("%s?viewPanel=%d", link, m.PanelId)
+	}
+	return link
+}
@@ -0,0 +1,237 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	"github.com/emnify/pcap-extractor/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestActionWritesJobMetadata(t *testing.T) {
+	mockSFNClient := &MockSFNClient{}
+	mockS3Client := &MockS3Client{}
+
+	var written JobMetadata
+	mockS3Client.On("PutObject", mock.Anything, matchKey("test-job-123.meta.json")).Run(func(args mock.Arguments) {
+		assert.Equal(t, "*", *args.Get(1).(*s3.PutObjectInput).IfNoneMatch)
+		body, err := io.ReadAll(args.Get(1).(*s3.PutObjectInput).Body)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(body, &written))
+	}).Return(&s3.PutObjectOutput{}, nil)
+
+	executionArn := "arn:aws:states:us-east-1:123456789012:execution:test-state-machine:test-job-123"
+	mockSFNClient.On("StartExecution", mock.Anything, mock.Anything).Return(&sfn.StartExecutionOutput{
+		ExecutionArn: &executionArn,
+	}, nil)
+
+	ds := &Datasource{
+		settings: &models.PluginSettings{
+			StepFunctionArn: "arn:aws:states:us-east-1:123456789012:stateMachine:test-state-machine",
+			S3Bucket:        "test-bucket",
+		},
+		sfnClient: mockSFNClient,
+		s3Client:  mockS3Client,
+	}
+
+	ctx := backend.WithPluginContext(context.Background(), backend.PluginContext{
+		OrgID:                      2,
+		DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{UID: "pcap-ds"},
+	})
+	ctx = backend.WithUser(ctx, &backend.User{Login: "jdoe", Email: "jdoe@example.com", Role: "Editor"})
+
+	from := time.Date(2025, 10, 1, 12, 0, 0, 0, time.UTC)
+	response := ds.handleRequestAction(ctx, queryModel{
+		Action:       "request",
+		JobId:        "test-job-123",
+		Extract:      map[string][]int{"file1.pcap": {1, 2, 3}, "file2.pcap": {4}},
+		DashboardUID: "abc",
+		PanelId:      4,
+		TimeRange:    backend.TimeRange{From: from, To: from.Add(time.Hour)},
+	})
+
+	assert.NoError(t, response.Error)
+	assert.Equal(t, "test-job-123", written.JobId)
+	require.NotNil(t, written.User)
+	assert.Equal(t, "jdoe", written.User.Login)
+	assert.Equal(t, "Editor", written.User.Role)
+	assert.Equal(t, int64(2), written.OrgId)
+	assert.Equal(t, "pcap-ds", written.DatasourceUID)
+	assert.Equal(t, "abc", written.DashboardUID)
+	assert.Equal(t, 2, written.Files)
+	assert.Equal(t, 4, written.Packets)
+	assert.Equal(t, extractHash(map[string][]int{"file1.pcap": {1, 2, 3}, "file2.pcap": {4}}), written.ExtractHash)
+	require.NotNil(t, written.From)
+	assert.True(t, from.Equal(*written.From))
+
+	mockSFNClient.AssertExpectations(t)
+	mockS3Client.AssertExpectations(t)
+}
+
+func TestRequestActionFailsWithoutJobMetadata(t *testing.T) {
+	mockSFNClient := &MockSFNClient{}
+	mockS3Client := &MockS3Client{}
+	mockS3Client.On("PutObject", mock.Anything, mock.Anything).Return(nil, errors.New("AccessDenied"))
+
+	ds := &Datasource{
+		settings: &models.PluginSettings{
+			StepFunctionArn: "arn:aws:states:us-east-1:123456789012:stateMachine:test-state-machine",
+			S3Bucket:        "test-bucket",
+		},
+		sfnClient: mockSFNClient,
+		s3Client:  mockS3Client,
+	}
+
+	response := ds.handleRequestAction(context.Background(), queryModel{
+		Action:  "request",
+		JobId:   "test-job-123",
+		Extract: map[string][]int{"file1.pcap": {1}},
+	})
+
+	require.Error(t, response.Error)
+	assert.Contains(t, response.Error.Error(), "Failed to record job metadata")
+	mockSFNClient.AssertNotCalled(t, "StartExecution", mock.Anything, mock.Anything)
+}
+
+func TestRequestActionRejectsExistingJob(t *testing.T) {
+	mockSFNClient := &MockSFNClient{}
+	mockS3Client := &MockS3Client{}
+	mockS3Client.On("PutObject", mock.Anything, matchKey("test-job-123.meta.json")).Return(nil, apiError("PreconditionFailed", "At least one of the pre-conditions you specified did not hold"))
+
+	ds := &Datasource{settings: authzSettings(), sfnClient: mockSFNClient, s3Client: mockS3Client}
+
+	response := ds.handleRequestAction(userContext("mallory", "Editor", 1), queryModel{
+		Action:  "request",
+		JobId:   "test-job-123",
+		Extract: map[string][]int{"file1.pcap": {1}},
+	})
+
+	require.Error(t, response.Error)
+	assert.Equal(t, backend.StatusBadRequest, response.Status)
+	assert.Contains(t, response.Error.Error(), "job 'test-job-123' already exists")
+	mockSFNClient.AssertNotCalled(t, "StartExecution", mock.Anything, mock.Anything)
+}
+
+func TestRequestActionRemovesJobMetadataIfNotStarted(t *testing.T) {
+	mockSFNClient := &MockSFNClient{}
+	mockSFNClient.On("StartExecution", mock.Anything, mock.Anything).Return(nil, apiError("ExecutionLimitExceeded", "Execution limit exceeded")).Once()
+	mockSFNClient.On("StartExecution", mock.Anything, mock.Anything).Return(&sfn.StartExecutionOutput{ExecutionArn: aws.String("arn")}, nil).Once()
+	mockS3Client := &MockS3Client{}
+	mockS3Client.On("PutObject", mock.Anything, matchKey("test-job-123.meta.json")).Return(&s3.PutObjectOutput{}, nil).Twice()
+	mockS3Client.On("DeleteObject", mock.Anything, mock.MatchedBy(func(input *s3.DeleteObjectInput) bool {
+		return *input.Bucket == "test-bucket" && *input.Key == "test-job-123.meta.json"
+	})).Return(&s3.DeleteObjectOutput{}, nil).Once()
+
+	ds := &Datasource{settings: authzSettings(), sfnClient: mockSFNClient, s3Client: mockS3Client}
+	qm := queryModel{
+		Action:  "request",
+		JobId:   "test-job-123",
+		Extract: map[string][]int{"file1.pcap": {1}},
+	}
+
+	// The job ID can be requested again once the first attempt failed
+	response := ds.handleRequestAction(userContext("jdoe", "Editor", 1), qm)
+	require.Error(t, response.Error)
+	response = ds.handleRequestAction(userContext("jdoe", "Editor", 1), qm)
+	require.NoError(t, response.Error)
+
+	mockSFNClient.AssertExpectations(t)
+	mockS3Client.AssertExpectations(t)
+}
+
+func TestRequestActionRejectsInvalidJobId(t *testing.T) {
+	for _, jobId := range []string{"../other-job", "a/b", strings.Repeat("a", 81)} {
+		t.Run(jobId, func(t *testing.T) {
+			mockSFNClient := &MockSFNClient{}
+			mockS3Client := &MockS3Client{}
+			ds := &Datasource{settings: authzSettings(), sfnClient: mockSFNClient, s3Client: mockS3Client}
+
+			response := ds.handleRequestAction(userContext("jdoe", "Editor", 1), queryModel{
+				Action:  "request",
+				JobId:   jobId,
+				Extract: map[string][]int{"file1.pcap": {1}},
+			})
+
+			require.Error(t, response.Error)
+			assert.Equal(t, backend.StatusBadRequest, response.Status)
+			mockS3Client.AssertNotCalled(t, "PutObject", mock.Anything, mock.Anything)
+			mockSFNClient.AssertNotCalled(t, "StartExecution", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestStatusActionExposesJobMetadata(t *testing.T) {
+	tests := []struct {
+		name           string
+		setupS3Mock    func(*MockS3Client)
+		expectedFields []string
+	}{
+		{
+			name: "with metadata",
+			setupS3Mock: func(mockClient *MockS3Client) {
+				mockClient.On("GetObject", mock.Anything, matchKey("test-job-123.meta.json")).Return(
+					objectBody(`{"jobId":"test-job-123","createdAt":"2025-10-01T12:00:00Z","user":{"login":"jdoe"},"files":2,"packets":4,"extractHash":"abc"}`), nil)
+			},
+			expectedFields: []string{"status", "start_date", "stop_date", "duration", "execution_arn", "state_machine_arn", "redrive_count", "requested_by", "requested_at", "files", "packets", "extract_hash"},
+		},
+		{
+			name: "without metadata",
+			setupS3Mock: func(mockClient *MockS3Client) {
+				mockClient.On("GetObject", mock.Anything, mock.Anything).Return(nil, &types.NoSuchKey{})
+			},
+			expectedFields: []string{"status", "start_date", "stop_date", "duration", "execution_arn", "state_machine_arn", "redrive_count"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockSFNClient := &MockSFNClient{}
+			mockSFNClient.On("DescribeExecution", mock.Anything, mock.Anything).Return(&sfn.DescribeExecutionOutput{
+				Status: "RUNNING",
+			}, nil)
+			mockS3Client := &MockS3Client{}
+			tt.setupS3Mock(mockS3Client)
+
+			ds := &Datasource{
+				settings: &models.PluginSettings{
+					StepFunctionArn: "arn:aws:states:us-east-1:123456789012:stateMachine:test-state-machine",
+					S3Bucket:        "test-bucket",
+				},
+				sfnClient: mockSFNClient,
+				s3Client:  mockS3Client,
+			}
+
+			response := ds.handleStatusAction(userContext("admin", "Admin", 1), queryModel{Action: "status", JobId: "test-job-123"})
+
+			require.NoError(t, response.Error)
+			require.Len(t, response.Frames, 1)
+			var names []string
+			for _, field := range response.Frames[0].Fields {
+				names = append(names, field.Name)
+			}
+			assert.Equal(t, tt.expectedFields, names)
+			mockS3Client.AssertExpectations(t)
+		})
+	}
+}
+
+func TestExtractHashIgnoresOrder(t *testing.T) {
+	a := extractHash(map[string][]int{"file1.pcap": {3, 1, 2}, "file2.pcap": {4}})
+	b := extractHash(map[string][]int{"file2.pcap": {4}, "file1.pcap": {1, 2, 3}})
+	c := extractHash(map[string][]int{"file1.pcap": {1, 2}, "file2.pcap": {4}})
+
+	assert.Equal(t, a, b)
+	assert.NotEqual(t, a, c)
+}
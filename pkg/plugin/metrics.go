@@ -0,0 +1,207 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	sfntypes "github.com/aws/aws-sdk-go-v2/service/sfn/types"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	// metricsLookback is how long before the query range executions are
+	// searched for, so long executions that end in the range are counted.
+	metricsLookback = 6 * time.Hour
+
+	// maxMetricsBuckets bounds the number of intervals of a metrics query.
+	maxMetricsBuckets = 1000
+)
+
+// terminalStatuses are the statuses counted per interval by the metrics
+// action, in the order of the frame fields.
+var terminalStatuses = []sfntypes.ExecutionStatus{
+	sfntypes.ExecutionStatusSucceeded,
+	sfntypes.ExecutionStatusFailed,
+	sfntypes.ExecutionStatusTimedOut,
+	sfntypes.ExecutionStatusAborted,
+}
+
+// handleMetricsAction returns time series about the executions of the state
+// machine for dashboards and alert rules: the executions that ended per
+// interval by status, the p50 and p95 of their duration, and the number and
+// the age of the oldest of the executions running now.
+func (d *Datasource) handleMetricsAction(ctx context.Context, qm queryModel) backend.DataResponse {
+	var response backend.DataResponse
+
+	from, to := qm.TimeRange.From, qm.TimeRange.To
+	if from.IsZero() || to.IsZero() || !from.Before(to) {
+		return backend.ErrDataResponse(backend.StatusBadRequest, "A time range is required for metrics action")
+	}
+	interval := metricsInterval(from, to, qm.Interval)
+
+	d.log(ctx).Info("Processing metrics action", "from", from, "to", to, "interval", interval)
+
+	ended, err := d.listExecutions(ctx, "", from.Add(-metricsLookback))
+	if err != nil {
+		d.log(ctx).Error("Failed to list Step Function executions", "error", err)
+		return awsErrorResponse(backend.StatusBadGateway, "Failed to list executions", err)
+	}
+	running, err := d.listExecutions(ctx, sfntypes.ExecutionStatusRunning, time.Time{})
+	if err != nil {
+		d.log(ctx).Error("Failed to list running Step Function executions", "error", err)
+		return awsErrorResponse(backend.StatusBadGateway, "Failed to list executions", err)
+	}
+
+	countsFrame, durationsFrame := executionSeries(ended, from, to, interval)
+	response.Frames = append(response.Frames, countsFrame, durationsFrame, runningFrame(running, time.Now()))
+	return response
+}
+
+// metricsInterval returns the interval of the series, the one requested by
+// Grafana unless it would result in too many intervals.
+func metricsInterval(from, to time.Time, interval time.Duration) time.Duration {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	if minimum := to.Sub(from) / maxMetricsBuckets; interval < minimum {
+		interval = minimum.Truncate(time.Second) + time.Second
+	}
+	return interval
+}
+
+// listExecutions returns the executions of all targets started after since,
+// most recent first, optionally only those with the given status. Only the
+// latest maxListPages pages of executions of each target are searched.
+func (d *Datasource) listExecutions(ctx context.Context, status sfntypes.ExecutionStatus, since time.Time) ([]sfntypes.ExecutionListItem, error) {
+	var executions []sfntypes.ExecutionListItem
+	for _, target := range d.targetViews() {
+		listed, err := target.view.listTargetExecutions(ctx, status, since)
+		if err != nil && target.view != d {
+			return nil, fmt.Errorf("failed to list the executions of target '%s': %w", target.name, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		executions = append(executions, listed...)
+	}
+	sort.SliceStable(executions, func(i, j int) bool {
+		return startedAfter(executions[i].StartDate, executions[j].StartDate)
+	})
+	return executions, nil
+}
+
+// listTargetExecutions lists the executions of the state machine of a view.
+func (d *Datasource) listTargetExecutions(ctx context.Context, status sfntypes.ExecutionStatus, since time.Time) ([]sfntypes.ExecutionListItem, error) {
+	var executions []sfntypes.ExecutionListItem
+	paginator := sfn.NewListExecutionsPaginator(d.sfnClient, &sfn.ListExecutionsInput{
+		StateMachineArn: aws.String(d.settings.StepFunctionArn),
+		StatusFilter:    status,
+		MaxResults:      1000,
+	})
+	for pages := 0; paginator.HasMorePages() && pages < maxListPages; pages++ {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, execution := range page.Executions {
+			if execution.StartDate != nil && execution.StartDate.Before(since) {
+				return executions, nil
+			}
+			executions = append(executions, execution)
+		}
+	}
+	return executions, nil
+}
+
+// startedAfter orders executions by their start, executions without a start
+// come last.
+func startedAfter(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a != nil
+	}
+	return a.After(*b)
+}
+
+// executionSeries buckets the executions that ended in the time range by the
+// interval they ended in.
+func executionSeries(executions []sfntypes.ExecutionListItem, from, to time.Time, interval time.Duration) (*data.Frame, *data.Frame) {
+	start := from.Truncate(interval)
+	buckets := int(to.Sub(start)/interval) + 1
+
+	times := make([]time.Time, buckets)
+	for i := range times {
+		times[i] = start.Add(time.Duration(i) * interval)
+	}
+	counts := map[sfntypes.ExecutionStatus][]int64{}
+	for _, status := range terminalStatuses {
+		counts[status] = make([]int64, buckets)
+	}
+	durations := make([][]float64, buckets)
+
+	for _, execution := range executions {
+		if execution.StartDate == nil || execution.StopDate == nil {
+			continue
+		}
+		stop := *execution.StopDate
+		if stop.Before(from) || stop.After(to) {
+			continue
+		}
+		i := int(stop.Sub(start) / interval)
+		if bucket, ok := counts[execution.Status]; ok {
+			bucket[i]++
+		}
+		durations[i] = append(durations[i], stop.Sub(*execution.StartDate).Seconds())
+	}
+
+	countsFrame := data.NewFrame("executions", data.NewField("time", nil, times))
+	for _, status := range terminalStatuses {
+		countsFrame.Fields = append(countsFrame.Fields, data.NewField(string(status), nil, counts[status]))
+	}
+
+	p50 := make([]*float64, buckets)
+	p95 := make([]*float64, buckets)
+	for i, values := range durations {
+		p50[i] = percentile(values, 50)
+		p95[i] = percentile(values, 95)
+	}
+	durationsFrame := data.NewFrame("durations",
+		data.NewField("time", nil, times),
+		data.NewField("p50", nil, p50).SetConfig(&data.FieldConfig{Unit: "s"}),
+		data.NewField("p95", nil, p95).SetConfig(&data.FieldConfig{Unit: "s"}),
+	)
+	return countsFrame, durationsFrame
+}
+
+// runningFrame returns the number of running executions and the age of the
+// oldest of them in seconds.
+func runningFrame(running []sfntypes.ExecutionListItem, now time.Time) *data.Frame {
+	oldest := 0.0
+	for _, execution := range running {
+		if execution.StartDate != nil {
+			oldest = max(oldest, now.Sub(*execution.StartDate).Seconds())
+		}
+	}
+	return data.NewFrame("running",
+		data.NewField("time", nil, []time.Time{now}),
+		data.NewField("running", nil, []int64{int64(len(running))}),
+		data.NewField("oldest_running_age", nil, []float64{oldest}).SetConfig(&data.FieldConfig{Unit: "s"}),
+	)
+}
+
+// percentile returns the nearest-rank percentile of values, nil if there are
+// none.
+func percentile(values []float64, p int) *float64 {
+	if len(values) == 0 {
+		return nil
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	rank := (p*len(sorted) + 99) / 100
+	value := sorted[max(rank, 1)-1]
+	return &value
+}
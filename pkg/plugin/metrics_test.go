@@ -0,0 +1,134 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	sfntypes "github.com/aws/aws-sdk-go-v2/service/sfn/types"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleMetricsAction(t *testing.T) {
+	from := time.Date(2025, 10, 1, 12, 0, 0, 0, time.UTC)
+	to := from.Add(30 * time.Minute)
+	at := func(minutes float64) *time.Time {
+		timestamp := from.Add(time.Duration(minutes * float64(time.Minute)))
+		return &timestamp
+	}
+	execution := func(status sfntypes.ExecutionStatus, start, stop *time.Time) sfntypes.ExecutionListItem {
+		return sfntypes.ExecutionListItem{Name: aws.String("job"), Status: status, StartDate: start, StopDate: stop}
+	}
+
+	mockSFNClient := &MockSFNClient{}
+	mockSFNClient.On("ListExecutions", mock.Anything, mock.MatchedBy(func(input *sfn.ListExecutionsInput) bool {
+		return input.StatusFilter == ""
+	})).Return(&sfn.ListExecutionsOutput{
+		Executions: []sfntypes.ExecutionListItem{
+			execution(sfntypes.ExecutionStatusRunning, at(25), nil),
+			execution(sfntypes.ExecutionStatusFailed, at(20), at(21)),
+			execution(sfntypes.ExecutionStatusSucceeded, at(11), at(12)),
+			execution(sfntypes.ExecutionStatusSucceeded, at(10), at(13)),
+			execution(sfntypes.ExecutionStatusSucceeded, at(-30), at(1)),
+			execution(sfntypes.ExecutionStatusFailed, at(-60), at(-50)),
+			// Started before the lookback, not listed any further
+			execution(sfntypes.ExecutionStatusSucceeded, at(-600), at(5)),
+		},
+	}, nil).Once()
+	mockSFNClient.On("ListExecutions", mock.Anything, mock.MatchedBy(func(input *sfn.ListExecutionsInput) bool {
+		return input.StatusFilter == sfntypes.ExecutionStatusRunning
+	})).Return(&sfn.ListExecutionsOutput{
+		Executions: []sfntypes.ExecutionListItem{
+			execution(sfntypes.ExecutionStatusRunning, aws.Time(time.Now().Add(-45*time.Minute)), nil),
+			execution(sfntypes.ExecutionStatusRunning, aws.Time(time.Now().Add(-time.Minute)), nil),
+		},
+	}, nil).Once()
+
+	ds := &Datasource{settings: authzSettings(), sfnClient: mockSFNClient}
+
+	response := ds.handleMetricsAction(context.Background(), queryModel{
+		Action:    "metrics",
+		TimeRange: backend.TimeRange{From: from, To: to},
+		Interval:  10 * time.Minute,
+	})
+	require.NoError(t, response.Error)
+	require.Len(t, response.Frames, 3)
+
+	counts := response.Frames[0]
+	assert.Equal(t, "executions", counts.Name)
+	require.Equal(t, 4, counts.Rows())
+	column := func(name string) []interface{} {
+		for _, frame := range response.Frames {
+			if field, _ := frame.FieldByName(name); field != nil {
+				values := make([]interface{}, field.Len())
+				for i := range values {
+					values[i] = field.At(i)
+				}
+				return values
+			}
+		}
+		t.Fatalf("no field %s", name)
+		return nil
+	}
+	assert.Equal(t, []interface{}{int64(1), int64(2), int64(0), int64(0)}, column("SUCCEEDED"))
+	assert.Equal(t, []interface{}{int64(0), int64(0), int64(1), int64(0)}, column("FAILED"))
+
+	p50 := column("p50")
+	assert.Equal(t, 31*60.0, *p50[0].(*float64))
+	assert.Equal(t, 60.0, *p50[1].(*float64))
+	assert.Nil(t, p50[3].(*float64))
+	assert.Equal(t, 180.0, *column("p95")[1].(*float64))
+
+	assert.Equal(t, []interface{}{int64(2)}, column("running"))
+	assert.InDelta(t, 45*60.0, column("oldest_running_age")[0].(float64), 5)
+
+	mockSFNClient.AssertExpectations(t)
+}
+
+func TestMetricsRequireTimeRange(t *testing.T) {
+	ds := &Datasource{settings: authzSettings()}
+
+	response := ds.handleMetricsAction(context.Background(), queryModel{Action: "metrics"})
+	require.Error(t, response.Error)
+	assert.Equal(t, backend.StatusBadRequest, response.Status)
+}
+
+func TestMetricsInterval(t *testing.T) {
+	from := time.Date(2025, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, time.Minute, metricsInterval(from, from.Add(time.Hour), 0))
+	assert.Equal(t, 5*time.Minute, metricsInterval(from, from.Add(time.Hour), 5*time.Minute))
+	assert.Equal(t, 605*time.Second, metricsInterval(from, from.Add(7*24*time.Hour), time.Minute))
+}
+
+func TestPercentile(t *testing.T) {
+	values := []float64{5, 1, 4, 2, 3}
+
+	assert.Equal(t, 3.0, *percentile(values, 50))
+	assert.Equal(t, 5.0, *percentile(values, 95))
+	assert.Nil(t, percentile(nil, 50))
+}
+
+func TestAlertRulesMayQueryMetrics(t *testing.T) {
+	ds := &Datasource{settings: authzSettings()}
+
+	assert.NoError(t, ds.authorizeAction(withAlerting(context.Background(), true), "metrics"))
+	assert.Error(t, ds.authorizeAction(withAlerting(context.Background(), true), "status"))
+	assert.Error(t, ds.authorizeAction(context.Background(), "metrics"))
+
+	queryJSON, err := json.Marshal(map[string]interface{}{"action": "metrics"})
+	require.NoError(t, err)
+	response, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		Headers: map[string]string{fromAlertHeader: "true"},
+		Queries: []backend.DataQuery{{RefID: "A", JSON: queryJSON}},
+	})
+	require.NoError(t, err)
+	// Authorized, but rejected for the missing time range
+	assert.Equal(t, backend.StatusBadRequest, response.Responses["A"].Status)
+}
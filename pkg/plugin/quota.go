@@ -0,0 +1,308 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	sfntypes "github.com/aws/aws-sdk-go-v2/service/sfn/types"
+	"github.com/emnify/pcap-extractor/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// runningJobTTL bounds how long a job counts as running if its terminal
+// status is never polled.
+const runningJobTTL = 6 * time.Hour
+
+// Limits on the running jobs, a request they reject is admitted once the
+// jobs tracked as running turn out to have ended.
+const (
+	limitRunningJobsPerUser = "Maximum running jobs per user"
+	limitRunningJobsPerOrg  = "Maximum running jobs per organization"
+)
+
+// QuotaError is returned when a request exceeds one of the configured limits.
+type QuotaError struct {
+	Limit   string
+	Max     int
+	Current int
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s exceeded: %d of %d", e.Limit, e.Current, e.Max)
+}
+
+// reserveQuota reserves a job with the quota tracker. Jobs only stop counting
+// as running once a status poll sees them end, so before a request is
+// rejected for the running jobs of its user or organization, the executions
+// of the jobs tracked as running are described and those that ended are
+// released.
+func (d *Datasource) reserveQuota(ctx context.Context, jobId string, files, packets int) *QuotaError {
+	owner := requestOwner(ctx)
+	err := d.quota.reserve(jobId, owner, files, packets)
+	if err == nil || (err.Limit != limitRunningJobsPerUser && err.Limit != limitRunningJobsPerOrg) {
+		return err
+	}
+	if d.releaseEndedJobs(ctx, d.quota.runningJobs(owner.OrgId)) == 0 {
+		return err
+	}
+	return d.quota.reserve(jobId, owner, files, packets)
+}
+
+// releaseEndedJobs stops counting the jobs whose executions ended as running
+// and returns how many were released. Jobs that cannot be described keep
+// counting until they expire.
+func (d *Datasource) releaseEndedJobs(ctx context.Context, jobIds []string) int {
+	released := 0
+	for _, jobId := range jobIds {
+		var meta *JobMetadata
+		if d.s3Client != nil {
+			meta, _ = d.readJobMetadata(ctx, jobId)
+		}
+		states, err := d.describeSubJobs(ctx, subJobs(jobId, meta))
+		if err != nil {
+			d.log(ctx).Debug("Failed to describe running job", "jobId", jobId, "error", err)
+			continue
+		}
+		switch aggregateExecutions(states).Status {
+		case sfntypes.ExecutionStatusRunning, sfntypes.ExecutionStatusPendingRedrive:
+		default:
+			d.quota.finish(jobId)
+			released++
+		}
+	}
+	return released
+}
+
+// quotaResponse turns a quota error into an error response with a frame
+// describing the exceeded limit.
+func quotaResponse(err *QuotaError) backend.DataResponse {
+	response := backend.ErrDataResponse(backend.StatusTooManyRequests, err.Error())
+	frame := data.NewFrame("quota_exceeded",
+		data.NewField("limit", nil, []string{err.Limit}),
+		data.NewField("max", nil, []int64{int64(err.Max)}),
+		data.NewField("current", nil, []int64{int64(err.Current)}),
+	)
+	frameMetaCustom(frame).ErrorCode = errorCodeQuotaExceeded
+	response.Frames = append(response.Frames, frame)
+	return response
+}
+
+type jobOwner struct {
+	Login string
+	OrgId int64
+}
+
+// requestOwner returns the user and organization of the request.
+func requestOwner(ctx context.Context) jobOwner {
+	owner := jobOwner{OrgId: backend.PluginConfigFromContext(ctx).OrgID}
+	if user := backend.UserFromContext(ctx); user != nil {
+		owner.Login = user.Login
+	}
+	return owner
+}
+
+func (o jobOwner) key() string {
+	return fmt.Sprintf("%d/%s", o.OrgId, o.Login)
+}
+
+type runningJob struct {
+	owner   jobOwner
+	packets int
+	started time.Time
+}
+
+type packetUsage struct {
+	day     string
+	packets int
+}
+
+// quotaTracker enforces the request limits of a datasource instance. Its
+// state is local to the instance, a restart of the plugin or a change of the
+// datasource settings resets it.
+type quotaTracker struct {
+	mu       sync.Mutex
+	settings *models.PluginSettings
+	now      func() time.Time
+	running  map[string]runningJob
+	usage    map[string]packetUsage
+	requests map[string][]time.Time
+
+	// reported is the number of running jobs added to the tracked jobs gauge
+	reported int
+}
+
+func newQuotaTracker(settings *models.PluginSettings) *quotaTracker {
+	return &quotaTracker{
+		settings: settings,
+		now:      time.Now,
+		running:  map[string]runningJob{},
+		usage:    map[string]packetUsage{},
+		requests: map[string][]time.Time{},
+	}
+}
+
+// reserve checks a request against all limits and, if it is admitted, counts
+// the job as running and its packets against the daily budget of the owner.
+func (q *quotaTracker) reserve(jobId string, owner jobOwner, files, packets int) *QuotaError {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.now()
+	q.expire(now)
+
+	if err := q.checkSize(files, packets); err != nil {
+		return err
+	}
+
+	key := owner.key()
+	if limit := q.settings.MaxRequestsPerMinute; limit > 0 {
+		recent := q.requests[key][:0]
+		for _, t := range q.requests[key] {
+			if now.Sub(t) < time.Minute {
+				recent = append(recent, t)
+			}
+		}
+		q.requests[key] = recent
+		if len(recent) >= limit {
+			return &QuotaError{Limit: "Maximum requests per minute", Max: limit, Current: len(recent) + 1}
+		}
+	}
+
+	if limit := q.settings.MaxRunningJobsPerUser; limit > 0 {
+		if count := q.countRunning(func(o jobOwner) bool { return o == owner }); count >= limit {
+			return &QuotaError{Limit: limitRunningJobsPerUser, Max: limit, Current: count + 1}
+		}
+	}
+	if limit := q.settings.MaxRunningJobsPerOrg; limit > 0 {
+		if count := q.countRunning(func(o jobOwner) bool { return o.OrgId == owner.OrgId }); count >= limit {
+			return &QuotaError{Limit: limitRunningJobsPerOrg, Max: limit, Current: count + 1}
+		}
+	}
+
+	day := now.UTC().Format(time.DateOnly)
+	usage := q.usage[key]
+	if usage.day != day {
+		usage = packetUsage{day: day}
+	}
+	if limit := q.settings.DailyPacketBudget; limit > 0 && usage.packets+packets > limit {
+		return &QuotaError{Limit: "Daily packet budget", Max: limit, Current: usage.packets + packets}
+	}
+
+	usage.packets += packets
+	q.usage[key] = usage
+	if q.settings.MaxRequestsPerMinute > 0 {
+		q.requests[key] = append(q.requests[key], now)
+	}
+	q.running[jobId] = runningJob{owner: owner, packets: packets, started: now}
+	q.report()
+	return nil
+}
+
+// checkSize checks the files and packets of a request against the limits per
+// request, which do not depend on the state of the tracker.
+func (q *quotaTracker) checkSize(files, packets int) *QuotaError {
+	if limit := q.settings.MaxFilesPerRequest; limit > 0 && files > limit {
+		return &QuotaError{Limit: "Maximum source files per request", Max: limit, Current: files}
+	}
+	if limit := q.settings.MaxPacketsPerRequest; limit > 0 && packets > limit {
+		return &QuotaError{Limit: "Maximum packets per request", Max: limit, Current: packets}
+	}
+	return nil
+}
+
+// selectionLimit returns the packet limit that rules out selections, empty
+// if there is none. The packets a selection matches are only known once it
+// has been extracted.
+func (q *quotaTracker) selectionLimit() string {
+	switch {
+	case q.settings.MaxPacketsPerRequest > 0:
+		return "maximum packets per request"
+	case q.settings.DailyPacketBudget > 0:
+		return "daily packet budget"
+	}
+	return ""
+}
+
+// abort undoes the reservation of a job that could not be started.
+func (q *quotaTracker) abort(jobId string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.running[jobId]
+	if !ok {
+		return
+	}
+	delete(q.running, jobId)
+	q.report()
+
+	key := job.owner.key()
+	if usage, ok := q.usage[key]; ok && usage.day == job.started.UTC().Format(time.DateOnly) {
+		usage.packets -= job.packets
+		q.usage[key] = usage
+	}
+}
+
+// finish stops counting a job as running.
+func (q *quotaTracker) finish(jobId string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.running, jobId)
+	q.report()
+}
+
+// close removes the jobs of the tracker from the tracked jobs gauge, once
+// the datasource instance is disposed. A nil tracker does nothing.
+func (q *quotaTracker) close() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	trackedJobs.Sub(float64(q.reported))
+	q.reported = 0
+}
+
+// report updates the tracked jobs gauge with the change of running jobs.
+func (q *quotaTracker) report() {
+	trackedJobs.Add(float64(len(q.running) - q.reported))
+	q.reported = len(q.running)
+}
+
+// runningJobs returns the IDs of the jobs of an organization tracked as
+// running.
+func (q *quotaTracker) runningJobs(orgId int64) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var jobIds []string
+	for jobId, job := range q.running {
+		if job.owner.OrgId == orgId {
+			jobIds = append(jobIds, jobId)
+		}
+	}
+	return jobIds
+}
+
+func (q *quotaTracker) countRunning(match func(jobOwner) bool) int {
+	count := 0
+	for _, job := range q.running {
+		if match(job.owner) {
+			count++
+		}
+	}
+	return count
+}
+
+func (q *quotaTracker) expire(now time.Time) {
+	for jobId, job := range q.running {
+		if now.Sub(job.started) > runningJobTTL {
+			delete(q.running, jobId)
+		}
+	}
+	q.report()
+}
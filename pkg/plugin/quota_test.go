@@ -0,0 +1,270 @@
+package plugin
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	sfntypes "github.com/aws/aws-sdk-go-v2/service/sfn/types"
+	"github.com/emnify/pcap-extractor/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotaTracker(t *testing.T) {
+	jdoe := jobOwner{Login: "jdoe", OrgId: 1}
+	other := jobOwner{Login: "other", OrgId: 1}
+
+	tests := []struct {
+		name          string
+		settings      models.PluginSettings
+		run           func(*quotaTracker, *time.Time) *QuotaError
+		expectedLimit string
+	}{
+		{
+			name:     "too many files",
+			settings: models.PluginSettings{MaxFilesPerRequest: 2},
+			run: func(q *quotaTracker, now *time.Time) *QuotaError {
+				return q.reserve("job-1", jdoe, 3, 10)
+			},
+			expectedLimit: "Maximum source files per request",
+		},
+		{
+			name:     "too many packets",
+			settings: models.PluginSettings{MaxPacketsPerRequest: 100},
+			run: func(q *quotaTracker, now *time.Time) *QuotaError {
+				return q.reserve("job-1", jdoe, 1, 101)
+			},
+			expectedLimit: "Maximum packets per request",
+		},
+		{
+			name:     "too many running jobs per user",
+			settings: models.PluginSettings{MaxRunningJobsPerUser: 1},
+			run: func(q *quotaTracker, now *time.Time) *QuotaError {
+				require.Nil(t, q.reserve("job-1", jdoe, 1, 1))
+				require.Nil(t, q.reserve("job-2", other, 1, 1))
+				return q.reserve("job-3", jdoe, 1, 1)
+			},
+			expectedLimit: "Maximum running jobs per user",
+		},
+		{
+			name:     "finished jobs do not count as running",
+			settings: models.PluginSettings{MaxRunningJobsPerUser: 1},
+			run: func(q *quotaTracker, now *time.Time) *QuotaError {
+				require.Nil(t, q.reserve("job-1", jdoe, 1, 1))
+				q.finish("job-1")
+				return q.reserve("job-2", jdoe, 1, 1)
+			},
+		},
+		{
+			name:     "running jobs expire",
+			settings: models.PluginSettings{MaxRunningJobsPerUser: 1},
+			run: func(q *quotaTracker, now *time.Time) *QuotaError {
+				require.Nil(t, q.reserve("job-1", jdoe, 1, 1))
+				*now = now.Add(runningJobTTL + time.Minute)
+				return q.reserve("job-2", jdoe, 1, 1)
+			},
+		},
+		{
+			name:     "too many running jobs per org",
+			settings: models.PluginSettings{MaxRunningJobsPerOrg: 1},
+			run: func(q *quotaTracker, now *time.Time) *QuotaError {
+				require.Nil(t, q.reserve("job-1", jdoe, 1, 1))
+				return q.reserve("job-2", other, 1, 1)
+			},
+			expectedLimit: "Maximum running jobs per organization",
+		},
+		{
+			name:     "daily packet budget",
+			settings: models.PluginSettings{DailyPacketBudget: 100},
+			run: func(q *quotaTracker, now *time.Time) *QuotaError {
+				require.Nil(t, q.reserve("job-1", jdoe, 1, 60))
+				require.Nil(t, q.reserve("job-2", other, 1, 60))
+				return q.reserve("job-3", jdoe, 1, 60)
+			},
+			expectedLimit: "Daily packet budget",
+		},
+		{
+			name:     "daily packet budget resets the next day",
+			settings: models.PluginSettings{DailyPacketBudget: 100},
+			run: func(q *quotaTracker, now *time.Time) *QuotaError {
+				require.Nil(t, q.reserve("job-1", jdoe, 1, 60))
+				*now = now.Add(24 * time.Hour)
+				return q.reserve("job-2", jdoe, 1, 60)
+			},
+		},
+		{
+			name:     "aborted jobs are refunded",
+			settings: models.PluginSettings{DailyPacketBudget: 100, MaxRunningJobsPerUser: 1},
+			run: func(q *quotaTracker, now *time.Time) *QuotaError {
+				require.Nil(t, q.reserve("job-1", jdoe, 1, 60))
+				q.abort("job-1")
+				return q.reserve("job-2", jdoe, 1, 60)
+			},
+		},
+		{
+			name:     "requests per minute",
+			settings: models.PluginSettings{MaxRequestsPerMinute: 2},
+			run: func(q *quotaTracker, now *time.Time) *QuotaError {
+				require.Nil(t, q.reserve("job-1", jdoe, 1, 1))
+				require.Nil(t, q.reserve("job-2", jdoe, 1, 1))
+				return q.reserve("job-3", jdoe, 1, 1)
+			},
+			expectedLimit: "Maximum requests per minute",
+		},
+		{
+			name:     "requests per minute window moves",
+			settings: models.PluginSettings{MaxRequestsPerMinute: 2},
+			run: func(q *quotaTracker, now *time.Time) *QuotaError {
+				require.Nil(t, q.reserve("job-1", jdoe, 1, 1))
+				require.Nil(t, q.reserve("job-2", jdoe, 1, 1))
+				*now = now.Add(time.Minute)
+				return q.reserve("job-3", jdoe, 1, 1)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2025, 10, 1, 12, 0, 0, 0, time.UTC)
+			q := newQuotaTracker(&tt.settings)
+			q.now = func() time.Time { return now }
+
+			err := tt.run(q, &now)
+			if tt.expectedLimit == "" {
+				assert.Nil(t, err)
+			} else {
+				require.NotNil(t, err)
+				assert.Equal(t, tt.expectedLimit, err.Limit)
+			}
+		})
+	}
+}
+
+func TestRequestActionEnforcesQuota(t *testing.T) {
+	settings := &models.PluginSettings{
+		StepFunctionArn:       "arn:aws:states:us-east-1:123456789012:stateMachine:test-state-machine",
+		S3Bucket:              "test-bucket",
+		MaxRunningJobsPerUser: 1,
+	}
+
+	mockSFNClient := &MockSFNClient{}
+	mockSFNClient.On("StartExecution", mock.Anything, mock.MatchedBy(func(input *sfn.StartExecutionInput) bool {
+		return *input.Name == "test-job-1"
+	})).Return(nil, errors.New("execution failed")).Once()
+	executionArn := "arn:aws:states:us-east-1:123456789012:execution:test-state-machine:test-job-2"
+	mockSFNClient.On("StartExecution", mock.Anything, mock.MatchedBy(func(input *sfn.StartExecutionInput) bool {
+		return *input.Name == "test-job-2"
+	})).Return(&sfn.StartExecutionOutput{ExecutionArn: &executionArn}, nil).Once()
+
+	ds := &Datasource{
+		settings:  settings,
+		sfnClient: mockSFNClient,
+		quota:     newQuotaTracker(settings),
+	}
+	ctx := userContext("jdoe", "Editor", 1)
+	extract := map[string][]int{"file1.pcap": {1, 2, 3}}
+
+	// A job that fails to start does not count against the limit
+	response := ds.handleRequestAction(ctx, queryModel{Action: "request", JobId: "test-job-1", Extract: extract})
+	require.Error(t, response.Error)
+
+	response = ds.handleRequestAction(ctx, queryModel{Action: "request", JobId: "test-job-2", Extract: extract})
+	require.NoError(t, response.Error)
+
+	mockSFNClient.On("DescribeExecution", mock.Anything, mock.Anything).Return(&sfn.DescribeExecutionOutput{Status: sfntypes.ExecutionStatusRunning}, nil).Once()
+	response = ds.handleRequestAction(ctx, queryModel{Action: "request", JobId: "test-job-3", Extract: extract})
+	assert.Equal(t, backend.StatusTooManyRequests, response.Status)
+	assert.Contains(t, response.Error.Error(), "Maximum running jobs per user exceeded: 2 of 1")
+	require.Len(t, response.Frames, 1)
+	assert.Equal(t, "quota_exceeded", response.Frames[0].Name)
+
+	mockSFNClient.AssertExpectations(t)
+}
+
+func TestRequestActionReleasesEndedJobsBeforeRejecting(t *testing.T) {
+	settings := &models.PluginSettings{
+		StepFunctionArn:       "arn:aws:states:us-east-1:123456789012:stateMachine:test-state-machine",
+		S3Bucket:              "test-bucket",
+		MaxRunningJobsPerUser: 1,
+	}
+
+	mockSFNClient := &MockSFNClient{}
+	mockSFNClient.On("StartExecution", mock.Anything, mock.Anything).Return(&sfn.StartExecutionOutput{ExecutionArn: aws.String("arn")}, nil)
+	mockSFNClient.On("DescribeExecution", mock.Anything, mock.MatchedBy(func(input *sfn.DescribeExecutionInput) bool {
+		return strings.HasSuffix(*input.ExecutionArn, ":test-job-1")
+	})).Return(&sfn.DescribeExecutionOutput{Status: sfntypes.ExecutionStatusRunning}, nil).Once()
+	mockSFNClient.On("DescribeExecution", mock.Anything, mock.MatchedBy(func(input *sfn.DescribeExecutionInput) bool {
+		return strings.HasSuffix(*input.ExecutionArn, ":test-job-1")
+	})).Return(&sfn.DescribeExecutionOutput{Status: sfntypes.ExecutionStatusSucceeded}, nil).Once()
+
+	ds := &Datasource{
+		settings:  settings,
+		sfnClient: mockSFNClient,
+		quota:     newQuotaTracker(settings),
+	}
+	ctx := userContext("jdoe", "Editor", 1)
+	extract := map[string][]int{"file1.pcap": {1, 2, 3}}
+
+	response := ds.handleRequestAction(ctx, queryModel{Action: "request", JobId: "test-job-1", Extract: extract})
+	require.NoError(t, response.Error)
+
+	// The job is still running
+	response = ds.handleRequestAction(ctx, queryModel{Action: "request", JobId: "test-job-2", Extract: extract})
+	assert.Equal(t, backend.StatusTooManyRequests, response.Status)
+
+	// The job ended without its status being polled
+	response = ds.handleRequestAction(ctx, queryModel{Action: "request", JobId: "test-job-3", Extract: extract})
+	require.NoError(t, response.Error)
+	assert.Equal(t, 1, ds.quota.countRunning(func(jobOwner) bool { return true }))
+
+	mockSFNClient.AssertExpectations(t)
+}
+
+func TestRequestActionEnforcesSizeBeforeCheckingSourceFiles(t *testing.T) {
+	settings := authzSettings()
+	settings.CheckSourceFiles = true
+	settings.MaxFilesPerRequest = 1
+
+	mockS3Client := &MockS3Client{}
+	ds := &Datasource{settings: settings, sfnClient: &MockSFNClient{}, s3Client: mockS3Client, quota: newQuotaTracker(settings)}
+
+	response := ds.handleRequestAction(userContext("jdoe", "Editor", 1), queryModel{
+		Action:  "request",
+		JobId:   "test-job-1",
+		Extract: map[string][]int{"a.pcap": {1}, "b.pcap": {1}},
+	})
+	assert.Equal(t, backend.StatusTooManyRequests, response.Status)
+	mockS3Client.AssertNotCalled(t, "HeadObject", mock.Anything, mock.Anything)
+}
+
+func TestRequestActionLimitsSelections(t *testing.T) {
+	settings := authzSettings()
+	settings.MaxFilesPerRequest = 2
+
+	mockS3Client := &MockS3Client{}
+	mockS3Client.On("ListObjectsV2", mock.Anything, mock.Anything).Return(&s3.ListObjectsV2Output{
+		Contents: []s3types.Object{{Key: aws.String("captures/a.pcap")}, {Key: aws.String("captures/b.pcap")}, {Key: aws.String("captures/c.pcap")}},
+	}, nil)
+	ds := &Datasource{settings: settings, sfnClient: &MockSFNClient{}, s3Client: mockS3Client, quota: newQuotaTracker(settings)}
+	ctx := userContext("jdoe", "Editor", 1)
+	timeRange := backend.TimeRange{From: time.Now().Add(-15 * time.Minute), To: time.Now()}
+
+	// The files below a prefix count against the limit of files
+	response := ds.handleRequestAction(ctx, queryModel{Action: "request", JobId: "test-job-1", TimeRange: timeRange, Selection: &FlowSelection{S3Prefix: "captures/"}})
+	assert.Equal(t, backend.StatusTooManyRequests, response.Status)
+	assert.Contains(t, response.Error.Error(), "Maximum source files per request exceeded: 3 of 2")
+
+	// The packets of a selection are unknown, packet limits rule it out
+	settings.DailyPacketBudget = 1000
+	response = ds.handleRequestAction(ctx, queryModel{Action: "request", JobId: "test-job-2", TimeRange: timeRange, Selection: &FlowSelection{Files: []string{"captures/a.pcap"}}})
+	assert.Equal(t, backend.StatusBadRequest, response.Status)
+	assert.Equal(t, "Selections are not allowed while the daily packet budget is limited, use an extract", response.Error.Error())
+}
@@ -0,0 +1,41 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+)
+
+// jobIdPattern matches the names Step Functions accepts for executions and
+// that are safe to use as S3 key prefixes.
+var jobIdPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,80}$`)
+
+func validateJobId(jobId string) error {
+	if jobId == "" {
+		return fmt.Errorf("jobId is required")
+	}
+	if !jobIdPattern.MatchString(jobId) {
+		return fmt.Errorf("invalid jobId '%s'", jobId)
+	}
+	return nil
+}
+
+func (d *Datasource) newResourceHandler() backend.CallResourceHandler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /bundle", d.handleBundle)
+	return httpadapter.New(mux)
+}
+
+// CallResource handles the resource routes of the datasource, available as
+// /api/datasources/uid/{uid}/resources/{route} in Grafana.
+func (d *Datasource) CallResource(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
+	handler := d.resourceHandler
+	if handler == nil {
+		handler = d.newResourceHandler()
+	}
+	return handler.CallResource(ctx, req, sender)
+}
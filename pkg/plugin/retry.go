@@ -0,0 +1,193 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	sfntypes "github.com/aws/aws-sdk-go-v2/service/sfn/types"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	retryModeRedrive = "redrive"
+	retryModeRestart = "restart"
+)
+
+// handleRetryAction continues a failed job. Executions Step Functions can
+// redrive are resumed from the failed state under the same job ID, all others
+// are restarted as a new job with the input of the original execution.
+func (d *Datasource) handleRetryAction(ctx context.Context, qm queryModel) (response backend.DataResponse) {
+	event := newAuditEvent(ctx, auditActionRetry, qm.JobId)
+	defer func() {
+		event.failOnError(response)
+		d.emitAudit(ctx, event)
+	}()
+
+	if qm.JobId == "" {
+		return backend.ErrDataResponse(backend.StatusBadRequest, "JobId is required for retry action")
+	}
+
+	d.log(ctx).Info("Processing retry action")
+
+	meta, err := d.loadJob(ctx, qm.JobId)
+	if err != nil {
+		return loadJobResponse(err)
+	}
+	if meta != nil {
+		event.Files, event.Packets = meta.Files, meta.Packets
+	}
+
+	view, _, err := d.jobTarget(qm.JobId, meta)
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, err.Error())
+	}
+	executionArn, err := view.executionArn(qm.JobId)
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, err.Error())
+	}
+	recordJobExecution(ctx, executionArn)
+
+	// The cached status may be outdated, a retry needs the current one
+	execution, err := view.sfnClient.DescribeExecution(ctx, &sfn.DescribeExecutionInput{
+		ExecutionArn: aws.String(executionArn),
+	})
+	if err != nil {
+		d.log(ctx).Error("Failed to describe Step Function execution", "error", err)
+		return awsErrorResponse(backend.StatusBadGateway, "Failed to get execution status", err)
+	}
+
+	switch execution.Status {
+	case sfntypes.ExecutionStatusFailed, sfntypes.ExecutionStatusTimedOut, sfntypes.ExecutionStatusAborted:
+	default:
+		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Job '%s' is %s, only failed, timed out or aborted jobs can be retried", qm.JobId, execution.Status))
+	}
+
+	if execution.RedriveStatus == sfntypes.ExecutionRedriveStatusRedrivable {
+		return d.redriveJob(ctx, view, qm, meta, executionArn)
+	}
+	return d.restartJob(ctx, view, qm, meta, execution)
+}
+
+// redriveJob resumes the execution of a job on the target it ran on from the
+// state it failed in.
+func (d *Datasource) redriveJob(ctx context.Context, view *Datasource, qm queryModel, meta *JobMetadata, executionArn string) (response backend.DataResponse) {
+	if d.quota != nil {
+		files, packets := 0, 0
+		if meta != nil {
+			files, packets = meta.Files, meta.Packets
+		}
+		if err := d.reserveQuota(ctx, qm.JobId, files, packets); err != nil {
+			d.log(ctx).Warn("Retry exceeds quota", "error", err)
+			return quotaResponse(err)
+		}
+		defer func() {
+			if response.Error != nil {
+				d.quota.abort(qm.JobId)
+			}
+		}()
+	}
+
+	_, err := view.sfnClient.RedriveExecution(ctx, &sfn.RedriveExecutionInput{
+		ExecutionArn: aws.String(executionArn),
+	})
+	if err != nil {
+		d.log(ctx).Error("Failed to redrive Step Function execution", "error", err)
+		return awsErrorResponse(backend.StatusBadGateway, "Step Function redrive failed", err)
+	}
+	d.cache.invalidate(executionArn)
+
+	d.log(ctx).Info("Step Function execution redriven")
+	frame := retryFrame(qm.JobId, qm.JobId, retryModeRedrive)
+	frame.Meta = &data.FrameMeta{ExecutedQueryString: fmt.Sprintf("RedriveExecution of %s", executionArn)}
+	response.Frames = append(response.Frames, frame)
+	return response
+}
+
+// restartJob starts a new job with the input of the original execution on the
+// same target and records the original job in the metadata of the new one.
+func (d *Datasource) restartJob(ctx context.Context, view *Datasource, qm queryModel, meta *JobMetadata, execution *sfn.DescribeExecutionOutput) (response backend.DataResponse) {
+	retryJobId := qm.RetryJobId
+	if retryJobId == "" {
+		retryJobId = newRetryJobId(qm.JobId, time.Now())
+	}
+	if err := validateJobId(retryJobId); err != nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, err.Error())
+	}
+
+	if execution.Input == nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("The input of job '%s' is not available, it cannot be restarted", qm.JobId))
+	}
+	var sfnInput StepFunctionInput
+	if err := json.Unmarshal([]byte(*execution.Input), &sfnInput); err != nil {
+		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("Failed to decode the input of job '%s': %v", qm.JobId, err))
+	}
+	sfnInput.JobId = retryJobId
+
+	retryQm := queryModel{JobId: retryJobId, Extract: sfnInput.Extract, FileOrder: sfnInput.FileOrder, Selection: sfnInput.Selection}
+	if meta != nil {
+		retryQm.Query, retryQm.DashboardUID, retryQm.PanelId = meta.Query, meta.DashboardUID, meta.PanelId
+		if meta.From != nil && meta.To != nil {
+			retryQm.TimeRange = backend.TimeRange{From: *meta.From, To: *meta.To}
+		}
+	}
+	retryMeta := newJobMetadata(ctx, retryQm)
+	retryMeta.RetryOf = qm.JobId
+	if meta != nil && len(meta.SubJobs) == 1 {
+		retryMeta.SubJobs = []SubJob{{Target: meta.SubJobs[0].Target, JobId: retryJobId, Files: retryMeta.Files, Packets: retryMeta.Packets}}
+	}
+
+	if d.quota != nil {
+		if err := d.reserveQuota(ctx, retryJobId, retryMeta.Files, retryMeta.Packets); err != nil {
+			d.log(ctx).Warn("Retry exceeds quota", "retryJobId", retryJobId, "error", err)
+			return quotaResponse(err)
+		}
+		defer func() {
+			if response.Error != nil {
+				d.quota.abort(retryJobId)
+			}
+		}()
+	}
+
+	if d.s3Client != nil {
+		if err := d.writeJobMetadata(ctx, retryMeta); err != nil {
+			d.log(ctx).Error("Failed to write job metadata", "error", err, "retryJobId", retryJobId)
+			return jobMetadataResponse(err)
+		}
+	}
+
+	if _, err := view.executeStepFunction(ctx, retryJobId, sfnInput); err != nil {
+		d.log(ctx).Error("Failed to execute Step Function", "error", err, "retryJobId", retryJobId)
+		d.deleteJobMetadata(ctx, retryJobId)
+		return awsErrorResponse(backend.StatusBadGateway, "Step Function execution failed", err)
+	}
+
+	d.log(ctx).Info("Job restarted", "retryJobId", retryJobId)
+	frame := retryFrame(retryJobId, qm.JobId, retryModeRestart)
+	frame.Meta = &data.FrameMeta{ExecutedQueryString: fmt.Sprintf("StartExecution of %s as job %s with the input of job %s", view.settings.StepFunctionArn, retryJobId, qm.JobId)}
+	response.Frames = append(response.Frames, frame)
+	return response
+}
+
+// newRetryJobId derives the ID of a restarted job from the original one,
+// shortening the original ID so the result stays a valid execution name.
+func newRetryJobId(jobId string, now time.Time) string {
+	suffix := "-retry-" + now.UTC().Format("20060102150405")
+	if maxLength := 80 - len(suffix); len(jobId) > maxLength {
+		jobId = jobId[:maxLength]
+	}
+	return jobId + suffix
+}
+
+func retryFrame(jobId, retryOf, mode string) *data.Frame {
+	return data.NewFrame("step_function_retry",
+		data.NewField("status", nil, []string{"RUNNING"}),
+		data.NewField("job_id", nil, []string{jobId}),
+		data.NewField("retry_of", nil, []string{retryOf}),
+		data.NewField("mode", nil, []string{mode}),
+	)
+}
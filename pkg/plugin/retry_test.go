@@ -0,0 +1,192 @@
+package plugin
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	sfntypes "github.com/aws/aws-sdk-go-v2/service/sfn/types"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleRetryAction(t *testing.T) {
+	originalArn := "arn:aws:states:us-east-1:123456789012:execution:test-state-machine:job-1"
+
+	tests := []struct {
+		name           string
+		queryModel     queryModel
+		setupSFNMock   func(*MockSFNClient)
+		expectedStatus backend.Status
+		expectedJobId  string
+		expectedMode   string
+	}{
+		{
+			name:       "redrivable execution is redriven",
+			queryModel: queryModel{Action: "retry", JobId: "job-1"},
+			setupSFNMock: func(mockClient *MockSFNClient) {
+				mockClient.On("DescribeExecution", mock.Anything, matchExecution("job-1")).Return(&sfn.DescribeExecutionOutput{
+					Status:        sfntypes.ExecutionStatusFailed,
+					RedriveStatus: sfntypes.ExecutionRedriveStatusRedrivable,
+				}, nil)
+				mockClient.On("RedriveExecution", mock.Anything, mock.MatchedBy(func(input *sfn.RedriveExecutionInput) bool {
+					return *input.ExecutionArn == originalArn
+				})).Return(&sfn.RedriveExecutionOutput{}, nil)
+			},
+			expectedJobId: "job-1",
+			expectedMode:  "redrive",
+		},
+		{
+			name:       "other executions are restarted with the original input",
+			queryModel: queryModel{Action: "retry", JobId: "job-1", RetryJobId: "job-1-again"},
+			setupSFNMock: func(mockClient *MockSFNClient) {
+				mockClient.On("DescribeExecution", mock.Anything, matchExecution("job-1")).Return(&sfn.DescribeExecutionOutput{
+					Status:        sfntypes.ExecutionStatusTimedOut,
+					RedriveStatus: sfntypes.ExecutionRedriveStatusNotRedrivable,
+					Input:         aws.String(`{"jobId":"job-1","bucket":"test-bucket","extract":{"file1.pcap":[1,2,3]}}`),
+				}, nil)
+				mockClient.On("StartExecution", mock.Anything, mock.MatchedBy(func(input *sfn.StartExecutionInput) bool {
+					var sfnInput StepFunctionInput
+					return *input.Name == "job-1-again" &&
+						json.Unmarshal([]byte(*input.Input), &sfnInput) == nil &&
+						sfnInput.JobId == "job-1-again" &&
+						assert.ObjectsAreEqual(map[string][]int{"file1.pcap": {1, 2, 3}}, sfnInput.Extract)
+				})).Return(&sfn.StartExecutionOutput{ExecutionArn: aws.String("arn:new")}, nil)
+			},
+			expectedJobId: "job-1-again",
+			expectedMode:  "restart",
+		},
+		{
+			name:       "running jobs cannot be retried",
+			queryModel: queryModel{Action: "retry", JobId: "job-1"},
+			setupSFNMock: func(mockClient *MockSFNClient) {
+				mockClient.On("DescribeExecution", mock.Anything, matchExecution("job-1")).Return(&sfn.DescribeExecutionOutput{
+					Status: sfntypes.ExecutionStatusRunning,
+				}, nil)
+			},
+			expectedStatus: backend.StatusBadRequest,
+		},
+		{
+			name:           "job ID is required",
+			queryModel:     queryModel{Action: "retry"},
+			setupSFNMock:   func(mockClient *MockSFNClient) {},
+			expectedStatus: backend.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockSFNClient := &MockSFNClient{}
+			tt.setupSFNMock(mockSFNClient)
+
+			ds := &Datasource{settings: authzSettings(), sfnClient: mockSFNClient}
+
+			response := ds.handleRetryAction(userContext("admin", "Admin", 1), tt.queryModel)
+
+			if tt.expectedStatus != 0 {
+				require.Error(t, response.Error)
+				assert.Equal(t, tt.expectedStatus, response.Status)
+				return
+			}
+			require.NoError(t, response.Error)
+			require.Len(t, response.Frames, 1)
+			frame := response.Frames[0]
+			assert.Equal(t, "step_function_retry", frame.Name)
+			assert.Equal(t, tt.expectedJobId, fieldValue(t, frame, "job_id"))
+			assert.Equal(t, "job-1", fieldValue(t, frame, "retry_of"))
+			assert.Equal(t, tt.expectedMode, fieldValue(t, frame, "mode"))
+			mockSFNClient.AssertExpectations(t)
+		})
+	}
+}
+
+func TestRetryLinksRestartedJobToOriginal(t *testing.T) {
+	mockSFNClient := &MockSFNClient{}
+	mockS3Client := &MockS3Client{}
+
+	created := time.Date(2025, 10, 1, 12, 0, 0, 0, time.UTC)
+	original, err := json.Marshal(JobMetadata{
+		JobId:        "job-1",
+		CreatedAt:    created,
+		User:         &JobUser{Login: "jdoe"},
+		OrgId:        1,
+		DashboardUID: "abc",
+		Files:        1,
+		Packets:      3,
+	})
+	require.NoError(t, err)
+	mockS3Client.On("GetObject", mock.Anything, matchKey("job-1.meta.json")).Return(objectBody(string(original)), nil)
+
+	var written JobMetadata
+	mockS3Client.On("PutObject", mock.Anything, mock.MatchedBy(func(input *s3.PutObjectInput) bool {
+		return *input.Key != "job-1.meta.json"
+	})).Run(func(args mock.Arguments) {
+		body, err := io.ReadAll(args.Get(1).(*s3.PutObjectInput).Body)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(body, &written))
+	}).Return(&s3.PutObjectOutput{}, nil)
+
+	mockSFNClient.On("DescribeExecution", mock.Anything, matchExecution("job-1")).Return(&sfn.DescribeExecutionOutput{
+		Status: sfntypes.ExecutionStatusFailed,
+		Input:  aws.String(`{"jobId":"job-1","bucket":"test-bucket","extract":{"file1.pcap":[1,2,3]}}`),
+	}, nil)
+	mockSFNClient.On("StartExecution", mock.Anything, mock.Anything).Return(&sfn.StartExecutionOutput{ExecutionArn: aws.String("arn:new")}, nil)
+
+	ds := &Datasource{settings: authzSettings(), sfnClient: mockSFNClient, s3Client: mockS3Client}
+
+	response := ds.handleRetryAction(userContext("jdoe", "Editor", 1), queryModel{Action: "retry", JobId: "job-1"})
+	require.NoError(t, response.Error)
+
+	assert.Regexp(t, `^job-1-retry-\d{14}$`, written.JobId)
+	assert.Equal(t, "job-1", written.RetryOf)
+	assert.Equal(t, "abc", written.DashboardUID)
+	assert.Equal(t, 3, written.Packets)
+	require.NotNil(t, written.User)
+	assert.Equal(t, "jdoe", written.User.Login)
+}
+
+func TestRetryRejectsExistingRetryJobId(t *testing.T) {
+	mockSFNClient := &MockSFNClient{}
+	mockS3Client := &MockS3Client{}
+
+	original, err := json.Marshal(JobMetadata{JobId: "job-1", User: &JobUser{Login: "jdoe"}, OrgId: 1})
+	require.NoError(t, err)
+	mockS3Client.On("GetObject", mock.Anything, matchKey("job-1.meta.json")).Return(objectBody(string(original)), nil)
+	mockS3Client.On("PutObject", mock.Anything, matchKey("job-2.meta.json")).Return(nil, apiError("PreconditionFailed", "At least one of the pre-conditions you specified did not hold"))
+	mockSFNClient.On("DescribeExecution", mock.Anything, matchExecution("job-1")).Return(&sfn.DescribeExecutionOutput{
+		Status: sfntypes.ExecutionStatusFailed,
+		Input:  aws.String(`{"jobId":"job-1","bucket":"test-bucket","extract":{"file1.pcap":[1]}}`),
+	}, nil)
+
+	ds := &Datasource{settings: authzSettings(), sfnClient: mockSFNClient, s3Client: mockS3Client}
+
+	response := ds.handleRetryAction(userContext("jdoe", "Editor", 1), queryModel{Action: "retry", JobId: "job-1", RetryJobId: "job-2"})
+	require.Error(t, response.Error)
+	assert.Equal(t, backend.StatusBadRequest, response.Status)
+	assert.Contains(t, response.Error.Error(), "job 'job-2' already exists")
+	mockSFNClient.AssertNotCalled(t, "StartExecution", mock.Anything, mock.Anything)
+}
+
+func TestNewRetryJobId(t *testing.T) {
+	now := time.Date(2025, 10, 1, 12, 30, 0, 0, time.UTC)
+
+	assert.Equal(t, "job-1-retry-20251001123000", newRetryJobId("job-1", now))
+
+	long := newRetryJobId(strings.Repeat("a", 80), now)
+	assert.Len(t, long, 80)
+	assert.NoError(t, validateJobId(long))
+}
+
+func fieldValue(t *testing.T, frame *data.Frame, name string) interface{} {
+	field, _ := frame.FieldByName(name)
+	require.NotNil(t, field, name)
+	return field.At(0)
+}
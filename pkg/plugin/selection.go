@@ -0,0 +1,193 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// imsiPattern matches the 6 to 15 digits of an IMSI.
+var imsiPattern = regexp.MustCompile(`^[0-9]{6,15}$`)
+
+// selectionProtocols are the transport protocols a selection can filter on.
+var selectionProtocols = []string{"tcp", "udp", "sctp", "icmp"}
+
+// FlowSelection selects the packets of a request by time window and flow
+// instead of by packet numbers, e.g. all traffic of an IMSI in the last 15
+// minutes. The packets are searched in a list of source files or in all files
+// below an S3 prefix.
+type FlowSelection struct {
+	Files    []string `json:"files,omitempty"`
+	S3Prefix string   `json:"s3Prefix,omitempty"`
+
+	// Time window, always taken from the time range of the query
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+
+	// Optional flow criteria, packets must match all that are set
+	SrcIP    string  `json:"srcIp,omitempty"`
+	DstIP    string  `json:"dstIp,omitempty"`
+	SrcPort  int     `json:"srcPort,omitempty"`
+	DstPort  int     `json:"dstPort,omitempty"`
+	Protocol string  `json:"protocol,omitempty"`
+	IMSI     string  `json:"imsi,omitempty"`
+	TEID     *uint32 `json:"teid,omitempty"`
+}
+
+// normalizeSelection validates a selection and returns it with the time
+// window of the query, the files sorted and deduplicated and the addresses
+// and protocol in canonical form.
+func (d *Datasource) normalizeSelection(selection FlowSelection, timeRange backend.TimeRange) (*FlowSelection, error) {
+	var problems []string
+
+	switch {
+	case len(selection.Files) > 0 && selection.S3Prefix != "":
+		problems = append(problems, "files and s3Prefix cannot be combined")
+	case len(selection.Files) > 0:
+		files := slices.Clone(selection.Files)
+		slices.Sort(files)
+		selection.Files = slices.Compact(files)
+		for _, file := range selection.Files {
+			if err := d.validateSourceFile(file); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+	case selection.S3Prefix != "":
+		if err := d.validateSourcePrefix(selection.S3Prefix); err != nil {
+			problems = append(problems, err.Error())
+		}
+	default:
+		problems = append(problems, "files or s3Prefix is required")
+	}
+
+	if timeRange.From.IsZero() || timeRange.To.IsZero() || !timeRange.From.Before(timeRange.To) {
+		problems = append(problems, "a time range is required")
+	}
+	selection.From, selection.To = timeRange.From.UTC(), timeRange.To.UTC()
+
+	for _, ip := range []*string{&selection.SrcIP, &selection.DstIP} {
+		if *ip == "" {
+			continue
+		}
+		addr, err := netip.ParseAddr(*ip)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("invalid IP address %q", *ip))
+			continue
+		}
+		*ip = addr.String()
+	}
+	for _, port := range []int{selection.SrcPort, selection.DstPort} {
+		if port < 0 || port > 65535 {
+			problems = append(problems, fmt.Sprintf("invalid port %d", port))
+		}
+	}
+	if selection.Protocol != "" {
+		selection.Protocol = strings.ToLower(selection.Protocol)
+		if !slices.Contains(selectionProtocols, selection.Protocol) {
+			problems = append(problems, fmt.Sprintf("invalid protocol %q, expected one of %s", selection.Protocol, strings.Join(selectionProtocols, ", ")))
+		}
+	}
+	if selection.IMSI != "" && !imsiPattern.MatchString(selection.IMSI) {
+		problems = append(problems, "invalid IMSI, expected 6 to 15 digits")
+	}
+
+	if len(problems) > 0 {
+		return nil, &ExtractError{Problems: problems, selection: true}
+	}
+	return &selection, nil
+}
+
+// criteria returns the names of the flow criteria of the selection.
+func (s *FlowSelection) criteria() []string {
+	var criteria []string
+	for _, c := range []struct {
+		name string
+		set  bool
+	}{
+		{"srcIp", s.SrcIP != ""},
+		{"dstIp", s.DstIP != ""},
+		{"srcPort", s.SrcPort != 0},
+		{"dstPort", s.DstPort != 0},
+		{"protocol", s.Protocol != ""},
+		{"imsi", s.IMSI != ""},
+		{"teid", s.TEID != nil},
+	} {
+		if c.set {
+			criteria = append(criteria, c.name)
+		}
+	}
+	return criteria
+}
+
+// logArgs returns the selection as key value pairs for a log line. The
+// values of the flow criteria identify subscribers and are left out.
+func (s *FlowSelection) logArgs() []interface{} {
+	return []interface{}{"files", len(s.Files), "s3Prefix", s.S3Prefix, "from", s.From, "to", s.To, "criteria", strings.Join(s.criteria(), ",")}
+}
+
+// checkSourcePrefix verifies that there are source files below a prefix in
+// the source bucket of its target.
+func (d *Datasource) checkSourcePrefix(ctx context.Context, prefix string) error {
+	if !d.settings.CheckSourceFiles {
+		return nil
+	}
+	view, err := d.forTarget(d.routeKey(prefix))
+	if err != nil {
+		return err
+	}
+	if view.s3Client == nil {
+		return nil
+	}
+	result, err := view.s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket:  aws.String(view.sourceBucket()),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int32(1),
+	})
+	if err != nil {
+		return err
+	}
+	if len(result.Contents) == 0 {
+		return &ExtractError{Problems: []string{fmt.Sprintf("there are no source files below %q", prefix)}, selection: true}
+	}
+	return nil
+}
+
+// countSelectionFiles counts the source files of a selection for the limit
+// of files per request. Files below a prefix are counted up to one more than
+// the limit.
+func (d *Datasource) countSelectionFiles(ctx context.Context, selection *FlowSelection, limit int) (int, error) {
+	if selection.S3Prefix == "" {
+		return len(selection.Files), nil
+	}
+	if limit <= 0 {
+		return 0, nil
+	}
+	view, err := d.forTarget(d.routeKey(selection.S3Prefix))
+	if err != nil {
+		return 0, err
+	}
+	if view.s3Client == nil {
+		return 0, fmt.Errorf("the source files below %q cannot be counted without an S3 client", selection.S3Prefix)
+	}
+	files := 0
+	paginator := s3.NewListObjectsV2Paginator(view.s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(view.sourceBucket()),
+		Prefix: aws.String(selection.S3Prefix),
+	})
+	for paginator.HasMorePages() && files <= limit {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return 0, err
+		}
+		files += len(page.Contents)
+	}
+	return files, nil
+}
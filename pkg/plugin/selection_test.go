@@ -0,0 +1,127 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	"github.com/emnify/pcap-extractor/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeSelection(t *testing.T) {
+	from := time.Date(2025, 10, 30, 12, 0, 0, 0, time.UTC)
+	window := backend.TimeRange{From: from, To: from.Add(15 * time.Minute)}
+	teid := uint32(0x1234)
+
+	tests := []struct {
+		name      string
+		selection FlowSelection
+		timeRange backend.TimeRange
+		expected  *FlowSelection
+		problems  []string
+	}{
+		{
+			name:      "files and flow",
+			selection: FlowSelection{Files: []string{"b.pcap", "a.pcap", "b.pcap"}, SrcIP: "2001:db8::0:1", DstPort: 2152, Protocol: "UDP", IMSI: "901405100000001", TEID: &teid},
+			timeRange: window,
+			expected:  &FlowSelection{Files: []string{"a.pcap", "b.pcap"}, From: window.From, To: window.To, SrcIP: "2001:db8::1", DstPort: 2152, Protocol: "udp", IMSI: "901405100000001", TEID: &teid},
+		},
+		{
+			name:      "prefix",
+			selection: FlowSelection{S3Prefix: "captures/2025/"},
+			timeRange: window,
+			expected:  &FlowSelection{S3Prefix: "captures/2025/", From: window.From, To: window.To},
+		},
+		{
+			name:      "no source and no time range",
+			selection: FlowSelection{IMSI: "9014"},
+			problems:  []string{"files or s3Prefix is required", "a time range is required", "invalid IMSI, expected 6 to 15 digits"},
+		},
+		{
+			name:      "invalid criteria",
+			selection: FlowSelection{Files: []string{"a.pcap"}, S3Prefix: "../", SrcIP: "10.0.0.300", SrcPort: 70000, Protocol: "gre"},
+			timeRange: backend.TimeRange{From: window.To, To: window.From},
+			problems: []string{
+				"files and s3Prefix cannot be combined",
+				"a time range is required",
+				`invalid IP address "10.0.0.300"`,
+				"invalid port 70000",
+				`invalid protocol "gre", expected one of tcp, udp, sctp, icmp`,
+			},
+		},
+		{
+			name:      "traversal in prefix",
+			selection: FlowSelection{S3Prefix: "captures/../secrets/"},
+			timeRange: window,
+			problems:  []string{`source prefix "captures/../secrets/" must not contain empty, '.' or '..' path segments`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := &Datasource{settings: &models.PluginSettings{}}
+			selection, err := ds.normalizeSelection(tt.selection, tt.timeRange)
+			if tt.problems == nil {
+				require.NoError(t, err)
+				assert.Equal(t, tt.expected, selection)
+				return
+			}
+			var extractErr *ExtractError
+			require.True(t, errors.As(err, &extractErr))
+			assert.Equal(t, tt.problems, extractErr.Problems)
+			assert.Contains(t, err.Error(), "Invalid selection: ")
+		})
+	}
+}
+
+func TestRequestActionWithSelection(t *testing.T) {
+	from := time.Date(2025, 10, 30, 12, 0, 0, 0, time.UTC)
+	settings := authzSettings()
+	settings.CheckSourceFiles = true
+
+	mockS3Client := &MockS3Client{}
+	mockS3Client.On("ListObjectsV2", mock.Anything, mock.MatchedBy(func(input *s3.ListObjectsV2Input) bool {
+		return *input.Prefix == "empty/"
+	})).Return(&s3.ListObjectsV2Output{}, nil)
+	mockS3Client.On("ListObjectsV2", mock.Anything, mock.Anything).Return(&s3.ListObjectsV2Output{
+		Contents: []s3types.Object{{Key: aws.String("captures/a.pcap")}},
+	}, nil)
+	mockS3Client.On("PutObject", mock.Anything, mock.Anything).Return(&s3.PutObjectOutput{}, nil)
+	mockSFNClient := &MockSFNClient{}
+	mockSFNClient.On("StartExecution", mock.Anything, mock.Anything).Return(&sfn.StartExecutionOutput{ExecutionArn: aws.String("arn")}, nil)
+	ds := &Datasource{settings: settings, sfnClient: mockSFNClient, s3Client: mockS3Client}
+
+	run := func(query string) backend.DataResponse {
+		var qm queryModel
+		require.NoError(t, json.Unmarshal([]byte(query), &qm))
+		qm.TimeRange = backend.TimeRange{From: from, To: from.Add(15 * time.Minute)}
+		return ds.handleRequestAction(userContext("jdoe", "Editor", 1), qm)
+	}
+
+	resp := run(`{"action": "request", "JobId": "test-job-123", "selection": {"s3Prefix": "empty/", "imsi": "901405100000001"}}`)
+	require.Error(t, resp.Error)
+	assert.Equal(t, `Invalid selection: there are no source files below "empty/"`, resp.Error.Error())
+
+	resp = run(`{"action": "request", "JobId": "test-job-123", "Extract": {"a.pcap": [1]}, "selection": {"s3Prefix": "captures/"}}`)
+	require.Error(t, resp.Error)
+	assert.Equal(t, "Extract, selection and upstream cannot be combined in one request", resp.Error.Error())
+
+	resp = run(`{"action": "request", "JobId": "test-job-123", "selection": {"s3Prefix": "captures/", "imsi": "901405100000001"}}`)
+	require.NoError(t, resp.Error)
+
+	params := mockSFNClient.Calls[0].Arguments.Get(1).(*sfn.StartExecutionInput)
+	assert.JSONEq(t, `{
+		"jobId": "test-job-123",
+		"bucket": "test-bucket",
+		"selection": {"s3Prefix": "captures/", "from": "2025-10-30T12:00:00Z", "to": "2025-10-30T12:15:00Z", "imsi": "901405100000001"}
+	}`, *params.Input)
+}
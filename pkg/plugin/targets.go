@@ -0,0 +1,356 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	sfntypes "github.com/aws/aws-sdk-go-v2/service/sfn/types"
+	"github.com/emnify/pcap-extractor/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// extractionTarget is a state machine with its buckets and the clients of
+// its region.
+type extractionTarget struct {
+	models.Target
+	sfnClient     SFNClientInterface
+	s3Client      S3ClientInterface
+	s3Presigner   S3PresignerInterface
+	s3Credentials aws.CredentialsProvider
+}
+
+// SubJob is the part of a job that runs on one target. Jobs whose source
+// files all go to one target run as a single sub-job under the ID of the job.
+type SubJob struct {
+	Target  string `json:"target"`
+	JobId   string `json:"jobId"`
+	Files   int    `json:"files"`
+	Packets int    `json:"packets"`
+}
+
+// plannedJob is a sub-job of a request with the input of its execution.
+type plannedJob struct {
+	SubJob
+	input StepFunctionInput
+}
+
+// routeKey returns the name of the target a source file or prefix goes to.
+func (d *Datasource) routeKey(key string) string {
+	for _, target := range d.targets {
+		if slices.ContainsFunc(target.SourcePrefixes, func(prefix string) bool {
+			return strings.HasPrefix(key, prefix)
+		}) {
+			return target.Name
+		}
+	}
+	return models.DefaultTargetName
+}
+
+// routeFiles groups source files by the target they go to, in the order the
+// targets are first used.
+func (d *Datasource) routeFiles(files []string) ([]string, map[string][]string) {
+	var names []string
+	routed := map[string][]string{}
+	for _, file := range files {
+		name := d.routeKey(file)
+		if _, ok := routed[name]; !ok {
+			names = append(names, name)
+		}
+		routed[name] = append(routed[name], file)
+	}
+	return names, routed
+}
+
+// forTarget returns a view of the data source that runs jobs with the state
+// machine, the buckets and the clients of a target. Job metadata, audit
+// events and quotas are kept by the data source itself, never by a view.
+func (d *Datasource) forTarget(name string) (*Datasource, error) {
+	if name == "" || name == models.DefaultTargetName {
+		return d, nil
+	}
+	i := slices.IndexFunc(d.targets, func(target *extractionTarget) bool { return target.Name == name })
+	if i < 0 {
+		return nil, fmt.Errorf("unknown target '%s'", name)
+	}
+	target := d.targets[i]
+
+	settings := *d.settings
+	settings.StepFunctionArn, settings.S3Bucket, settings.SourceBucket = target.StepFunctionArn, target.S3Bucket, target.SourceBucket
+	view := *d
+	view.settings = &settings
+	view.targets = nil
+	view.sfnClient, view.s3Client, view.s3Presigner = target.sfnClient, target.s3Client, target.s3Presigner
+	view.s3Credentials = target.s3Credentials
+	return &view, nil
+}
+
+// targetView is the view of a target with the name of the target.
+type targetView struct {
+	name string
+	view *Datasource
+}
+
+// targetViews returns the views of all targets, the default one first.
+func (d *Datasource) targetViews() []targetView {
+	views := []targetView{{name: models.DefaultTargetName, view: d}}
+	for _, target := range d.targets {
+		view, err := d.forTarget(target.Name)
+		if err != nil {
+			continue
+		}
+		views = append(views, targetView{name: target.Name, view: view})
+	}
+	return views
+}
+
+// planJobs splits the extract or the selection of a request into one sub-job
+// per target. A request that goes to a single target is not split.
+func (d *Datasource) planJobs(qm queryModel, input StepFunctionInput) ([]plannedJob, error) {
+	var names []string
+	parts := map[string]StepFunctionInput{}
+	switch {
+	case qm.Selection != nil && qm.Selection.S3Prefix != "":
+		name := d.routeKey(qm.Selection.S3Prefix)
+		names, parts[name] = []string{name}, input
+	case qm.Selection != nil:
+		var routed map[string][]string
+		names, routed = d.routeFiles(qm.Selection.Files)
+		for _, name := range names {
+			selection := *qm.Selection
+			selection.Files = routed[name]
+			part := input
+			part.Selection = &selection
+			parts[name] = part
+		}
+	default:
+		files := qm.FileOrder
+		if len(files) == 0 {
+			files = slices.Sorted(maps.Keys(qm.Extract))
+		}
+		var routed map[string][]string
+		names, routed = d.routeFiles(files)
+		for _, name := range names {
+			part := input
+			part.Extract = map[string][]int{}
+			for _, file := range routed[name] {
+				part.Extract[file] = qm.Extract[file]
+			}
+			if len(qm.FileOrder) > 0 {
+				part.FileOrder = routed[name]
+			}
+			parts[name] = part
+		}
+	}
+
+	jobs := make([]plannedJob, 0, len(names))
+	for _, name := range names {
+		view, err := d.forTarget(name)
+		if err != nil {
+			return nil, err
+		}
+		job := plannedJob{SubJob: SubJob{Target: name, JobId: qm.JobId}, input: parts[name]}
+		if len(names) > 1 {
+			job.JobId = qm.JobId + "-" + name
+			if err := validateJobId(job.JobId); err != nil {
+				return nil, fmt.Errorf("the job is split across targets and its ID is too long for sub-job IDs: %w", err)
+			}
+		}
+		job.input.JobId = job.JobId
+		job.input.Bucket = view.settings.S3Bucket
+		if job.input.Selection != nil {
+			job.Files = len(job.input.Selection.Files)
+		}
+		job.Files += len(job.input.Extract)
+		for _, packets := range job.input.Extract {
+			job.Packets += len(packets)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// startedSubJob is a sub-job whose execution has been started.
+type startedSubJob struct {
+	SubJob
+	view         *Datasource
+	executionArn string
+}
+
+// stopSubJobs stops the sub-jobs started for a request after the sub-job of
+// a later target failed to start, and returns the targets of the sub-jobs
+// that could not be stopped. Every attempt to stop a sub-job is audited.
+func (d *Datasource) stopSubJobs(ctx context.Context, started []startedSubJob, failedTarget string) []string {
+	var running []string
+	for _, job := range started {
+		event := newAuditEvent(ctx, auditActionStop, job.JobId)
+		event.Files, event.Packets = job.Files, job.Packets
+
+		_, err := job.view.sfnClient.StopExecution(ctx, &sfn.StopExecutionInput{
+			ExecutionArn: aws.String(job.executionArn),
+			Error:        aws.String("SubJobNotStarted"),
+			Cause:        aws.String(fmt.Sprintf("the sub-job of target '%s' failed to start", failedTarget)),
+		})
+		if err != nil {
+			d.log(ctx).Error("Failed to stop sub-job", "error", err, "target", job.Target, "executionArn", job.executionArn)
+			event.fail(fmt.Sprintf("failed to stop the sub-job of target '%s', it keeps running: %s", job.Target, err))
+			d.emitAudit(ctx, event)
+			running = append(running, job.Target)
+			continue
+		}
+		d.cache.invalidate(job.executionArn)
+		d.emitAudit(ctx, event)
+	}
+	return running
+}
+
+// subJobs returns the sub-jobs of a job. Jobs without sub-jobs in their
+// metadata ran on the default target.
+func subJobs(jobId string, meta *JobMetadata) []SubJob {
+	if meta != nil && len(meta.SubJobs) > 0 {
+		return meta.SubJobs
+	}
+	job := SubJob{Target: models.DefaultTargetName, JobId: jobId}
+	if meta != nil {
+		job.Files, job.Packets = meta.Files, meta.Packets
+	}
+	return []SubJob{job}
+}
+
+// jobTarget returns the view of the target a job ran on and the ID of its
+// execution. Jobs split across targets have no single execution.
+func (d *Datasource) jobTarget(jobId string, meta *JobMetadata) (*Datasource, string, error) {
+	jobs := subJobs(jobId, meta)
+	if len(jobs) > 1 {
+		return nil, "", fmt.Errorf("job '%s' is split across the targets %s, this is only supported for its status", jobId, strings.Join(subJobTargets(jobs), ", "))
+	}
+	view, err := d.forTarget(jobs[0].Target)
+	return view, jobs[0].JobId, err
+}
+
+func subJobTargets(jobs []SubJob) []string {
+	names := make([]string, len(jobs))
+	for i, job := range jobs {
+		names[i] = job.Target
+	}
+	return names
+}
+
+// subJobState is the execution of a sub-job.
+type subJobState struct {
+	SubJob
+	view         *Datasource
+	executionArn string
+	result       *sfn.DescribeExecutionOutput
+}
+
+// describeSubJobs describes the executions of the sub-jobs of a job.
+func (d *Datasource) describeSubJobs(ctx context.Context, jobs []SubJob) ([]*subJobState, error) {
+	states := make([]*subJobState, 0, len(jobs))
+	for _, job := range jobs {
+		view, err := d.forTarget(job.Target)
+		if err != nil {
+			return nil, err
+		}
+		executionArn, err := view.executionArn(job.JobId)
+		if err != nil {
+			return nil, err
+		}
+		result, err := view.describeExecution(ctx, executionArn)
+		if err != nil && view != d {
+			return nil, fmt.Errorf("failed to describe the execution of target '%s': %w", job.Target, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, &subJobState{SubJob: job, view: view, executionArn: executionArn, result: result})
+	}
+	return states, nil
+}
+
+// aggregateExecutions combines the executions of the sub-jobs of a job into
+// the execution of the job. The job runs while any sub-job runs, and else
+// ended like the sub-job that ended worst. Errors name the target they
+// occurred on.
+func aggregateExecutions(states []*subJobState) *sfn.DescribeExecutionOutput {
+	if len(states) == 1 {
+		return states[0].result
+	}
+
+	severity := func(status sfntypes.ExecutionStatus) int {
+		return slices.Index([]sfntypes.ExecutionStatus{
+			sfntypes.ExecutionStatusSucceeded,
+			sfntypes.ExecutionStatusAborted,
+			sfntypes.ExecutionStatusTimedOut,
+			sfntypes.ExecutionStatusFailed,
+			sfntypes.ExecutionStatusPendingRedrive,
+			sfntypes.ExecutionStatusRunning,
+		}, status)
+	}
+
+	job := &sfn.DescribeExecutionOutput{Status: sfntypes.ExecutionStatusSucceeded}
+	running := false
+	for _, state := range states {
+		result := state.result
+		if severity(result.Status) > severity(job.Status) {
+			job.Status = result.Status
+		}
+		switch result.Status {
+		case sfntypes.ExecutionStatusRunning, sfntypes.ExecutionStatusPendingRedrive:
+			running = true
+		case sfntypes.ExecutionStatusFailed, sfntypes.ExecutionStatusTimedOut, sfntypes.ExecutionStatusAborted:
+			if job.Error == nil && result.Error != nil {
+				job.Error = prefixTarget(state.Target, *result.Error)
+			}
+			if job.Cause == nil && result.Cause != nil {
+				job.Cause = prefixTarget(state.Target, *result.Cause)
+			}
+		}
+		if result.StartDate != nil && (job.StartDate == nil || result.StartDate.Before(*job.StartDate)) {
+			job.StartDate = result.StartDate
+		}
+		if result.StopDate != nil && (job.StopDate == nil || result.StopDate.After(*job.StopDate)) {
+			job.StopDate = result.StopDate
+		}
+	}
+	if running {
+		job.StopDate = nil
+	}
+	return job
+}
+
+func prefixTarget(target, text string) *string {
+	text = fmt.Sprintf("%s: %s", target, text)
+	return &text
+}
+
+// subJobsFrame returns a frame with one row per sub-job of a job split
+// across targets, with the download URLs of the sub-jobs that succeeded.
+func subJobsFrame(states []*subJobState, urls []string) *data.Frame {
+	var (
+		targets, jobIds, statuses, errorTexts, arns []string
+		stopDates                                   []*time.Time
+	)
+	for _, state := range states {
+		targets = append(targets, state.Target)
+		jobIds = append(jobIds, state.JobId)
+		statuses = append(statuses, string(state.result.Status))
+		errorTexts = append(errorTexts, aws.ToString(state.result.Error))
+		arns = append(arns, state.executionArn)
+		stopDates = append(stopDates, state.result.StopDate)
+	}
+	return data.NewFrame("step_function_sub_jobs",
+		data.NewField("target", nil, targets),
+		data.NewField("job_id", nil, jobIds),
+		data.NewField("status", nil, statuses),
+		data.NewField("error", nil, errorTexts),
+		data.NewField("stop_date", nil, stopDates),
+		data.NewField("execution_arn", nil, arns),
+		data.NewField("download_url", nil, urls),
+	)
+}
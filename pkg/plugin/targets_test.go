@@ -0,0 +1,376 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	sfntypes "github.com/aws/aws-sdk-go-v2/service/sfn/types"
+	"github.com/emnify/pcap-extractor/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// euTarget returns a target for the source files below "eu/" with its mocks.
+func euTarget() (*extractionTarget, *MockSFNClient, *MockS3Client, *MockS3Presigner) {
+	sfnClient, s3Client, presigner := &MockSFNClient{}, &MockS3Client{}, &MockS3Presigner{}
+	return &extractionTarget{
+		Target: models.Target{
+			Name:            "eu",
+			Region:          "eu-west-1",
+			StepFunctionArn: "arn:aws:states:eu-west-1:123456789012:stateMachine:eu-extractor",
+			S3Bucket:        "eu-bucket",
+			SourceBucket:    "eu-captures",
+			SourcePrefixes:  []string{"eu/"},
+		},
+		sfnClient:   sfnClient,
+		s3Client:    s3Client,
+		s3Presigner: presigner,
+	}, sfnClient, s3Client, presigner
+}
+
+func TestPlanJobs(t *testing.T) {
+	target, _, _, _ := euTarget()
+	ds := &Datasource{settings: authzSettings(), targets: []*extractionTarget{target}}
+
+	plan := func(qm queryModel) []plannedJob {
+		jobs, err := ds.planJobs(qm, StepFunctionInput{JobId: qm.JobId, Extract: qm.Extract, FileOrder: qm.FileOrder, Selection: qm.Selection, Bucket: "test-bucket"})
+		require.NoError(t, err)
+		return jobs
+	}
+
+	// Files of a single target are not split
+	jobs := plan(queryModel{JobId: "job-1", Extract: map[string][]int{"eu/a.pcap": {1, 2}}})
+	require.Len(t, jobs, 1)
+	assert.Equal(t, SubJob{Target: "eu", JobId: "job-1", Files: 1, Packets: 2}, jobs[0].SubJob)
+	assert.Equal(t, "eu-bucket", jobs[0].input.Bucket)
+
+	// Files of several targets are split, keeping their order
+	jobs = plan(queryModel{
+		JobId:     "job-2",
+		Extract:   map[string][]int{"eu/a.pcap": {1}, "us/b.pcap": {2, 3}, "eu/c.pcap": {4}},
+		FileOrder: []string{"us/b.pcap", "eu/c.pcap", "eu/a.pcap"},
+	})
+	require.Len(t, jobs, 2)
+	assert.Equal(t, SubJob{Target: "default", JobId: "job-2-default", Files: 1, Packets: 2}, jobs[0].SubJob)
+	assert.Equal(t, StepFunctionInput{JobId: "job-2-default", Bucket: "test-bucket", Extract: map[string][]int{"us/b.pcap": {2, 3}}, FileOrder: []string{"us/b.pcap"}}, jobs[0].input)
+	assert.Equal(t, SubJob{Target: "eu", JobId: "job-2-eu", Files: 2, Packets: 2}, jobs[1].SubJob)
+	assert.Equal(t, StepFunctionInput{JobId: "job-2-eu", Bucket: "eu-bucket", Extract: map[string][]int{"eu/a.pcap": {1}, "eu/c.pcap": {4}}, FileOrder: []string{"eu/c.pcap", "eu/a.pcap"}}, jobs[1].input)
+
+	// Selections are split by their files, or routed by their prefix
+	jobs = plan(queryModel{JobId: "job-3", Selection: &FlowSelection{Files: []string{"eu/a.pcap", "us/b.pcap"}, IMSI: "901405100000001"}})
+	require.Len(t, jobs, 2)
+	assert.Equal(t, &FlowSelection{Files: []string{"eu/a.pcap"}, IMSI: "901405100000001"}, jobs[0].input.Selection)
+	assert.Equal(t, &FlowSelection{Files: []string{"us/b.pcap"}, IMSI: "901405100000001"}, jobs[1].input.Selection)
+
+	jobs = plan(queryModel{JobId: "job-4", Selection: &FlowSelection{S3Prefix: "eu/2025/"}})
+	require.Len(t, jobs, 1)
+	assert.Equal(t, "eu", jobs[0].Target)
+
+	// Sub-job IDs must remain valid execution names
+	_, err := ds.planJobs(queryModel{JobId: string(make([]byte, 80)), Extract: map[string][]int{"eu/a.pcap": {1}, "us/b.pcap": {1}}}, StepFunctionInput{})
+	assert.ErrorContains(t, err, "too long for sub-job IDs")
+}
+
+func TestAggregateExecutions(t *testing.T) {
+	start := time.Date(2025, 10, 30, 12, 0, 0, 0, time.UTC)
+	execution := func(status sfntypes.ExecutionStatus, startOffset, stopOffset time.Duration, errorText string) *sfn.DescribeExecutionOutput {
+		result := &sfn.DescribeExecutionOutput{Status: status, StartDate: aws.Time(start.Add(startOffset))}
+		if stopOffset > 0 {
+			result.StopDate = aws.Time(start.Add(stopOffset))
+		}
+		if errorText != "" {
+			result.Error = aws.String(errorText)
+		}
+		return result
+	}
+	states := func(results ...*sfn.DescribeExecutionOutput) []*subJobState {
+		var states []*subJobState
+		for i, result := range results {
+			states = append(states, &subJobState{SubJob: SubJob{Target: []string{"default", "eu", "us"}[i]}, result: result})
+		}
+		return states
+	}
+
+	result := aggregateExecutions(states(
+		execution(sfntypes.ExecutionStatusSucceeded, time.Minute, 3*time.Minute, ""),
+		execution(sfntypes.ExecutionStatusSucceeded, 0, 2*time.Minute, ""),
+	))
+	assert.Equal(t, sfntypes.ExecutionStatusSucceeded, result.Status)
+	assert.Equal(t, start, *result.StartDate)
+	assert.Equal(t, start.Add(3*time.Minute), *result.StopDate)
+
+	result = aggregateExecutions(states(
+		execution(sfntypes.ExecutionStatusSucceeded, 0, time.Minute, ""),
+		execution(sfntypes.ExecutionStatusFailed, 0, time.Minute, "States.TaskFailed"),
+		execution(sfntypes.ExecutionStatusTimedOut, 0, time.Minute, "States.Timeout"),
+	))
+	assert.Equal(t, sfntypes.ExecutionStatusFailed, result.Status)
+	assert.Equal(t, "eu: States.TaskFailed", *result.Error)
+
+	result = aggregateExecutions(states(
+		execution(sfntypes.ExecutionStatusFailed, 0, time.Minute, "States.TaskFailed"),
+		execution(sfntypes.ExecutionStatusRunning, 0, 0, ""),
+	))
+	assert.Equal(t, sfntypes.ExecutionStatusRunning, result.Status)
+	assert.Nil(t, result.StopDate)
+}
+
+func TestRequestActionAcrossTargets(t *testing.T) {
+	target, euSFN, euS3, _ := euTarget()
+	euS3.On("HeadObject", mock.Anything, mock.MatchedBy(func(input *s3.HeadObjectInput) bool {
+		return *input.Bucket == "eu-captures" && *input.Key == "eu/missing.pcap"
+	})).Return(nil, apiError("NotFound", "Not Found"))
+	euS3.On("HeadObject", mock.Anything, mock.Anything).Return(&s3.HeadObjectOutput{}, nil)
+	euSFN.On("StartExecution", mock.Anything, mock.Anything).Return(&sfn.StartExecutionOutput{ExecutionArn: aws.String("eu-arn")}, nil)
+
+	mockS3Client := &MockS3Client{}
+	mockS3Client.On("HeadObject", mock.Anything, mock.Anything).Return(&s3.HeadObjectOutput{}, nil)
+	mockS3Client.On("PutObject", mock.Anything, mock.Anything).Return(&s3.PutObjectOutput{}, nil)
+	mockSFNClient := &MockSFNClient{}
+	mockSFNClient.On("StartExecution", mock.Anything, mock.Anything).Return(&sfn.StartExecutionOutput{ExecutionArn: aws.String("arn")}, nil)
+
+	settings := authzSettings()
+	settings.CheckSourceFiles = true
+	ds := &Datasource{settings: settings, sfnClient: mockSFNClient, s3Client: mockS3Client, targets: []*extractionTarget{target}}
+	ctx := userContext("jdoe", "Editor", 1)
+
+	// Source files are looked up in the source bucket of their target
+	resp := ds.handleRequestAction(ctx, queryModel{Action: "request", JobId: "job-1", Extract: map[string][]int{"us/a.pcap": {1}, "eu/missing.pcap": {1}}})
+	require.Error(t, resp.Error)
+	assert.Equal(t, `Invalid extract: source file "eu/missing.pcap" does not exist`, resp.Error.Error())
+
+	resp = ds.handleRequestAction(ctx, queryModel{Action: "request", JobId: "job-1", Extract: map[string][]int{"us/a.pcap": {1}, "eu/b.pcap": {2, 3}}})
+	require.NoError(t, resp.Error)
+
+	params := mockSFNClient.Calls[0].Arguments.Get(1).(*sfn.StartExecutionInput)
+	assert.Equal(t, "job-1-default", *params.Name)
+	assert.JSONEq(t, `{"jobId": "job-1-default", "bucket": "test-bucket", "extract": {"us/a.pcap": [1]}}`, *params.Input)
+	params = euSFN.Calls[0].Arguments.Get(1).(*sfn.StartExecutionInput)
+	assert.Equal(t, "job-1-eu", *params.Name)
+	assert.Equal(t, target.StepFunctionArn, *params.StateMachineArn)
+	assert.JSONEq(t, `{"jobId": "job-1-eu", "bucket": "eu-bucket", "extract": {"eu/b.pcap": [2, 3]}}`, *params.Input)
+
+	// The job is recorded with its sub-jobs in the bucket of the data source
+	var meta JobMetadata
+	for _, call := range mockS3Client.Calls {
+		if input, ok := call.Arguments.Get(1).(*s3.PutObjectInput); ok && *input.Key == metadataKey("job-1") {
+			assert.Equal(t, "test-bucket", *input.Bucket)
+			body, err := io.ReadAll(input.Body)
+			require.NoError(t, err)
+			require.NoError(t, json.Unmarshal(body, &meta))
+		}
+	}
+	assert.Equal(t, []SubJob{
+		{Target: "eu", JobId: "job-1-eu", Files: 1, Packets: 2},
+		{Target: "default", JobId: "job-1-default", Files: 1, Packets: 1},
+	}, meta.SubJobs)
+	euS3.AssertNotCalled(t, "PutObject", mock.Anything, mock.Anything)
+}
+
+func TestRequestActionStopsStartedSubJobs(t *testing.T) {
+	tests := []struct {
+		name    string
+		stopErr error
+		message string
+		outcome string
+	}{
+		{
+			name:    "stopped",
+			outcome: auditOutcomeSuccess,
+			message: "Step Function execution of target 'default' failed: Access denied by AWS, check the IAM permissions of the data source: not allowed",
+		},
+		{
+			name:    "stop fails",
+			stopErr: apiError("ThrottlingException", "Rate exceeded"),
+			outcome: auditOutcomeFailure,
+			message: "Step Function execution of target 'default' failed, the sub-jobs on the targets eu could not be stopped and keep running: Access denied by AWS, check the IAM permissions of the data source: not allowed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, euSFN, _, _ := euTarget()
+			euSFN.On("StartExecution", mock.Anything, mock.Anything).Return(&sfn.StartExecutionOutput{ExecutionArn: aws.String("eu-arn")}, nil)
+			euSFN.On("StopExecution", mock.Anything, mock.MatchedBy(func(input *sfn.StopExecutionInput) bool {
+				return *input.ExecutionArn == "eu-arn"
+			})).Return(&sfn.StopExecutionOutput{}, tt.stopErr)
+
+			var stopEvents []AuditEvent
+			mockS3Client := &MockS3Client{}
+			mockS3Client.On("PutObject", mock.Anything, mock.MatchedBy(func(input *s3.PutObjectInput) bool {
+				return strings.Contains(*input.Key, "-stop-")
+			})).Run(func(args mock.Arguments) {
+				var event AuditEvent
+				require.NoError(t, json.NewDecoder(args.Get(1).(*s3.PutObjectInput).Body).Decode(&event))
+				stopEvents = append(stopEvents, event)
+			}).Return(&s3.PutObjectOutput{}, nil)
+			mockS3Client.On("PutObject", mock.Anything, mock.Anything).Return(&s3.PutObjectOutput{}, nil)
+			mockSFNClient := &MockSFNClient{}
+			mockSFNClient.On("StartExecution", mock.Anything, mock.Anything).Return(nil, apiError("AccessDeniedException", "not allowed"))
+
+			settings := authzSettings()
+			settings.AuditS3Prefix = "audit/"
+			ds := &Datasource{settings: settings, sfnClient: mockSFNClient, s3Client: mockS3Client, targets: []*extractionTarget{target}}
+
+			resp := ds.handleRequestAction(userContext("jdoe", "Editor", 1), queryModel{Action: "request", JobId: "job-1", Extract: map[string][]int{"us/a.pcap": {1}, "eu/b.pcap": {2}}})
+			require.Error(t, resp.Error)
+			assert.Equal(t, tt.message, resp.Error.Error())
+			euSFN.AssertExpectations(t)
+
+			// Stopping the started sub-job is audited with its outcome
+			require.Len(t, stopEvents, 1)
+			assert.Equal(t, "job-1-eu", stopEvents[0].JobId)
+			assert.Equal(t, "jdoe", stopEvents[0].UserLogin)
+			assert.Equal(t, tt.outcome, stopEvents[0].Outcome)
+			assert.Equal(t, 1, stopEvents[0].Packets)
+		})
+	}
+}
+
+func TestStatusActionAcrossTargets(t *testing.T) {
+	target, euSFN, euS3, euPresigner := euTarget()
+	meta := `{"jobId": "job-1", "orgId": 1, "user": {"login": "jdoe"}, "files": 2, "packets": 3, "subJobs": [
+		{"target": "default", "jobId": "job-1-default", "files": 1, "packets": 1},
+		{"target": "eu", "jobId": "job-1-eu", "files": 1, "packets": 2}
+	]}`
+
+	mockS3Client := &MockS3Client{}
+	mockS3Client.On("GetObject", mock.Anything, matchKey("job-1.meta.json")).Return(objectBody(meta), nil)
+	mockS3Client.On("HeadObject", mock.Anything, mock.Anything).Return(&s3.HeadObjectOutput{}, nil)
+	mockSFNClient := &MockSFNClient{}
+	mockSFNClient.On("DescribeExecution", mock.Anything, mock.Anything).Return(&sfn.DescribeExecutionOutput{
+		Status:    sfntypes.ExecutionStatusSucceeded,
+		StartDate: aws.Time(time.Unix(0, 0)),
+		StopDate:  aws.Time(time.Unix(60, 0)),
+	}, nil)
+	mockPresigner := &MockS3Presigner{}
+	mockPresigner.On("PresignGetObject", mock.Anything, mock.Anything).Return(&v4.PresignedHTTPRequest{URL: "https://test-bucket/job-1-default.pcapng"}, nil)
+
+	euSFN.On("DescribeExecution", mock.Anything, mock.Anything).Return(&sfn.DescribeExecutionOutput{
+		Status:    sfntypes.ExecutionStatusSucceeded,
+		StartDate: aws.Time(time.Unix(10, 0)),
+		StopDate:  aws.Time(time.Unix(90, 0)),
+	}, nil)
+	euS3.On("HeadObject", mock.Anything, mock.Anything).Return(&s3.HeadObjectOutput{}, nil)
+	euPresigner.On("PresignGetObject", mock.Anything, mock.MatchedBy(func(input *s3.GetObjectInput) bool {
+		return *input.Bucket == "eu-bucket" && *input.Key == "job-1-eu.pcapng"
+	})).Return(&v4.PresignedHTTPRequest{URL: "https://eu-bucket/job-1-eu.pcapng"}, nil)
+
+	ds := &Datasource{settings: authzSettings(), sfnClient: mockSFNClient, s3Client: mockS3Client, s3Presigner: mockPresigner, targets: []*extractionTarget{target}}
+	resp := ds.handleStatusAction(userContext("jdoe", "Admin", 1), queryModel{Action: "status", JobId: "job-1"})
+	require.NoError(t, resp.Error)
+	require.Len(t, resp.Frames, 2)
+
+	params := euSFN.Calls[0].Arguments.Get(1).(*sfn.DescribeExecutionInput)
+	assert.Equal(t, "arn:aws:states:eu-west-1:123456789012:execution:eu-extractor:job-1-eu", *params.ExecutionArn)
+
+	job := resp.Frames[0]
+	assert.Equal(t, "SUCCEEDED", fieldValue(t, job, "status"))
+	assert.Equal(t, 90.0, *fieldValue(t, job, "duration").(*float64))
+	_, downloadURL := job.FieldByName("download_url")
+	assert.Equal(t, -1, downloadURL)
+
+	subJobs := resp.Frames[1]
+	assert.Equal(t, "step_function_sub_jobs", subJobs.Name)
+	assert.Equal(t, 2, subJobs.Rows())
+	urls, _ := subJobs.FieldByName("download_url")
+	assert.Equal(t, "https://test-bucket/job-1-default.pcapng", urls.At(0))
+	assert.Equal(t, "https://eu-bucket/job-1-eu.pcapng", urls.At(1))
+}
+
+func TestSplitJobsOnlySupportStatus(t *testing.T) {
+	target, _, _, _ := euTarget()
+	meta := `{"jobId": "job-1", "subJobs": [{"target": "default", "jobId": "job-1-default"}, {"target": "eu", "jobId": "job-1-eu"}]}`
+	mockS3Client := &MockS3Client{}
+	mockS3Client.On("GetObject", mock.Anything, matchKey("job-1.meta.json")).Return(objectBody(meta), nil).Once()
+	mockS3Client.On("GetObject", mock.Anything, matchKey("job-1.meta.json")).Return(objectBody(meta), nil).Once()
+	ds := &Datasource{settings: authzSettings(), s3Client: mockS3Client, sfnClient: &MockSFNClient{}, targets: []*extractionTarget{target}}
+
+	for _, resp := range []backend.DataResponse{
+		ds.handleHistoryAction(userContext("admin", "Admin", 1), queryModel{JobId: "job-1"}),
+		ds.handleRetryAction(userContext("admin", "Admin", 1), queryModel{JobId: "job-1"}),
+	} {
+		require.Error(t, resp.Error)
+		assert.Equal(t, backend.StatusBadRequest, resp.Status)
+		assert.Equal(t, "job 'job-1' is split across the targets default, eu, this is only supported for its status", resp.Error.Error())
+	}
+}
+
+func TestQueryDescribesJobsOnTheirTarget(t *testing.T) {
+	target, euSFN, _, _ := euTarget()
+	mockS3Client := &MockS3Client{}
+	mockS3Client.On("GetObject", mock.Anything, matchKey("job-2.meta.json")).Return(
+		objectBody(`{"jobId": "job-2", "orgId": 1, "user": {"login": "admin"}, "subJobs": [{"target": "eu", "jobId": "job-2"}]}`), nil)
+	euSFN.On("DescribeExecution", mock.Anything, mock.Anything).Return(&sfn.DescribeExecutionOutput{
+		Status: sfntypes.ExecutionStatusFailed,
+		Error:  aws.String("States.TaskFailed"),
+	}, nil)
+	ds := &Datasource{settings: authzSettings(), sfnClient: &MockSFNClient{}, s3Client: mockS3Client, targets: []*extractionTarget{target}}
+
+	euExecution := "arn:aws:states:eu-west-1:123456789012:execution:eu-extractor:job-2"
+	query := func(qm map[string]interface{}) backend.DataResponse {
+		queryJSON, err := json.Marshal(qm)
+		require.NoError(t, err)
+		return ds.query(userContext("admin", "Admin", 1), backend.PluginContext{}, backend.DataQuery{JSON: queryJSON})
+	}
+
+	resp := query(map[string]interface{}{"action": "status", "jobId": "job-2"})
+	require.NoError(t, resp.Error)
+	meta := resp.Frames[0].Meta
+	assert.Equal(t, "DescribeExecution of "+euExecution, meta.ExecutedQueryString)
+	require.Len(t, meta.Notices, 1)
+	assert.Contains(t, meta.Notices[0].Link, "region=eu-west-1#/v2/executions/details/"+euExecution)
+
+	assert.Equal(t, "ListExecutions of arn:aws:states:us-east-1:123456789012:stateMachine:test-state-machine, arn:aws:states:eu-west-1:123456789012:stateMachine:eu-extractor",
+		ds.executedQueryString(queryModel{Action: "variables", Variable: variableJobIds}, nil))
+}
+
+func TestListingsCoverAllTargets(t *testing.T) {
+	target, euSFN, _, _ := euTarget()
+	mockSFNClient := &MockSFNClient{}
+	mockSFNClient.On("ListExecutions", mock.Anything, mock.Anything).Return(&sfn.ListExecutionsOutput{
+		Executions: []sfntypes.ExecutionListItem{
+			{Name: aws.String("job-3-default"), StartDate: aws.Time(time.Unix(300, 0))},
+			{Name: aws.String("job-1"), StartDate: aws.Time(time.Unix(100, 0))},
+		},
+	}, nil)
+	euSFN.On("ListExecutions", mock.Anything, mock.MatchedBy(func(input *sfn.ListExecutionsInput) bool {
+		return *input.StateMachineArn == target.StepFunctionArn
+	})).Return(&sfn.ListExecutionsOutput{
+		Executions: []sfntypes.ExecutionListItem{
+			{Name: aws.String("job-3-eu"), StartDate: aws.Time(time.Unix(300, 0))},
+			{Name: aws.String("job-2-eu"), StartDate: aws.Time(time.Unix(200, 0))},
+		},
+	}, nil)
+
+	// job-2-eu ran on its own, job-3 is split across both targets
+	mockS3Client := &MockS3Client{}
+	split := `{"jobId": "job-3", "subJobs": [{"target": "default", "jobId": "job-3-default"}, {"target": "eu", "jobId": "job-3-eu"}]}`
+	mockS3Client.On("GetObject", mock.Anything, matchKey("job-3.meta.json")).Return(objectBody(split), nil).Once()
+	mockS3Client.On("GetObject", mock.Anything, matchKey("job-3.meta.json")).Return(objectBody(split), nil).Once()
+	mockS3Client.On("GetObject", mock.Anything, matchKey("job-2.meta.json")).Return(nil, &types.NoSuchKey{})
+	ds := &Datasource{settings: authzSettings(), sfnClient: mockSFNClient, s3Client: mockS3Client, targets: []*extractionTarget{target}}
+
+	jobIds, err := ds.listJobIds(context.Background(), "job-", "", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"job-3", "job-2-eu", "job-1"}, jobIds)
+
+	executions, err := ds.listExecutions(context.Background(), "", time.Unix(150, 0))
+	require.NoError(t, err)
+	var names []string
+	for _, execution := range executions {
+		names = append(names, *execution.Name)
+	}
+	assert.Equal(t, []string{"job-3-default", "job-3-eu", "job-2-eu"}, names)
+}
@@ -0,0 +1,51 @@
+package plugin
+
+import (
+	"context"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// endSpan ends the span of a query handler, recording the error of the
+// response and its error code.
+func endSpan(span trace.Span, response backend.DataResponse) {
+	defer span.End()
+	if response.Error == nil {
+		return
+	}
+	attrs := []attribute.KeyValue{attribute.Int("status", int(response.Status))}
+	for _, frame := range response.Frames {
+		if frame.Meta == nil {
+			continue
+		}
+		if custom, ok := frame.Meta.Custom.(*FrameMetaCustom); ok {
+			if custom.ErrorCode != "" {
+				attrs = append(attrs, attribute.String("error_code", custom.ErrorCode))
+			}
+			if custom.AWSErrorCode != "" {
+				attrs = append(attrs, attribute.String("aws.error_code", custom.AWSErrorCode))
+			}
+			break
+		}
+	}
+	span.SetAttributes(attrs...)
+	_ = tracing.Error(span, response.Error)
+}
+
+// traceContext returns the W3C trace context of ctx, nil if there is no
+// sampled trace to continue.
+func traceContext(ctx context.Context) map[string]string {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return nil
+	}
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
@@ -0,0 +1,135 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans installs a tracer recording all spans for the duration of the
+// test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous := tracing.DefaultTracer()
+	tracing.InitDefaultTracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test"))
+	t.Cleanup(func() { tracing.InitDefaultTracer(previous) })
+	return recorder
+}
+
+func endedSpan(t *testing.T, recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	for _, span := range recorder.Ended() {
+		if span.Name() == name {
+			return span
+		}
+	}
+	require.Failf(t, "span not found", "no span named %q", name)
+	return nil
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) string {
+	for _, attr := range span.Attributes() {
+		if attr.Key == key {
+			return attr.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestRequestActionTracing(t *testing.T) {
+	recorder := recordSpans(t)
+
+	metadata := middleware.Metadata{}
+	awsmiddleware.SetRequestIDMetadata(&metadata, "start-request-id")
+	mockSFNClient := &MockSFNClient{}
+	mockSFNClient.On("StartExecution", mock.Anything, mock.Anything).Return(&sfn.StartExecutionOutput{
+		ExecutionArn:   aws.String("arn:aws:states:us-east-1:123456789012:execution:test-state-machine:test-job-123"),
+		ResultMetadata: metadata,
+	}, nil)
+	ds := &Datasource{settings: authzSettings(), sfnClient: &instrumentedSFNClient{client: mockSFNClient}}
+
+	queryJSON, err := json.Marshal(map[string]interface{}{
+		"action":  "request",
+		"JobId":   "test-job-123",
+		"Extract": map[string][]int{"file1.pcap": {1, 2}},
+	})
+	require.NoError(t, err)
+	resp, err := ds.QueryData(userContext("jdoe", "Editor", 1), &backend.QueryDataRequest{
+		Queries: []backend.DataQuery{{RefID: "A", JSON: queryJSON}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, resp.Responses["A"].Error)
+
+	root := endedSpan(t, recorder, "QueryData")
+	query := endedSpan(t, recorder, "query")
+	handler := endedSpan(t, recorder, "handleRequestAction")
+	execute := endedSpan(t, recorder, "executeStepFunction")
+	call := endedSpan(t, recorder, "sfn.StartExecution")
+
+	assert.Equal(t, root.SpanContext().SpanID(), query.Parent().SpanID())
+	assert.Equal(t, query.SpanContext().SpanID(), handler.Parent().SpanID())
+	assert.Equal(t, handler.SpanContext().SpanID(), execute.Parent().SpanID())
+	assert.Equal(t, execute.SpanContext().SpanID(), call.Parent().SpanID())
+
+	assert.Equal(t, "request", spanAttribute(query, "action"))
+	assert.Equal(t, "test-job-123", spanAttribute(handler, "job_id"))
+	assert.Equal(t, "start-request-id", spanAttribute(call, "aws.request_id"))
+
+	// The trace continues in the Step Function
+	var input StepFunctionInput
+	params := mockSFNClient.Calls[0].Arguments.Get(1).(*sfn.StartExecutionInput)
+	require.NoError(t, json.Unmarshal([]byte(*params.Input), &input))
+	assert.Contains(t, input.TraceContext["traceparent"], execute.SpanContext().TraceID().String())
+}
+
+func TestStatusActionTracesAWSErrors(t *testing.T) {
+	recorder := recordSpans(t)
+
+	mockSFNClient := &MockSFNClient{}
+	mockSFNClient.On("DescribeExecution", mock.Anything, mock.Anything).Return(nil, &smithy.OperationError{
+		ServiceID:     "SFN",
+		OperationName: "DescribeExecution",
+		Err: &awshttp.ResponseError{
+			ResponseError: &smithyhttp.ResponseError{
+				Response: &smithyhttp.Response{Response: &http.Response{StatusCode: http.StatusBadRequest}},
+				Err:      &smithy.GenericAPIError{Code: "ExecutionDoesNotExist", Message: "Execution Does Not Exist"},
+			},
+			RequestID: "describe-request-id",
+		},
+	})
+	ds := &Datasource{settings: authzSettings(), sfnClient: &instrumentedSFNClient{client: mockSFNClient}}
+
+	resp := ds.handleStatusAction(userContext("jdoe", "Viewer", 1), queryModel{Action: "status", JobId: "test-job-123"})
+	require.Error(t, resp.Error)
+
+	call := endedSpan(t, recorder, "sfn.DescribeExecution")
+	assert.Equal(t, "describe-request-id", spanAttribute(call, "aws.request_id"))
+	assert.Equal(t, "ExecutionDoesNotExist", spanAttribute(call, "aws.error_code"))
+	assert.Equal(t, codes.Error, call.Status().Code)
+
+	handler := endedSpan(t, recorder, "handleStatusAction")
+	assert.Equal(t, "test-job-123", spanAttribute(handler, "job_id"))
+	assert.Equal(t, "404", spanAttribute(handler, "status"))
+	assert.Equal(t, codes.Error, handler.Status().Code)
+}
+
+func TestTraceContextWithoutSpan(t *testing.T) {
+	assert.Nil(t, traceContext(context.Background()))
+}
@@ -0,0 +1,406 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emnify/pcap-extractor/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	// maxUpstreamResponseBytes bounds the size of upstream query results.
+	maxUpstreamResponseBytes = 256 << 20
+
+	// upstreamRefId is the refId of the upstream query.
+	upstreamRefId = "upstream"
+)
+
+// UpstreamQuery refers to a query of another data source whose results hold
+// the packets to extract. The backend runs it through Grafana's query API and
+// builds the extract from the configured source file and packet number
+// columns, so the results do not pass through the browser.
+type UpstreamQuery struct {
+	DatasourceUID string          `json:"datasourceUid"`
+	Query         json.RawMessage `json:"query"`
+
+	// Time range of the upstream query in Grafana's format, e.g. "now-15m" or
+	// epoch milliseconds, the time range of the query if empty
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+}
+
+// upstreamError is the failure of an upstream query, with the status to
+// answer the request with.
+type upstreamError struct {
+	status  backend.Status
+	message string
+}
+
+func (e *upstreamError) Error() string {
+	return e.message
+}
+
+type userIdTokenKey struct{}
+
+// withUserIdToken keeps the ID token Grafana forwards for the user of a query,
+// upstream queries run on behalf of that user.
+func withUserIdToken(ctx context.Context, token string) context.Context {
+	if token == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, userIdTokenKey{}, token)
+}
+
+func userIdToken(ctx context.Context) string {
+	token, _ := ctx.Value(userIdTokenKey{}).(string)
+	return token
+}
+
+// upstreamExtract runs an upstream query and builds the extract, and the
+// order of its files if known, from the packets in its results.
+func (d *Datasource) upstreamExtract(ctx context.Context, upstream UpstreamQuery, timeRange backend.TimeRange) (map[string][]int, []string, error) {
+	if upstream.DatasourceUID == "" {
+		return nil, nil, &upstreamError{status: backend.StatusBadRequest, message: "The datasource UID of the upstream query is required"}
+	}
+	if !slices.Contains(d.settings.UpstreamDatasources, upstream.DatasourceUID) {
+		return nil, nil, &upstreamError{status: backend.StatusForbidden, message: fmt.Sprintf("Data source '%s' is not allowed for upstream queries", upstream.DatasourceUID)}
+	}
+
+	frames, err := d.runUpstreamQuery(ctx, upstream, timeRange)
+	if err != nil {
+		return nil, nil, err
+	}
+	return d.extractFromFrames(frames)
+}
+
+// grafanaAPI calls the HTTP API of Grafana with the service account of the
+// plugin.
+type grafanaAPI struct {
+	client *http.Client
+	appURL string
+	token  string
+	orgId  int64
+}
+
+// grafanaAPI returns the HTTP API of the Grafana instance of the request.
+func (d *Datasource) grafanaAPI(ctx context.Context) (*grafanaAPI, error) {
+	cfg := backend.GrafanaConfigFromContext(ctx)
+	appURL, err := cfg.AppURL()
+	if err != nil {
+		return nil, &upstreamError{status: backend.StatusInternal, message: fmt.Sprintf("Upstream queries are not available: %v", err)}
+	}
+	token, err := cfg.PluginAppClientSecret()
+	if err != nil {
+		return nil, &upstreamError{status: backend.StatusInternal, message: fmt.Sprintf("Upstream queries are not available: %v", err)}
+	}
+	client := d.grafanaClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &grafanaAPI{
+		client: client,
+		appURL: strings.TrimSuffix(appURL, "/"),
+		token:  token,
+		orgId:  backend.PluginConfigFromContext(ctx).OrgID,
+	}, nil
+}
+
+// newRequest creates a request of the API authenticated as the service
+// account of the plugin.
+func (g *grafanaAPI) newRequest(ctx context.Context, method string, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, g.appURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+g.token)
+	if g.orgId != 0 {
+		req.Header.Set("X-Grafana-Org-Id", strconv.FormatInt(g.orgId, 10))
+	}
+	return req, nil
+}
+
+// datasourceQueryScopes are the scopes of the datasources:query permission
+// that cover the data source with the UID.
+func datasourceQueryScopes(uid string) []string {
+	return []string{"*", "datasources:*", "datasources:uid:*", "datasources:uid:" + uid}
+}
+
+// authorizeUpstream checks that the user of the request may query the data
+// source. The query API only sees the service account of the plugin, which
+// may query data sources the user may not, so the permissions of the user
+// are looked up first.
+func (d *Datasource) authorizeUpstream(ctx context.Context, api *grafanaAPI, uid string) error {
+	user := backend.UserFromContext(ctx)
+	if user == nil || user.Login == "" {
+		return &upstreamError{status: backend.StatusForbidden, message: "Upstream queries run on behalf of the requesting user, the request has no user"}
+	}
+
+	params := url.Values{"userLogin": {user.Login}, "action": {"datasources:query"}}
+	req, err := api.newRequest(ctx, http.MethodGet, "/api/access-control/users/permissions/search?"+params.Encode(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create permission search request: %w", err)
+	}
+	res, err := api.client.Do(req)
+	if err != nil {
+		return &upstreamError{status: backend.StatusBadGateway, message: fmt.Sprintf("Failed to look up the permissions of the user: %v", err)}
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return &upstreamError{status: backend.StatusBadGateway, message: fmt.Sprintf("Failed to look up the permissions of the user: %s", res.Status)}
+	}
+
+	// Permissions by user ID and action
+	var permissions map[string]map[string][]string
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxUpstreamResponseBytes)).Decode(&permissions); err != nil {
+		return &upstreamError{status: backend.StatusBadGateway, message: fmt.Sprintf("Failed to decode the permissions of the user: %v", err)}
+	}
+	allowed := datasourceQueryScopes(uid)
+	for _, actions := range permissions {
+		for _, scope := range actions["datasources:query"] {
+			if slices.Contains(allowed, scope) {
+				return nil
+			}
+		}
+	}
+	return &upstreamError{status: backend.StatusForbidden, message: fmt.Sprintf("User '%s' may not query data source '%s'", user.Login, uid)}
+}
+
+// runUpstreamQuery runs an upstream query through Grafana's query API with
+// the service account of the plugin on behalf of the user of the request,
+// after checking that the user may query the data source.
+func (d *Datasource) runUpstreamQuery(ctx context.Context, upstream UpstreamQuery, timeRange backend.TimeRange) (data.Frames, error) {
+	idToken := userIdToken(ctx)
+	if idToken == "" {
+		return nil, &upstreamError{status: backend.StatusForbidden, message: "Upstream queries run on behalf of the requesting user, Grafana forwarded no ID token for the user (feature toggle idForwarding)"}
+	}
+
+	api, err := d.grafanaAPI(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.authorizeUpstream(ctx, api, upstream.DatasourceUID); err != nil {
+		return nil, err
+	}
+
+	query := map[string]interface{}{}
+	if len(upstream.Query) > 0 {
+		if err := json.Unmarshal(upstream.Query, &query); err != nil {
+			return nil, &upstreamError{status: backend.StatusBadRequest, message: fmt.Sprintf("Invalid upstream query: %v", err)}
+		}
+	}
+	query["refId"] = upstreamRefId
+	query["datasource"] = map[string]string{"uid": upstream.DatasourceUID}
+
+	from, to := upstream.From, upstream.To
+	if from == "" || to == "" {
+		if timeRange.From.IsZero() || timeRange.To.IsZero() {
+			return nil, &upstreamError{status: backend.StatusBadRequest, message: "The upstream query requires a time range"}
+		}
+		from, to = strconv.FormatInt(timeRange.From.UnixMilli(), 10), strconv.FormatInt(timeRange.To.UnixMilli(), 10)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"queries": []interface{}{query},
+		"from":    from,
+		"to":      to,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal upstream query: %w", err)
+	}
+
+	req, err := api.newRequest(ctx, http.MethodPost, "/api/ds/query", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upstream query request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(backend.GrafanaUserSignInTokenHeaderName, idToken)
+
+	res, err := api.client.Do(req)
+	if err != nil {
+		return nil, &upstreamError{status: backend.StatusBadGateway, message: fmt.Sprintf("Failed to run the upstream query: %v", err)}
+	}
+	defer res.Body.Close()
+
+	raw, err := io.ReadAll(io.LimitReader(res.Body, maxUpstreamResponseBytes+1))
+	if err != nil {
+		return nil, &upstreamError{status: backend.StatusBadGateway, message: fmt.Sprintf("Failed to read the upstream query results: %v", err)}
+	}
+	if len(raw) > maxUpstreamResponseBytes {
+		return nil, &upstreamError{status: backend.StatusBadRequest, message: fmt.Sprintf("The upstream query results exceed %d MiB", maxUpstreamResponseBytes>>20)}
+	}
+
+	var result struct {
+		Message string `json:"message"`
+		Results map[string]struct {
+			Error  string      `json:"error"`
+			Frames data.Frames `json:"frames"`
+		} `json:"results"`
+	}
+	decodeErr := json.Unmarshal(raw, &result)
+
+	upstreamResult := result.Results[upstreamRefId]
+	if res.StatusCode >= 300 || upstreamResult.Error != "" {
+		message := upstreamResult.Error
+		if message == "" {
+			message = result.Message
+		}
+		if message == "" {
+			message = res.Status
+		}
+		status := backend.StatusBadGateway
+		switch {
+		case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+			// The user may not query the data source
+			status = backend.StatusForbidden
+		case res.StatusCode >= 400 && res.StatusCode < 500:
+			status = backend.StatusBadRequest
+		}
+		return nil, &upstreamError{status: status, message: fmt.Sprintf("The upstream query failed: %s", message)}
+	}
+	if decodeErr != nil {
+		return nil, &upstreamError{status: backend.StatusBadGateway, message: fmt.Sprintf("Failed to decode the upstream query results: %v", decodeErr)}
+	}
+	return upstreamResult.Frames, nil
+}
+
+// extractFromFrames builds an extract from the source file and packet number
+// columns of query results. With a timestamp column it also returns the files
+// in the order of their first captured packet. Problems name rows and columns
+// but never their values, which the user may not be allowed to read.
+func (d *Datasource) extractFromFrames(frames data.Frames) (map[string][]int, []string, error) {
+	fileColumn, packetColumn, timeColumn := d.sourceFileColumn(), d.packetNumberColumn(), d.settings.TimestampColumn
+
+	extract := map[string][]int{}
+	firstCapture := map[string]time.Time{}
+	found := false
+	var problems []string
+	for _, frame := range frames {
+		fileField, _ := frame.FieldByName(fileColumn)
+		packetField, _ := frame.FieldByName(packetColumn)
+		if fileField == nil || packetField == nil {
+			continue
+		}
+		found = true
+		var timeField *data.Field
+		if timeColumn != "" {
+			timeField, _ = frame.FieldByName(timeColumn)
+		}
+
+		for i := 0; i < fileField.Len() && len(problems) < maxExtractProblems; i++ {
+			file, fileOk := fileField.ConcreteAt(i)
+			packet, packetOk := packetField.ConcreteAt(i)
+			if !fileOk || !packetOk {
+				problems = append(problems, fmt.Sprintf("row %d of frame %q has no source file or packet number", i+1, frame.Name))
+				continue
+			}
+			number, ok := packetNumber(packet)
+			if !ok {
+				problems = append(problems, fmt.Sprintf("row %d of frame %q has an invalid value in column %s", i+1, frame.Name, packetColumn))
+				continue
+			}
+			name := fmt.Sprint(file)
+			extract[name] = append(extract[name], number)
+
+			if timeField == nil {
+				continue
+			}
+			// Rows without a capture time do not affect the order
+			value, ok := timeField.ConcreteAt(i)
+			if !ok {
+				continue
+			}
+			captured, ok := value.(time.Time)
+			if !ok {
+				problems = append(problems, fmt.Sprintf("row %d of frame %q has an invalid value in column %s", i+1, frame.Name, timeColumn))
+				continue
+			}
+			if first, seen := firstCapture[name]; !seen || captured.Before(first) {
+				firstCapture[name] = captured
+			}
+		}
+	}
+
+	if !found {
+		return nil, nil, &ExtractError{Problems: []string{fmt.Sprintf("the upstream query returned no frame with the columns %s and %s", fileColumn, packetColumn)}}
+	}
+	if len(problems) > 0 {
+		return nil, nil, &ExtractError{Problems: problems}
+	}
+	if len(extract) == 0 {
+		return nil, nil, &ExtractError{Problems: []string{"the upstream query returned no packets"}}
+	}
+	if len(firstCapture) == 0 {
+		return extract, nil, nil
+	}
+	return extract, orderFiles(slices.Collect(maps.Keys(extract)), firstCapture), nil
+}
+
+// orderFiles sorts files by the time of their first captured packet. Files
+// without a capture time come last, files captured at the same time are
+// sorted by name.
+func orderFiles(files []string, firstCapture map[string]time.Time) []string {
+	slices.SortFunc(files, func(a, b string) int {
+		ta, okA := firstCapture[a]
+		tb, okB := firstCapture[b]
+		switch {
+		case okA != okB && okA:
+			return -1
+		case okA != okB:
+			return 1
+		case !ta.Equal(tb):
+			return ta.Compare(tb)
+		}
+		return strings.Compare(a, b)
+	})
+	return files
+}
+
+// sourceFileColumn returns the column of query results naming source files.
+func (d *Datasource) sourceFileColumn() string {
+	if d.settings.SourceFileColumn != "" {
+		return d.settings.SourceFileColumn
+	}
+	return models.DefaultSourceFileColumn
+}
+
+// packetNumberColumn returns the column of query results holding packet
+// numbers.
+func (d *Datasource) packetNumberColumn() string {
+	if d.settings.PacketNumberColumn != "" {
+		return d.settings.PacketNumberColumn
+	}
+	return models.DefaultPacketNumberColumn
+}
+
+// packetNumber converts the value of a packet number column to an int.
+func packetNumber(value interface{}) (int, bool) {
+	switch v := value.(type) {
+	case int8, int16, int32, int64, uint8, uint16, uint32, uint64, int:
+		n, err := strconv.ParseInt(fmt.Sprint(v), 10, 64)
+		return int(n), err == nil
+	case float32:
+		return packetNumber(float64(v))
+	case float64:
+		if v != math.Trunc(v) || math.Abs(v) > 1<<53 {
+			return 0, false
+		}
+		return int(v), true
+	case string:
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		return n, err == nil
+	}
+	return 0, false
+}
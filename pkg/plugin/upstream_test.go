@@ -0,0 +1,334 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	"github.com/emnify/pcap-extractor/pkg/models"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// upstreamContext returns a user context with the Grafana config and the ID
+// token of the user needed to run upstream queries against appURL.
+func upstreamContext(appURL string) context.Context {
+	ctx := backend.WithGrafanaConfig(userContext("jdoe", "Editor", 1), backend.NewGrafanaCfg(map[string]string{
+		backend.AppURL:          appURL,
+		backend.AppClientSecret: "service-account-token",
+	}))
+	return withUserIdToken(ctx, "jdoe-id-token")
+}
+
+// grafanaServer fakes Grafana for upstream queries, answering permission
+// searches with the datasources:query scopes of the user and passing query
+// requests to query.
+func grafanaServer(t *testing.T, scopes []string, query http.HandlerFunc) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/access-control/users/permissions/search" {
+			query(w, r)
+			return
+		}
+		assert.Equal(t, "Bearer service-account-token", r.Header.Get("Authorization"))
+		assert.Equal(t, "jdoe", r.URL.Query().Get("userLogin"))
+		assert.Equal(t, "datasources:query", r.URL.Query().Get("action"))
+		raw, err := json.Marshal(map[string]map[string][]string{"2": {"datasources:query": scopes}})
+		require.NoError(t, err)
+		_, _ = w.Write(raw)
+	}))
+}
+
+// upstreamResponse encodes frames as the response of Grafana's query API.
+func upstreamResponse(t *testing.T, frames ...*data.Frame) []byte {
+	raw, err := json.Marshal(data.Frames(frames))
+	require.NoError(t, err)
+	return []byte(`{"results": {"upstream": {"status": 200, "frames": ` + string(raw) + `}}}`)
+}
+
+func TestUpstreamExtract(t *testing.T) {
+	from := time.Date(2025, 10, 30, 12, 0, 0, 0, time.UTC)
+	timeRange := backend.TimeRange{From: from, To: from.Add(15 * time.Minute)}
+
+	var request map[string]interface{}
+	var header http.Header
+	server := grafanaServer(t, []string{"datasources:uid:upstream-uid"}, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/ds/query", r.URL.Path)
+		header = r.Header
+		body, _ := io.ReadAll(r.Body)
+		require.NoError(t, json.Unmarshal(body, &request))
+		_, _ = w.Write(upstreamResponse(t,
+			data.NewFrame("packets",
+				data.NewField(models.DefaultSourceFileColumn, nil, []string{"b.pcap", "a.pcap", "b.pcap"}),
+				data.NewField(models.DefaultPacketNumberColumn, nil, []int64{7, 1, 3}),
+			),
+			data.NewFrame("other", data.NewField("value", nil, []float64{1})),
+		))
+	})
+	defer server.Close()
+
+	settings := authzSettings()
+	settings.UpstreamDatasources = []string{"upstream-uid"}
+	ds := &Datasource{settings: settings}
+
+	extract, order, err := ds.upstreamExtract(upstreamContext(server.URL), UpstreamQuery{
+		DatasourceUID: "upstream-uid",
+		Query:         json.RawMessage(`{"rawSql": "SELECT 1"}`),
+	}, timeRange)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]int{"a.pcap": {1}, "b.pcap": {7, 3}}, extract)
+	assert.Nil(t, order)
+
+	assert.Equal(t, "Bearer service-account-token", header.Get("Authorization"))
+	assert.Equal(t, "jdoe-id-token", header.Get("X-Grafana-Id"))
+	assert.Equal(t, "1", header.Get("X-Grafana-Org-Id"))
+	assert.Equal(t, "1761825600000", request["from"])
+	assert.Equal(t, "1761826500000", request["to"])
+	assert.Equal(t, []interface{}{map[string]interface{}{
+		"refId":      upstreamRefId,
+		"rawSql":     "SELECT 1",
+		"datasource": map[string]interface{}{"uid": "upstream-uid"},
+	}}, request["queries"])
+}
+
+func TestUpstreamExtractErrors(t *testing.T) {
+	from := time.Date(2025, 10, 30, 12, 0, 0, 0, time.UTC)
+	timeRange := backend.TimeRange{From: from, To: from.Add(15 * time.Minute)}
+
+	tests := []struct {
+		name     string
+		uid      string
+		status   int
+		response string
+		expected backend.Status
+		message  string
+	}{
+		{
+			name:     "not allowed",
+			uid:      "other-uid",
+			expected: backend.StatusForbidden,
+			message:  "Data source 'other-uid' is not allowed for upstream queries",
+		},
+		{
+			name:     "query error",
+			uid:      "upstream-uid",
+			status:   http.StatusBadRequest,
+			response: `{"results": {"upstream": {"error": "syntax error"}}}`,
+			expected: backend.StatusBadRequest,
+			message:  "The upstream query failed: syntax error",
+		},
+		{
+			name:     "user may not query",
+			uid:      "upstream-uid",
+			status:   http.StatusForbidden,
+			response: `{"message": "access denied"}`,
+			expected: backend.StatusForbidden,
+			message:  "The upstream query failed: access denied",
+		},
+		{
+			name:     "server error",
+			uid:      "upstream-uid",
+			status:   http.StatusInternalServerError,
+			response: `{"message": "internal error"}`,
+			expected: backend.StatusBadGateway,
+			message:  "The upstream query failed: internal error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := grafanaServer(t, []string{"datasources:*"}, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.response))
+			})
+			defer server.Close()
+
+			settings := authzSettings()
+			settings.UpstreamDatasources = []string{"upstream-uid"}
+			ds := &Datasource{settings: settings}
+
+			_, _, err := ds.upstreamExtract(upstreamContext(server.URL), UpstreamQuery{DatasourceUID: tt.uid}, timeRange)
+			var upstreamErr *upstreamError
+			require.True(t, errors.As(err, &upstreamErr))
+			assert.Equal(t, tt.expected, upstreamErr.status)
+			assert.Equal(t, tt.message, upstreamErr.message)
+		})
+	}
+}
+
+func TestUpstreamExtractRequiresUserIdToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("upstream query sent without the ID token of the user")
+	}))
+	defer server.Close()
+
+	settings := authzSettings()
+	settings.UpstreamDatasources = []string{"upstream-uid"}
+	ds := &Datasource{settings: settings}
+
+	ctx := backend.WithGrafanaConfig(userContext("jdoe", "Editor", 1), backend.NewGrafanaCfg(map[string]string{
+		backend.AppURL:          server.URL,
+		backend.AppClientSecret: "service-account-token",
+	}))
+	_, _, err := ds.upstreamExtract(ctx, UpstreamQuery{DatasourceUID: "upstream-uid"}, backend.TimeRange{From: time.Unix(0, 0), To: time.Unix(60, 0)})
+	var upstreamErr *upstreamError
+	require.True(t, errors.As(err, &upstreamErr))
+	assert.Equal(t, backend.StatusForbidden, upstreamErr.status)
+}
+
+func TestUpstreamExtractRequiresQueryPermissionOfUser(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes []string
+		status int
+	}{
+		{name: "other data source", scopes: []string{"datasources:uid:other-uid"}, status: http.StatusOK},
+		{name: "no permission", status: http.StatusOK},
+		{name: "search fails", status: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/access-control/users/permissions/search" {
+					t.Error("upstream query sent for a user who may not query the data source")
+					return
+				}
+				w.WriteHeader(tt.status)
+				raw, _ := json.Marshal(map[string]map[string][]string{"2": {"datasources:query": tt.scopes}})
+				_, _ = w.Write(raw)
+			}))
+			defer server.Close()
+
+			settings := authzSettings()
+			settings.UpstreamDatasources = []string{"upstream-uid"}
+			ds := &Datasource{settings: settings}
+
+			_, _, err := ds.upstreamExtract(upstreamContext(server.URL), UpstreamQuery{DatasourceUID: "upstream-uid"}, backend.TimeRange{From: time.Unix(0, 0), To: time.Unix(60, 0)})
+			var upstreamErr *upstreamError
+			require.True(t, errors.As(err, &upstreamErr))
+			if tt.status == http.StatusOK {
+				assert.Equal(t, backend.StatusForbidden, upstreamErr.status)
+				assert.Equal(t, "User 'jdoe' may not query data source 'upstream-uid'", upstreamErr.message)
+			} else {
+				assert.Equal(t, backend.StatusBadGateway, upstreamErr.status)
+			}
+		})
+	}
+}
+
+func TestExtractFromFrames(t *testing.T) {
+	capture := time.Date(2025, 10, 30, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		settings models.PluginSettings
+		frame    *data.Frame
+		extract  map[string][]int
+		order    []string
+		problems string
+	}{
+		{
+			name:     "missing columns",
+			frame:    data.NewFrame("", data.NewField("value", nil, []int64{1})),
+			problems: "Invalid extract: the upstream query returned no frame with the columns source_file and source_packet_number",
+		},
+		{
+			name: "invalid rows",
+			frame: data.NewFrame("packets",
+				data.NewField(models.DefaultSourceFileColumn, nil, []*string{aws.String("a.pcap"), nil}),
+				data.NewField(models.DefaultPacketNumberColumn, nil, []float64{1.5, 2}),
+			),
+			problems: `Invalid extract: row 1 of frame "packets" has an invalid value in column source_packet_number; row 2 of frame "packets" has no source file or packet number`,
+		},
+		{
+			name: "string packet numbers",
+			frame: data.NewFrame("packets",
+				data.NewField(models.DefaultSourceFileColumn, nil, []string{"a.pcap", "a.pcap"}),
+				data.NewField(models.DefaultPacketNumberColumn, nil, []string{"4", " 2 "}),
+			),
+			extract: map[string][]int{"a.pcap": {4, 2}},
+		},
+		{
+			name:     "configured columns",
+			settings: models.PluginSettings{SourceFileColumn: "pcap_key", PacketNumberColumn: "frame_no", TimestampColumn: "captured_at"},
+			frame: data.NewFrame("packets",
+				data.NewField("pcap_key", nil, []string{"b.pcap", "a.pcap", "c.pcap", "b.pcap", "d.pcap"}),
+				data.NewField("frame_no", nil, []int64{9, 1, 5, 2, 3}),
+				data.NewField("captured_at", nil, []*time.Time{
+					aws.Time(capture.Add(time.Minute)), aws.Time(capture.Add(time.Hour)), aws.Time(capture.Add(time.Hour)), aws.Time(capture), nil,
+				}),
+			),
+			extract: map[string][]int{"a.pcap": {1}, "b.pcap": {9, 2}, "c.pcap": {5}, "d.pcap": {3}},
+			order:   []string{"b.pcap", "a.pcap", "c.pcap", "d.pcap"},
+		},
+		{
+			name:     "configured columns without capture times",
+			settings: models.PluginSettings{SourceFileColumn: "pcap_key", PacketNumberColumn: "frame_no", TimestampColumn: "captured_at"},
+			frame: data.NewFrame("packets",
+				data.NewField("pcap_key", nil, []string{"a.pcap"}),
+				data.NewField("frame_no", nil, []int64{1}),
+			),
+			extract: map[string][]int{"a.pcap": {1}},
+		},
+		{
+			name:     "invalid capture time",
+			settings: models.PluginSettings{TimestampColumn: "captured_at"},
+			frame: data.NewFrame("packets",
+				data.NewField(models.DefaultSourceFileColumn, nil, []string{"a.pcap"}),
+				data.NewField(models.DefaultPacketNumberColumn, nil, []int64{1}),
+				data.NewField("captured_at", nil, []string{"yesterday"}),
+			),
+			problems: `Invalid extract: row 1 of frame "packets" has an invalid value in column captured_at`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds := &Datasource{settings: &tt.settings}
+			extract, order, err := ds.extractFromFrames(data.Frames{tt.frame})
+			if tt.problems != "" {
+				assert.EqualError(t, err, tt.problems)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.extract, extract)
+			assert.Equal(t, tt.order, order)
+		})
+	}
+}
+
+func TestRequestActionWithUpstream(t *testing.T) {
+	server := grafanaServer(t, []string{"datasources:uid:*"}, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(upstreamResponse(t, data.NewFrame("packets",
+			data.NewField(models.DefaultSourceFileColumn, nil, []string{"b.pcap", "a.pcap", "a.pcap"}),
+			data.NewField(models.DefaultPacketNumberColumn, nil, []uint32{3, 1, 2}),
+			data.NewField("captured_at", nil, []time.Time{time.Unix(3, 0), time.Unix(1, 0), time.Unix(2, 0)}),
+		)))
+	})
+	defer server.Close()
+
+	settings := authzSettings()
+	settings.UpstreamDatasources = []string{"upstream-uid"}
+	settings.TimestampColumn = "captured_at"
+	mockSFNClient := &MockSFNClient{}
+	mockSFNClient.On("StartExecution", mock.Anything, mock.Anything).Return(&sfn.StartExecutionOutput{ExecutionArn: aws.String("arn")}, nil)
+	ds := &Datasource{settings: settings, sfnClient: mockSFNClient}
+
+	var qm queryModel
+	require.NoError(t, json.Unmarshal([]byte(`{"action": "request", "JobId": "test-job-123", "upstream": {"datasourceUid": "upstream-uid", "from": "now-1h", "to": "now"}}`), &qm))
+	resp := ds.handleRequestAction(upstreamContext(server.URL), qm)
+	require.NoError(t, resp.Error)
+
+	params := mockSFNClient.Calls[0].Arguments.Get(1).(*sfn.StartExecutionInput)
+	assert.JSONEq(t, `{"jobId": "test-job-123", "bucket": "test-bucket", "extract": {"a.pcap": [1, 2], "b.pcap": [3]}, "fileOrder": ["a.pcap", "b.pcap"]}`, *params.Input)
+}
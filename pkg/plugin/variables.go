@@ -0,0 +1,198 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	sfntypes "github.com/aws/aws-sdk-go-v2/service/sfn/types"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// Values of a template variable query
+const (
+	variableJobIds   = "jobIds"
+	variableStatuses = "statuses"
+	variablePrefixes = "prefixes"
+	variableObjects  = "objects"
+)
+
+// maxVariableValues bounds the number of values of a template variable.
+const maxVariableValues = 1000
+
+// variableValue is one option of a template variable.
+type variableValue struct {
+	text  string
+	value string
+}
+
+// handleVariablesAction returns the options of a dashboard template variable
+// as a frame with text and value fields: recent job IDs, execution statuses,
+// or the prefixes and objects under a prefix of the bucket.
+func (d *Datasource) handleVariablesAction(ctx context.Context, qm queryModel) backend.DataResponse {
+	var response backend.DataResponse
+
+	d.log(ctx).Info("Processing variables action", "variable", qm.Variable)
+
+	var (
+		values []variableValue
+		err    error
+	)
+	switch qm.Variable {
+	case variableJobIds:
+		if status := sfntypes.ExecutionStatus(qm.StatusFilter); status != "" && !slices.Contains(status.Values(), status) {
+			return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("unknown status '%s'", qm.StatusFilter))
+		}
+		values, err = d.jobIdValues(ctx, qm)
+	case variableStatuses:
+		for _, status := range sfntypes.ExecutionStatus("").Values() {
+			values = append(values, variableValue{text: string(status), value: string(status)})
+		}
+	case variablePrefixes, variableObjects:
+		if d.s3Client == nil {
+			return backend.ErrDataResponse(backend.StatusBadRequest, "Listing the bucket requires an S3 client")
+		}
+		sourcePrefixes := d.allSourcePrefixes()
+		if len(sourcePrefixes) == 0 {
+			return backend.ErrDataResponse(backend.StatusBadRequest, "Listing the bucket requires sourcePrefixes in the data source settings")
+		}
+		if qm.S3Prefix == "" && qm.Variable == variablePrefixes {
+			for _, prefix := range sourcePrefixes {
+				values = append(values, variableValue{text: prefix, value: prefix})
+			}
+			break
+		}
+		if !slices.ContainsFunc(sourcePrefixes, func(prefix string) bool { return strings.HasPrefix(qm.S3Prefix, prefix) }) {
+			return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("s3Prefix %q is not below a source prefix (%s)", qm.S3Prefix, strings.Join(sourcePrefixes, ", ")))
+		}
+		values, err = d.bucketValues(ctx, qm.S3Prefix, qm.Variable == variablePrefixes)
+	default:
+		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("unknown variable: '%s', expected one of %s, %s, %s or %s",
+			qm.Variable, variableJobIds, variableStatuses, variablePrefixes, variableObjects))
+	}
+	if err != nil {
+		d.log(ctx).Error("Failed to list variable values", "error", err, "variable", qm.Variable)
+		return awsErrorResponse(backend.StatusBadGateway, "Failed to list variable values", err)
+	}
+
+	texts := make([]string, len(values))
+	vals := make([]string, len(values))
+	for i, value := range values {
+		texts[i], vals[i] = value.text, value.value
+	}
+	response.Frames = append(response.Frames, data.NewFrame("variables",
+		data.NewField("text", nil, texts),
+		data.NewField("value", nil, vals),
+	))
+	return response
+}
+
+// jobIdValues lists the most recent jobs the user may see, optionally only
+// the ones with a prefix or a known status.
+func (d *Datasource) jobIdValues(ctx context.Context, qm queryModel) ([]variableValue, error) {
+	jobIds, err := d.listJobIds(ctx, qm.JobIdPrefix, sfntypes.ExecutionStatus(qm.StatusFilter), maxBatchJobs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the jobs the user may see are offered
+	visible := make([]bool, len(jobIds))
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, max(d.settings.MaxConcurrentQueries, 1))
+	for i, jobId := range jobIds {
+		wg.Add(1)
+		go func(i int, jobId string) {
+			defer wg.Done()
+			select {
+			case workers <- struct{}{}:
+				defer func() { <-workers }()
+				_, err := d.loadJob(withLogJob(ctx, jobId), jobId)
+				visible[i] = err == nil
+			case <-ctx.Done():
+			}
+		}(i, jobId)
+	}
+	wg.Wait()
+
+	var values []variableValue
+	for i, jobId := range jobIds {
+		if visible[i] {
+			values = append(values, variableValue{text: jobId, value: jobId})
+		}
+	}
+	return values, nil
+}
+
+// allSourcePrefixes returns the source prefixes of the default target and of
+// every further target, the only prefixes template variables may list.
+func (d *Datasource) allSourcePrefixes() []string {
+	prefixes := slices.Clone(d.settings.SourcePrefixes)
+	for _, target := range d.targets {
+		prefixes = append(prefixes, target.SourcePrefixes...)
+	}
+	return prefixes
+}
+
+// listableKey reports whether a key of a source bucket may be offered as a
+// variable value. Captures, metadata and audit records of jobs belong to the
+// users who requested them and are never listed, even if they are stored
+// below a source prefix.
+func (d *Datasource) listableKey(key string) bool {
+	if audit := d.settings.AuditS3Prefix; audit != "" && strings.HasPrefix(key, audit) {
+		return false
+	}
+	// Jobs are stored at the top of the bucket as {jobId} and a suffix
+	for _, suffix := range []string{outputKey(""), anonymizedOutputKey(""), metadataKey("")} {
+		if jobId, ok := strings.CutSuffix(key, suffix); ok && jobIdPattern.MatchString(jobId) {
+			return false
+		}
+	}
+	return true
+}
+
+// bucketValues lists the prefixes directly below prefix, or the objects
+// below it, in the source bucket of the target of prefix. Values are full
+// keys, texts are relative to prefix.
+func (d *Datasource) bucketValues(ctx context.Context, prefix string, prefixes bool) ([]variableValue, error) {
+	view, err := d.forTarget(d.routeKey(prefix))
+	if err != nil {
+		return nil, err
+	}
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(view.sourceBucket()),
+		Prefix: aws.String(prefix),
+	}
+	if prefixes {
+		input.Delimiter = aws.String("/")
+	}
+
+	var values []variableValue
+	add := func(key string) {
+		if len(values) < maxVariableValues && d.listableKey(key) {
+			values = append(values, variableValue{text: strings.TrimPrefix(key, prefix), value: key})
+		}
+	}
+
+	paginator := s3.NewListObjectsV2Paginator(view.s3Client, input)
+	for pages := 0; paginator.HasMorePages() && pages < maxListPages && len(values) < maxVariableValues; pages++ {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if prefixes {
+			for _, common := range page.CommonPrefixes {
+				add(aws.ToString(common.Prefix))
+			}
+			continue
+		}
+		for _, object := range page.Contents {
+			add(aws.ToString(object.Key))
+		}
+	}
+	return values, nil
+}
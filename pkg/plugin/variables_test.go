@@ -0,0 +1,192 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sfn"
+	sfntypes "github.com/aws/aws-sdk-go-v2/service/sfn/types"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleVariablesAction(t *testing.T) {
+	tests := []struct {
+		name           string
+		queryModel     queryModel
+		ctx            context.Context
+		setupSFNMock   func(*MockSFNClient)
+		setupS3Mock    func(*MockS3Client)
+		expectedStatus backend.Status
+		expectedTexts  []string
+		expectedValues []string
+	}{
+		{
+			name:       "job IDs the user may see",
+			queryModel: queryModel{Action: "variables", Variable: "jobIds", JobIdPrefix: "incident-", StatusFilter: "FAILED"},
+			ctx:        userContext("jdoe", "Viewer", 1),
+			setupSFNMock: func(mockClient *MockSFNClient) {
+				mockClient.On("ListExecutions", mock.Anything, mock.MatchedBy(func(input *sfn.ListExecutionsInput) bool {
+					return input.StatusFilter == sfntypes.ExecutionStatusFailed
+				})).Return(&sfn.ListExecutionsOutput{
+					Executions: []sfntypes.ExecutionListItem{
+						{Name: aws.String("incident-1")},
+						{Name: aws.String("other-1")},
+						{Name: aws.String("incident-2")},
+					},
+				}, nil)
+			},
+			setupS3Mock: func(mockClient *MockS3Client) {
+				mockClient.On("GetObject", mock.Anything, matchKey("incident-1.meta.json")).Return(
+					objectBody(`{"jobId":"incident-1","orgId":1,"user":{"login":"jdoe"}}`), nil)
+				mockClient.On("GetObject", mock.Anything, matchKey("incident-2.meta.json")).Return(
+					objectBody(`{"jobId":"incident-2","orgId":1,"user":{"login":"other"}}`), nil)
+			},
+			expectedTexts:  []string{"incident-1"},
+			expectedValues: []string{"incident-1"},
+		},
+		{
+			name:           "unknown status filter",
+			queryModel:     queryModel{Action: "variables", Variable: "jobIds", StatusFilter: "DONE"},
+			ctx:            context.Background(),
+			expectedStatus: backend.StatusBadRequest,
+		},
+		{
+			name:           "statuses",
+			queryModel:     queryModel{Action: "variables", Variable: "statuses"},
+			ctx:            context.Background(),
+			expectedTexts:  []string{"RUNNING", "SUCCEEDED", "FAILED", "TIMED_OUT", "ABORTED", "PENDING_REDRIVE"},
+			expectedValues: []string{"RUNNING", "SUCCEEDED", "FAILED", "TIMED_OUT", "ABORTED", "PENDING_REDRIVE"},
+		},
+		{
+			name:       "prefixes",
+			queryModel: queryModel{Action: "variables", Variable: "prefixes", S3Prefix: "captures/"},
+			ctx:        context.Background(),
+			setupS3Mock: func(mockClient *MockS3Client) {
+				mockClient.On("ListObjectsV2", mock.Anything, mock.MatchedBy(func(input *s3.ListObjectsV2Input) bool {
+					return *input.Prefix == "captures/" && *input.Delimiter == "/"
+				})).Return(&s3.ListObjectsV2Output{
+					CommonPrefixes: []types.CommonPrefix{
+						{Prefix: aws.String("captures/eu-west-1/")},
+						{Prefix: aws.String("captures/us-east-1/")},
+					},
+				}, nil)
+			},
+			expectedTexts:  []string{"eu-west-1/", "us-east-1/"},
+			expectedValues: []string{"captures/eu-west-1/", "captures/us-east-1/"},
+		},
+		{
+			name:       "objects",
+			queryModel: queryModel{Action: "variables", Variable: "objects", S3Prefix: "captures/eu-west-1/"},
+			ctx:        context.Background(),
+			setupS3Mock: func(mockClient *MockS3Client) {
+				mockClient.On("ListObjectsV2", mock.Anything, mock.MatchedBy(func(input *s3.ListObjectsV2Input) bool {
+					return *input.Prefix == "captures/eu-west-1/" && input.Delimiter == nil
+				})).Return(&s3.ListObjectsV2Output{
+					Contents: []types.Object{{Key: aws.String("captures/eu-west-1/probe-1.pcap")}},
+				}, nil)
+			},
+			expectedTexts:  []string{"probe-1.pcap"},
+			expectedValues: []string{"captures/eu-west-1/probe-1.pcap"},
+		},
+		{
+			name:           "source prefixes",
+			queryModel:     queryModel{Action: "variables", Variable: "prefixes"},
+			ctx:            context.Background(),
+			expectedTexts:  []string{"captures"},
+			expectedValues: []string{"captures"},
+		},
+		{
+			name:       "objects without jobs and audit records",
+			queryModel: queryModel{Action: "variables", Variable: "objects", S3Prefix: "captures"},
+			ctx:        context.Background(),
+			setupS3Mock: func(mockClient *MockS3Client) {
+				mockClient.On("ListObjectsV2", mock.Anything, mock.Anything).Return(&s3.ListObjectsV2Output{
+					Contents: []types.Object{
+						{Key: aws.String("captures/probe-1.pcap")},
+						{Key: aws.String("captures/audit/2025/10/01/20251001T123000.000000000Z-download-job-1.jsonl")},
+						{Key: aws.String("captures-job-1.pcapng")},
+						{Key: aws.String("captures-job-1.anonymized.pcapng")},
+						{Key: aws.String("captures-job-1.meta.json")},
+					},
+				}, nil)
+			},
+			expectedTexts:  []string{"/probe-1.pcap"},
+			expectedValues: []string{"captures/probe-1.pcap"},
+		},
+		{
+			name:           "objects outside the source prefixes",
+			queryModel:     queryModel{Action: "variables", Variable: "objects", S3Prefix: ""},
+			ctx:            context.Background(),
+			expectedStatus: backend.StatusBadRequest,
+		},
+		{
+			name:           "prefixes outside the source prefixes",
+			queryModel:     queryModel{Action: "variables", Variable: "prefixes", S3Prefix: "audit/"},
+			ctx:            context.Background(),
+			expectedStatus: backend.StatusBadRequest,
+		},
+		{
+			name:           "unknown variable",
+			queryModel:     queryModel{Action: "variables", Variable: "regions"},
+			ctx:            context.Background(),
+			expectedStatus: backend.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockSFNClient := &MockSFNClient{}
+			if tt.setupSFNMock != nil {
+				tt.setupSFNMock(mockSFNClient)
+			}
+			mockS3Client := &MockS3Client{}
+			if tt.setupS3Mock != nil {
+				tt.setupS3Mock(mockS3Client)
+			}
+
+			settings := authzSettings()
+			settings.SourcePrefixes = []string{"captures"}
+			settings.AuditS3Prefix = "captures/audit/"
+			ds := &Datasource{settings: settings, sfnClient: mockSFNClient, s3Client: mockS3Client}
+
+			response := ds.handleVariablesAction(tt.ctx, tt.queryModel)
+
+			if tt.expectedStatus != 0 {
+				require.Error(t, response.Error)
+				assert.Equal(t, tt.expectedStatus, response.Status)
+				return
+			}
+			require.NoError(t, response.Error)
+			require.Len(t, response.Frames, 1)
+			frame := response.Frames[0]
+			assert.Equal(t, "variables", frame.Name)
+
+			var texts, values []string
+			for i := 0; i < frame.Rows(); i++ {
+				texts = append(texts, frame.Fields[0].At(i).(string))
+				values = append(values, frame.Fields[1].At(i).(string))
+			}
+			assert.Equal(t, tt.expectedTexts, texts)
+			assert.Equal(t, tt.expectedValues, values)
+			mockSFNClient.AssertExpectations(t)
+			mockS3Client.AssertExpectations(t)
+		})
+	}
+}
+
+func TestBucketVariablesRequireSourcePrefixes(t *testing.T) {
+	mockS3Client := &MockS3Client{}
+	ds := &Datasource{settings: authzSettings(), sfnClient: &MockSFNClient{}, s3Client: mockS3Client}
+
+	response := ds.handleVariablesAction(context.Background(), queryModel{Action: "variables", Variable: "objects", S3Prefix: "captures/"})
+
+	require.Error(t, response.Error)
+	assert.Equal(t, backend.StatusBadRequest, response.Status)
+	mockS3Client.AssertNotCalled(t, "ListObjectsV2", mock.Anything, mock.Anything)
+}
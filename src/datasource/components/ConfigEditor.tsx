@@ -31,6 +31,36 @@ export function ConfigEditor(props: Props) {
     });
   };
 
+  const onSourceFileColumnChange = (event: ChangeEvent<HTMLInputElement>) => {
+    onOptionsChange({
+      ...options,
+      jsonData: {
+        ...jsonData,
+        sourceFileColumn: event.target.value,
+      },
+    });
+  };
+
+  const onPacketNumberColumnChange = (event: ChangeEvent<HTMLInputElement>) => {
+    onOptionsChange({
+      ...options,
+      jsonData: {
+        ...jsonData,
+        packetNumberColumn: event.target.value,
+      },
+    });
+  };
+
+  const onTimestampColumnChange = (event: ChangeEvent<HTMLInputElement>) => {
+    onOptionsChange({
+      ...options,
+      jsonData: {
+        ...jsonData,
+        timestampColumn: event.target.value,
+      },
+    });
+  };
+
   return (
     <>
       <ConnectionConfig {...props} />
@@ -59,6 +89,41 @@ export function ConfigEditor(props: Props) {
           </InlineField>
 
       </ConfigSection>
+
+      <Divider />
+      <ConfigSection title="Extract columns" description="Columns of query results that the PCAP Download button and upstream queries build the extract from">
+
+          <InlineField label="Source file" labelWidth={20} interactive tooltip={'Column naming the source file of a packet'}>
+            <Input
+              id="config-editor-source-file-column"
+              onChange={onSourceFileColumnChange}
+              value={jsonData.sourceFileColumn || ''}
+              placeholder="source_file"
+              width={60}
+            />
+          </InlineField>
+
+          <InlineField label="Packet number" labelWidth={20} interactive tooltip={'Column holding the number of a packet in its source file'}>
+            <Input
+              id="config-editor-packet-number-column"
+              onChange={onPacketNumberColumnChange}
+              value={jsonData.packetNumberColumn || ''}
+              placeholder="source_packet_number"
+              width={60}
+            />
+          </InlineField>
+
+          <InlineField label="Capture time" labelWidth={20} interactive tooltip={'Optional column holding the capture time of a packet, source files are extracted in the order of their first packet'}>
+            <Input
+              id="config-editor-timestamp-column"
+              onChange={onTimestampColumnChange}
+              value={jsonData.timestampColumn || ''}
+              placeholder="timestamp"
+              width={60}
+            />
+          </InlineField>
+
+      </ConfigSection>
     </>
   );
 }
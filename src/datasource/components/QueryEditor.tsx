@@ -1,16 +1,43 @@
-import React from 'react';
-import { Alert } from '@grafana/ui';
-import { QueryEditorProps } from '@grafana/data';
+import React, { ChangeEvent } from 'react';
+import { Alert, InlineField, Input, RadioButtonGroup } from '@grafana/ui';
+import { QueryEditorProps, SelectableValue } from '@grafana/data';
 import { DataSource } from '../datasource';
 import { DataSourceOptions, Query } from '../types';
 
 type Props = QueryEditorProps<DataSource, Query, DataSourceOptions>;
 
+// Actions that dashboards and alert rules can query, extractions are requested by the PCAP Download button
+const actionOptions: Array<SelectableValue<Query['action']>> = [
+  { label: 'Metrics', value: 'metrics', description: 'Executions that ended, their durations and the running ones' },
+  { label: 'Status', value: 'status', description: 'The status of a job' },
+];
+
 export function QueryEditor({ query, onChange, onRunQuery }: Props) {
+  const action = query.action === 'status' ? 'status' : 'metrics';
+
+  const onActionChange = (value: Query['action']) => {
+    onChange({ ...query, action: value });
+    onRunQuery();
+  };
+
+  const onJobIdChange = (event: ChangeEvent<HTMLInputElement>) => {
+    onChange({ ...query, action: 'status', jobId: event.target.value });
+  };
+
   return (
     <div>
-      <Alert title="PCAP Extractor Data Source" severity="warning">
-        This data source is not meant to be invoked directly, but from the PCAP Download button.
+      <InlineField label="Action" labelWidth={20} tooltip="Metrics can be used in alert rules">
+        <RadioButtonGroup options={actionOptions} value={action} onChange={onActionChange} />
+      </InlineField>
+
+      {action === 'status' && (
+        <InlineField label="Job ID" labelWidth={20} tooltip="The job to show the status of, may refer to a variable like $job">
+          <Input value={query.jobId || ''} onChange={onJobIdChange} onBlur={onRunQuery} placeholder="$job" width={40} />
+        </InlineField>
+      )}
+
+      <Alert title="PCAP Extractor Data Source" severity="info">
+        Extractions are not requested here, but from the PCAP Download button.
       </Alert>
     </div>
   );
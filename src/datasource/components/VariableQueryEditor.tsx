@@ -0,0 +1,70 @@
+import React, { ChangeEvent } from 'react';
+import { InlineField, Input, Select } from '@grafana/ui';
+import { QueryEditorProps, SelectableValue } from '@grafana/data';
+import { DataSource } from '../datasource';
+import { DataSourceOptions, Query } from '../types';
+
+type Props = QueryEditorProps<DataSource, Query, DataSourceOptions, Query>;
+
+type Variable = NonNullable<Query['variable']>;
+
+const variableOptions: Array<SelectableValue<Variable>> = [
+  { label: 'Job IDs', value: 'jobIds', description: 'The most recent jobs you may see' },
+  { label: 'Statuses', value: 'statuses', description: 'The statuses of Step Function executions' },
+  { label: 'Prefixes', value: 'prefixes', description: 'The prefixes directly below a source prefix' },
+  { label: 'Objects', value: 'objects', description: 'The source files below a source prefix' },
+];
+
+// VariableQueryEditor edits the query of a dashboard template variable, it always runs the variables action
+export function VariableQueryEditor({ query, onChange }: Props) {
+  const variable = query.variable ?? 'jobIds';
+
+  const update = (changes: Partial<Query>) => {
+    onChange({ ...query, action: 'variables', variable, ...changes });
+  };
+
+  return (
+    <>
+      <InlineField label="Values" labelWidth={20} tooltip="What the variable lists">
+        <Select
+          options={variableOptions}
+          value={variable}
+          onChange={(option) => update({ variable: option.value })}
+          width={40}
+        />
+      </InlineField>
+
+      {variable === 'jobIds' && (
+        <>
+          <InlineField label="Job ID prefix" labelWidth={20} tooltip="Only list jobs whose ID starts with this prefix">
+            <Input
+              value={query.jobIdPrefix || ''}
+              onChange={(event: ChangeEvent<HTMLInputElement>) => update({ jobIdPrefix: event.target.value })}
+              placeholder="incident-42-"
+              width={40}
+            />
+          </InlineField>
+          <InlineField label="Status" labelWidth={20} tooltip="Only list jobs with this status, e.g. SUCCEEDED">
+            <Input
+              value={query.statusFilter || ''}
+              onChange={(event: ChangeEvent<HTMLInputElement>) => update({ statusFilter: event.target.value })}
+              placeholder="SUCCEEDED"
+              width={40}
+            />
+          </InlineField>
+        </>
+      )}
+
+      {(variable === 'prefixes' || variable === 'objects') && (
+        <InlineField label="S3 prefix" labelWidth={20} tooltip="The prefix to list below, one of the source prefixes of the data source or below them">
+          <Input
+            value={query.s3Prefix || ''}
+            onChange={(event: ChangeEvent<HTMLInputElement>) => update({ s3Prefix: event.target.value })}
+            placeholder="captures/"
+            width={40}
+          />
+        </InlineField>
+      )}
+    </>
+  );
+}
@@ -1,10 +1,30 @@
-import { DataSourceInstanceSettings } from '@grafana/data';
-import { DataSourceWithBackend } from '@grafana/runtime';
+import { CoreApp, DataSourceInstanceSettings, ScopedVars } from '@grafana/data';
+import { DataSourceWithBackend, getTemplateSrv } from '@grafana/runtime';
 
 import { Query, DataSourceOptions } from './types';
+import { VariableSupport } from './variables';
 
 export class DataSource extends DataSourceWithBackend<Query, DataSourceOptions> {
   constructor(instanceSettings: DataSourceInstanceSettings<DataSourceOptions>) {
     super(instanceSettings);
+    this.variables = new VariableSupport(this);
+  }
+
+  // Dashboards and alert rules start with the metrics of the executions
+  getDefaultQuery(_: CoreApp): Partial<Query> {
+    return { action: 'metrics' };
+  }
+
+  // Job IDs, prefixes and filters may refer to template variables
+  applyTemplateVariables(query: Query, scopedVars: ScopedVars): Query {
+    const templateSrv = getTemplateSrv();
+    const replace = (value?: string) => (value ? templateSrv.replace(value, scopedVars) : value);
+    return {
+      ...query,
+      jobId: replace(query.jobId),
+      jobIdPrefix: replace(query.jobIdPrefix),
+      statusFilter: replace(query.statusFilter),
+      s3Prefix: replace(query.s3Prefix),
+    };
   }
 }
@@ -3,11 +3,83 @@ import { AwsAuthDataSourceJsonData } from '@grafana/aws-sdk';
 
 export interface Query extends DataQuery {
   bucket: string; // Job ID for the PCAP extraction
-  action: 'request' | 'status';
-  extract?: { [key: string]: number[] };
+  action: 'request' | 'status' | 'history' | 'retry' | 'variables' | 'metrics';
+  jobId?: string;
+  // packets per source file, as a plain list, ranges like [[1,500],[720,721]] or a string like "1-500,720"
+  extract?: { [key: string]: Array<number | [number, number]> | string };
+  fileOrder?: string[];
+  selection?: FlowSelection;
+  upstream?: UpstreamQuery;
+  variable?: 'jobIds' | 'statuses' | 'prefixes' | 'objects';
+  jobIdPrefix?: string;
+  statusFilter?: string;
+  s3Prefix?: string;
+}
+
+// FlowSelection selects packets by the time range of the query and flow criteria
+export interface FlowSelection {
+  files?: string[];
+  s3Prefix?: string;
+  srcIp?: string;
+  dstIp?: string;
+  srcPort?: number;
+  dstPort?: number;
+  protocol?: 'tcp' | 'udp' | 'sctp' | 'icmp';
+  imsi?: string;
+  teid?: number;
+}
+
+// UpstreamQuery refers to a query of another data source to build the extract from
+export interface UpstreamQuery {
+  datasourceUid: string;
+  query: object;
+  from?: string;
+  to?: string;
+}
+
+// Target is a further state machine with its buckets, source files below its prefixes are extracted by it
+export interface Target {
+  name: string;
+  region?: string;
+  stepFunctionArn: string;
+  s3Bucket: string;
+  sourceBucket?: string;
+  sourcePrefixes: string[];
+  assumeRoleArn?: string;
+  externalId?: string;
+  s3AssumeRoleArn?: string;
+  s3ExternalId?: string;
 }
 
 export interface DataSourceOptions extends AwsAuthDataSourceJsonData {
   stepFunctionArn?: string;
   s3Bucket?: string;
+  auditS3Prefix?: string;
+  statusRoles?: string[];
+  requestRoles?: string[];
+  downloadRoles?: string[];
+  shareJobsWithinOrg?: boolean;
+  maxRunningJobsPerUser?: number;
+  maxRunningJobsPerOrg?: number;
+  maxPacketsPerRequest?: number;
+  maxFilesPerRequest?: number;
+  dailyPacketBudget?: number;
+  maxRequestsPerMinute?: number;
+  maxConcurrentQueries?: number;
+  maxRetryAttempts?: number;
+  maxPacketNumber?: number;
+  maxRangesPerRequest?: number;
+  maxFileNameLength?: number;
+  sourcePrefixes?: string[];
+  checkSourceFiles?: boolean;
+  sourceBucket?: string;
+  s3AssumeRoleArn?: string;
+  s3ExternalId?: string;
+  extractEncoding?: 'list' | 'ranges';
+  upstreamDatasources?: string[];
+  targets?: Target[];
+  sourceFileColumn?: string;
+  packetNumberColumn?: string;
+  timestampColumn?: string;
+  logLevel?: 'debug' | 'info' | 'warn' | 'error';
 }
@@ -0,0 +1,25 @@
+import { CustomVariableSupport, DataQueryRequest, DataQueryResponse } from '@grafana/data';
+import { Observable } from 'rxjs';
+
+import { DataSource } from './datasource';
+import { VariableQueryEditor } from './components/VariableQueryEditor';
+import { Query } from './types';
+
+// VariableSupport runs template variable queries through the variables action of the backend, which answers with
+// text and value fields
+export class VariableSupport extends CustomVariableSupport<DataSource, Query> {
+  constructor(private readonly datasource: DataSource) {
+    super();
+  }
+
+  editor = VariableQueryEditor;
+
+  query(request: DataQueryRequest<Query>): Observable<DataQueryResponse> {
+    const targets = request.targets.map((query) => ({
+      ...query,
+      action: 'variables' as const,
+      variable: query.variable ?? 'jobIds',
+    }));
+    return this.datasource.query({ ...request, targets });
+  }
+}
@@ -1,7 +1,8 @@
 import React, { useState, useRef, useCallback } from 'react';
-import { PanelProps, Field, QueryResultMeta } from '@grafana/data';
-import { getBackendSrv } from '@grafana/runtime';
-import { PcapExtractorOptions, QueryTemplate } from 'panel/types';
+import { PanelProps, Field, QueryResultMeta, ScopedVars, DataSourceInstanceSettings } from '@grafana/data';
+import { getBackendSrv, getDataSourceSrv, getTemplateSrv } from '@grafana/runtime';
+import { PacketRange, PcapExtractorOptions, QueryTemplate } from 'panel/types';
+import { DataSourceOptions } from 'datasource/types';
 import { css } from '@emotion/css';
 import { useStyles2, Button, Alert, Spinner } from '@grafana/ui';
 
@@ -56,6 +57,20 @@ const parseResponse = (response: any): Map<string, string> => {
     }
   });
 
+  // Notices explain e.g. why a succeeded job has no download URL
+  const notices = (frame.schema.meta?.notices ?? []).map((notice: any) => notice.text).filter((text: string) => text);
+  if (notices.length > 0) {
+    fieldValues.set('notices', notices.join('\n'));
+  }
+
+  // Jobs split across targets have one download URL per sub-job
+  const subJobs = pcapResult.frames.find((f: any) => f?.schema?.name === 'step_function_sub_jobs');
+  const urlIndex = subJobs?.schema?.fields?.findIndex((field: any) => field.name === 'download_url') ?? -1;
+  if (urlIndex >= 0) {
+    const urls = (subJobs.data.values[urlIndex] as string[]).filter(url => url);
+    fieldValues.set('download_urls', urls.join('\n'));
+  }
+
   return fieldValues;
 };
 
@@ -89,16 +104,33 @@ async function queryBackend(query: QueryTemplate) {
   return parseResponse(response);
 }
 
+// Columns naming the source file and packet number, and optionally the capture time, as configured in the data source
+type ExtractColumns = {
+  sourceFile: string;
+  packetNumber: string;
+  timestamp?: string;
+}
+
+const getExtractColumns = (uid: string): ExtractColumns => {
+  const settings = getDataSourceSrv().getInstanceSettings(uid) as DataSourceInstanceSettings<DataSourceOptions> | undefined;
+  const jsonData: DataSourceOptions = settings?.jsonData ?? {};
+  return {
+    sourceFile: jsonData.sourceFileColumn || 'source_file',
+    packetNumber: jsonData.packetNumberColumn || 'source_packet_number',
+    timestamp: jsonData.timestampColumn || undefined,
+  };
+}
+
 const transformExtractData = (seriesData: {
   name?: string | undefined;
   fields: Field[] | undefined;
   length: number | undefined;
   refId?: string | undefined;
   meta?: QueryResultMeta | undefined
-})=>  {
+}, columns: ExtractColumns)=>  {
 
-  // Extract only the required fields: source_file and source_packet_number
-  const requiredFieldNames = ['source_file', 'source_packet_number'];
+  // Extract only the required fields: the source file and packet number
+  const requiredFieldNames = [columns.sourceFile, columns.packetNumber];
   const extractedFields = seriesData?.fields?.filter(field =>
     requiredFieldNames.includes(field.name)
   ).map(field => ({
@@ -117,10 +149,12 @@ const transformExtractData = (seriesData: {
   }
 
   // Transform data to group packet numbers by source file
-  const sourceFileField = extractedFields.find(field => field.name === 'source_file');
-  const packetNumberField = extractedFields.find(field => field.name === 'source_packet_number');
+  const sourceFileField = extractedFields.find(field => field.name === columns.sourceFile);
+  const packetNumberField = extractedFields.find(field => field.name === columns.packetNumber);
+  const timestampField = seriesData?.fields?.find(field => columns.timestamp && field.name === columns.timestamp);
 
-  const extractData: { [sourceFile: string]: number[] } = {};
+  const packetsByFile: { [sourceFile: string]: Set<number> } = {};
+  const firstCapture: { [sourceFile: string]: number } = {};
 
   if (sourceFileField && packetNumberField) {
     const sourceFiles = sourceFileField.values;
@@ -130,17 +164,61 @@ const transformExtractData = (seriesData: {
       const sourceFile = sourceFiles[i] as string;
       const packetNumber = packetNumbers[i] as number;
 
-      if (!extractData[sourceFile]) {
-        extractData[sourceFile] = [];
+      if (!packetsByFile[sourceFile]) {
+        packetsByFile[sourceFile] = new Set();
       }
+      packetsByFile[sourceFile].add(packetNumber);
 
-      if (!extractData[sourceFile].includes(packetNumber)) {
-        extractData[sourceFile].push(packetNumber);
+      const captured = timestampField?.values[i];
+      if (captured != null && !(firstCapture[sourceFile] <= captured)) {
+        firstCapture[sourceFile] = captured;
       }
     }
   }
 
-  return extractData;
+  // Send runs of consecutive packets as ranges to keep the request small
+  const extractData: { [sourceFile: string]: PacketRange[] } = {};
+  for (const [sourceFile, packets] of Object.entries(packetsByFile)) {
+    extractData[sourceFile] = toPacketRanges(Array.from(packets));
+  }
+
+  // Order the files by their first captured packet, files without capture time last
+  let fileOrder: string[] | undefined;
+  if (Object.keys(firstCapture).length > 0) {
+    fileOrder = Object.keys(extractData).sort((a, b) =>
+      (firstCapture[a] ?? Infinity) - (firstCapture[b] ?? Infinity) || a.localeCompare(b)
+    );
+  }
+
+  return { extractData, fileOrder };
+};
+
+// interpolateQuery replaces the template variables in every string of a query, as the data source would before running it
+const interpolateQuery = (value: any, scopedVars?: ScopedVars): any => {
+  if (typeof value === 'string') {
+    return getTemplateSrv().replace(value, scopedVars);
+  }
+  if (Array.isArray(value)) {
+    return value.map(item => interpolateQuery(item, scopedVars));
+  }
+  if (value && typeof value === 'object') {
+    return Object.fromEntries(Object.entries(value).map(([key, item]) => [key, interpolateQuery(item, scopedVars)]));
+  }
+  return value;
+};
+
+// toPacketRanges sorts packet numbers into ranges of consecutive numbers
+const toPacketRanges = (packets: number[]): PacketRange[] => {
+  const ranges: PacketRange[] = [];
+  for (const packet of [...packets].sort((a, b) => a - b)) {
+    const last = ranges[ranges.length - 1];
+    if (last && last[1] + 1 === packet) {
+      last[1] = packet;
+    } else {
+      ranges.push([packet, packet]);
+    }
+  }
+  return ranges;
 };
 
 function stopPolling(pollingIntervalRef: React.MutableRefObject<NodeJS.Timeout | null>) {
@@ -207,10 +285,20 @@ export const Download: React.FC<Props> = ({ options, data }) => {
 
           const downloadUrl = response.get('download_url');
           window.console.log('Download URL:', downloadUrl);
+          const downloadUrls = response.get('download_urls')?.split('\n').filter(url => url) ?? [];
+          stopPolling(pollingIntervalRef);
+
+          if (!downloadUrl && downloadUrls.length === 0) {
+            setError(response.get('notices') || 'The job succeeded, but no download URL was returned');
+            setDownloadState('error');
+            return;
+          }
 
           setDownloadState('downloaded');
-          triggerDownload(downloadUrl);
-          stopPolling(pollingIntervalRef);
+          if (downloadUrl) {
+            triggerDownload(downloadUrl);
+          }
+          downloadUrls.forEach(triggerDownload);
 
         } else {
           window.console.error('Job ended with status:', status);
@@ -250,19 +338,32 @@ export const Download: React.FC<Props> = ({ options, data }) => {
         throw new Error('PCAP Extractor data source not configured');
       }
 
-      const seriesData = data.series?.[0];
-      let extractData;
-      try {
-        extractData = transformExtractData(seriesData);
-      } catch (error){
-        setError("" + error)
-        return;
-      }
+      let query = getQueryTemplate('request', jobId, options);
 
-      window.console.log('Extract data prepared', extractData);
+      const target = data.request?.targets?.[0];
+      if (options.serverSideExtract && target?.datasource?.uid) {
+        // The data source runs the panel query and collects the packets itself
+        query.upstream = {
+          datasourceUid: target.datasource.uid,
+          query: interpolateQuery(target, data.request?.scopedVars),
+          from: String(data.timeRange.from.valueOf()),
+          to: String(data.timeRange.to.valueOf()),
+        };
+        window.console.log('Upstream query prepared', query.upstream);
+      } else {
+        const seriesData = data.series?.[0];
+        let extractData, fileOrder;
+        try {
+          ({ extractData, fileOrder } = transformExtractData(seriesData, getExtractColumns(options.pcapExtractorDataSource)));
+        } catch (error){
+          setError("" + error)
+          return;
+        }
 
-      let query = getQueryTemplate('request', jobId, options);
-      query.extract = extractData
+        window.console.log('Extract data prepared', extractData);
+        query.extract = extractData
+        query.fileOrder = fileOrder
+      }
 
       const response = await queryBackend(query)
       window.console.log('Received response data', response);
@@ -33,6 +33,12 @@ export const plugin = new PanelPlugin<PcapExtractorOptions>(Download).setPanelOp
         },
       },
     })
+    .addBooleanSwitch({
+      path: 'serverSideExtract',
+      name: 'Build extract on the server',
+      description: 'Let the data source run the panel query and collect the packets itself, so large results do not pass through the browser. The queried data source must be allowed for upstream queries.',
+      defaultValue: false,
+    })
     .addTextInput({
       path: 'text',
       name: 'Button Text',
@@ -1,8 +1,15 @@
 export interface PcapExtractorOptions {
   pcapExtractorDataSource?: string;
+  serverSideExtract?: boolean;
   text: string;
 }
 
+// PacketRange is an inclusive range of packet numbers
+export type PacketRange = [number, number];
+
+// Packets of a source file, as a plain list, ranges or a string like "1-500,720"
+export type PacketSelection = Array<number | PacketRange> | string;
+
 export type QueryTemplate = {
   refId: string,
   datasource: {
@@ -10,6 +17,16 @@ export type QueryTemplate = {
     uid: string,
   },
   jobId: string;
-  action: 'request' | 'status';
-  extract?: { [key: string]: number[] };
+  action: 'request' | 'status' | 'history' | 'retry' | 'variables' | 'metrics';
+  extract?: { [key: string]: PacketSelection };
+  fileOrder?: string[];
+  upstream?: UpstreamQuery;
+}
+
+// UpstreamQuery refers to a query the data source runs to build the extract itself
+export type UpstreamQuery = {
+  datasourceUid: string;
+  query: object;
+  from?: string;
+  to?: string;
 }